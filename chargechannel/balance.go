@@ -0,0 +1,230 @@
+package chargechannel
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+)
+
+// BalanceQuerier 商户余额查询,是渠道的可选能力,支持查询余额的渠道(充值或者代付)实现这个接口
+type BalanceQuerier interface {
+	// Balance 查询商户在渠道的余额,单位为元
+	Balance(ctx context.Context) (balance Balance, err error)
+}
+
+// Balance 商户余额
+type Balance struct {
+	Available decimal.Decimal `json:"available"` // 可用余额
+	Frozen    decimal.Decimal `json:"frozen"`    // 冻结余额,渠道没有返回时为0
+}
+
+// ChannelBalance 单个渠道的余额查询结果
+type ChannelBalance struct {
+	Key     ChannelKey `json:"key"`     // 渠道
+	Balance Balance    `json:"balance"` // 余额,Err!=nil时无意义
+	Err     error      `json:"-"`       // 查询错误
+}
+
+func (m manager) Balances(ctx context.Context, timeout time.Duration, keys ...ChannelKey) []ChannelBalance {
+	queriers := m.balanceQueriers(keys)
+
+	sorted := make([]ChannelKey, 0, len(queriers))
+	for key := range queriers {
+		sorted = append(sorted, key)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	result := make([]ChannelBalance, len(sorted))
+	wg := &sync.WaitGroup{}
+
+	for i, key := range sorted {
+		wg.Add(1)
+
+		go func(i int, key ChannelKey) {
+			defer wg.Done()
+
+			queryCtx := ctx
+
+			if timeout > 0 {
+				var cancel context.CancelFunc
+
+				queryCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			balance, err := queriers[key].Balance(queryCtx)
+
+			result[i] = ChannelBalance{
+				Key:     key,
+				Balance: balance,
+				Err:     errors.Wrapf(err, `查询渠道[%s]余额`, key.Text()),
+			}
+		}(i, key)
+	}
+
+	wg.Wait()
+
+	return result
+}
+
+// balanceQueriers 支持余额查询的渠道,keys为空时返回所有渠道,同一个key的充值和代付渠道是同一个商户,只查询一次
+func (m manager) balanceQueriers(keys []ChannelKey) map[ChannelKey]BalanceQuerier {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := make(map[ChannelKey]BalanceQuerier, len(m.channels))
+
+	for key, channel := range m.payouts {
+		if querier, ok := channel.(BalanceQuerier); ok {
+			result[key] = querier
+		}
+	}
+
+	for key, channel := range m.channels {
+		if querier, ok := channel.(BalanceQuerier); ok {
+			result[key] = querier
+		}
+	}
+
+	if len(keys) == 0 {
+		return result
+	}
+
+	selected := make(map[ChannelKey]BalanceQuerier, len(keys))
+
+	for _, key := range keys {
+		if querier, exist := result[key]; exist {
+			selected[key] = querier
+		}
+	}
+
+	return selected
+}
+
+// BalanceAlert 余额告警,余额低于阈值时调用
+type BalanceAlert func(key ChannelKey, balance Balance, threshold decimal.Decimal)
+
+// BalanceMonitor 余额监控,定时查询所有渠道的余额,可用余额低于阈值时告警
+type BalanceMonitor struct {
+	manager    Manager
+	thresholds map[ChannelKey]decimal.Decimal
+	interval   time.Duration
+	timeout    time.Duration
+	alert      BalanceAlert
+	logger     log.Logger
+	lock       *sync.Mutex
+	alerting   map[ChannelKey]bool // 已经告警,余额恢复前不再重复告警
+}
+
+/*NewBalanceMonitor 新建余额监控
+参数:
+*	manager   	Manager                       	渠道管理器
+*	thresholds	map[ChannelKey]decimal.Decimal	每个渠道的告警阈值,没有配置的渠道不监控
+*	interval  	time.Duration                 	查询间隔
+*	timeout   	time.Duration                 	单个渠道的查询超时时间,<=0时使用查询间隔
+*	alert     	BalanceAlert                  	告警
+*	logger    	log.Logger                    	日志器
+返回值:
+*	*BalanceMonitor	*BalanceMonitor	余额监控
+*	error          	error          	错误
+*/
+func NewBalanceMonitor(manager Manager, thresholds map[ChannelKey]decimal.Decimal, interval, timeout time.Duration, alert BalanceAlert, logger log.Logger) (*BalanceMonitor, error) { //nolint:lll
+	if manager == nil {
+		return nil, errors.New(`渠道管理器不能为空`)
+	}
+
+	if interval <= 0 {
+		return nil, errors.New(`查询间隔必须大于0`)
+	}
+
+	if alert == nil {
+		return nil, errors.New(`告警不能为空`)
+	}
+
+	if timeout <= 0 {
+		timeout = interval
+	}
+
+	return &BalanceMonitor{
+		manager:    manager,
+		thresholds: thresholds,
+		interval:   interval,
+		timeout:    timeout,
+		alert:      alert,
+		logger:     logger,
+		lock:       &sync.Mutex{},
+		alerting:   make(map[ChannelKey]bool, len(thresholds)),
+	}, nil
+}
+
+// Start 开始监控,ctx结束时停止
+func (b *BalanceMonitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+
+		for {
+			b.Check(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+/*Check 查询一次余额,可用余额低于阈值时告警,同一个渠道在余额恢复之前只告警一次
+参数:
+*	ctx	context.Context	上下文
+返回值:
+*/
+func (b *BalanceMonitor) Check(ctx context.Context) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if len(b.thresholds) == 0 {
+		return
+	}
+
+	keys := make([]ChannelKey, 0, len(b.thresholds))
+	for key := range b.thresholds {
+		keys = append(keys, key)
+	}
+
+	for _, balance := range b.manager.Balances(ctx, b.timeout, keys...) {
+		threshold := b.thresholds[balance.Key]
+
+		if balance.Err != nil {
+			b.logger.Warn(`查询余额失败`, zap.String(`渠道`, balance.Key.Text()), helpers.ZapError(balance.Err))
+			continue
+		}
+
+		if !balance.Balance.Available.LessThan(threshold) {
+			b.alerting[balance.Key] = false
+			continue
+		}
+
+		if b.alerting[balance.Key] {
+			continue
+		}
+
+		b.alerting[balance.Key] = true
+
+		b.logger.Warn(`余额不足`, zap.String(`渠道`, balance.Key.Text()), zap.String(`可用余额`, balance.Balance.Available.String()),
+			zap.String(`阈值`, threshold.String()))
+
+		b.alert(balance.Key, balance.Balance, threshold)
+	}
+}
@@ -0,0 +1,57 @@
+package bank
+
+import (
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// amountStep 金额尾数步长,按分递增
+	amountStep = `0.01`
+	// amountSlots 同一张卡同一订单金额最多同时存在的订单数
+	amountSlots = 99
+	// amountPrecision 金额精度,银行转账只到分
+	amountPrecision = 2
+	// finishLease 记录结果之后保存到accessor的最长时间,超过之后认为之前的处理已经中断,可以重新保存
+	finishLease = time.Minute
+)
+
+// Account 收款银行卡
+type Account struct {
+	BankName  string `json:"bankName"`  // 银行名称
+	Branch    string `json:"branch"`    // 开户行
+	AccountNo string `json:"accountNo"` // 卡号
+	Holder    string `json:"holder"`    // 持卡人
+}
+
+// Instruction 转账说明，返回给用户
+type Instruction struct {
+	Account
+	OrderNo   string          `json:"orderNo"`   // 商户订单号
+	PayAmount decimal.Decimal `json:"payAmount"` // 需要转账的精确金额
+	ExpireAt  time.Time       `json:"expireAt"`  // 过期时间
+}
+
+func newInstruction(account Account, order deposit.Order) Instruction {
+	return Instruction{
+		Account:   account,
+		OrderNo:   order.OrderNo,
+		PayAmount: order.PayAmount,
+		ExpireAt:  order.ExpireAt,
+	}
+}
+
+// confirmArgument 确认到账参数
+type confirmArgument struct {
+	Amount   decimal.Decimal `json:"amount"`   // 实际到账金额
+	TradeNo  string          `json:"tradeNo"`  // 银行流水号，可以为空
+	Operator string          `json:"operator"` // 操作人
+}
+
+// rejectArgument 驳回参数
+type rejectArgument struct {
+	Reason   string `json:"reason" binding:"required"` // 驳回原因
+	Operator string `json:"operator"`                  // 操作人
+}
@@ -0,0 +1,367 @@
+package bank
+
+// 线下银行卡转账,用户按照转账说明转账，运营人员核对银行流水后人工确认或者驳回
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/fighterlyt/log"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Service 服务
+type Service struct {
+	accounts map[string]Account     // 卡号->收款银行卡
+	pool     *deposit.Pool          // 收款卡池
+	accessor chargechannel.Accessor // 订单持久化
+	logger   log.Logger             // 日志器
+}
+
+/*NewService 新建服务
+参数:
+*	accounts	[]Account             	收款银行卡
+*	ttl     	time.Duration         	订单有效期,过期之后尾数可以分配给其他订单
+*	store   	deposit.Store         	订单存储,需要持久化,重启之后仍然可以人工处理
+*	accessor	chargechannel.Accessor	订单持久化，人工确认/驳回时调用
+*	logger  	log.Logger            	日志器
+返回值:
+*	*Service	*Service              	服务
+*	error   	error                 	错误
+*/
+func NewService(accounts []Account, ttl time.Duration, store deposit.Store, accessor chargechannel.Accessor, logger log.Logger) (*Service, error) { //nolint:lll
+	if accessor == nil {
+		return nil, errors.New(`accessor不能为空`)
+	}
+
+	accountMap := make(map[string]Account, len(accounts))
+	accountNos := make([]string, 0, len(accounts))
+
+	for _, account := range accounts {
+		accountMap[account.AccountNo] = account
+		accountNos = append(accountNos, account.AccountNo)
+	}
+
+	pool, err := deposit.NewPool(store, accountNos, decimal.RequireFromString(amountStep), amountSlots, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, `收款卡池`)
+	}
+
+	return &Service{
+		accounts: accountMap,
+		pool:     pool,
+		accessor: accessor,
+		logger:   logger,
+	}, nil
+}
+
+func (s Service) Key() chargechannel.ChannelKey {
+	return chargechannel.ChannelKeyBank
+}
+
+// PrivateKey 没有回调，也就没有私钥
+func (s Service) PrivateKey() string {
+	return ``
+}
+
+// Capabilities 渠道能力,不能主动查单,币种由银行卡决定
+func (s Service) Capabilities() chargechannel.Capabilities {
+	return chargechannel.Capabilities{}
+}
+
+// NeedCheck 既不主动查单，也没有回调，由运营人员人工确认
+func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need bool) {
+	return nil, false
+}
+
+func (s Service) CreateOrderNo(_ int64, _ decimal.Decimal) string {
+	return primitive.NewObjectID().Hex()
+}
+
+/*CreateOrder 创建订单,分配收款银行卡和带分尾数的精确金额,金额最多两位小数
+参数:
+*	_      	context.Context                      	上下文
+*	orderNo	string                               	商户订单号
+*	amount 	decimal.Decimal                      	订单金额
+*	_      	string                               	回调地址(无用)
+*	_      	*chargechannel.CreateOrderExtendParam	额外参数(无用)
+返回值:
+*	result 	*chargechannel.CreateOrderResult	转账说明和收款账户
+*	err    	error                           	错误
+*/
+func (s Service) CreateOrder(_ context.Context, orderNo string, amount decimal.Decimal, _ string, _ *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) { //nolint:lll
+	var order deposit.Order
+
+	// 截断会改变用户需要支付的金额,精度超过银行卡支持的位数时直接拒绝
+	if !amount.Equal(amount.Truncate(amountPrecision)) {
+		return nil, errors.Wrapf(chargechannel.ErrInvalidArgument, `金额[%s]最多只能有%d位小数`, amount.String(), amountPrecision)
+	}
+
+	if order, err = s.pool.Allocate(orderNo, amount, deposit.Watch{}); err != nil {
+		return nil, errors.Wrap(err, `分配收款银行卡`)
+	}
+
+	account := s.accounts[order.Account]
+
+	payHtml := fmt.Sprintf(`<p>请在%s之前向以下银行卡转账<b>%s</b>元,金额必须完全一致</p><p>银行:%s %s</p><p>卡号:%s</p><p>户名:%s</p>`,
+		order.ExpireAt.Format(time.RFC3339), order.PayAmount.StringFixed(amountPrecision), html.EscapeString(account.BankName),
+		html.EscapeString(account.Branch), html.EscapeString(account.AccountNo), html.EscapeString(account.Holder))
+
+	return &chargechannel.CreateOrderResult{
+		PayHTML: payHtml,
+		Instruction: &chargechannel.TransferInstruction{
+			BankName:  account.BankName,
+			Branch:    account.Branch,
+			AccountNo: account.AccountNo,
+			Holder:    account.Holder,
+			Amount:    order.PayAmount,
+		},
+		ExpireAt: order.ExpireAt,
+	}, nil
+}
+
+// Check 不支持主动查单
+func (s Service) Check(_ string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	return chargechannel.PaidUnknown, decimal.Zero, ``, chargechannel.ErrNotSupported
+}
+
+/*Instruction 订单的转账说明
+参数:
+*	orderNo    	string     	商户订单号
+返回值:
+*	instruction	Instruction	转账说明
+*	err        	error      	错误
+*/
+func (s Service) Instruction(orderNo string) (instruction Instruction, err error) {
+	var order deposit.Order
+
+	if order, err = s.pool.Load(orderNo); err != nil {
+		return instruction, err
+	}
+
+	return newInstruction(s.accounts[order.Account], order), nil
+}
+
+// Pending 所有等待人工处理的订单
+func (s Service) Pending() (result []Instruction, err error) {
+	var orders []deposit.Order
+
+	if orders, err = s.pool.List(); err != nil {
+		return nil, errors.Wrap(err, `加载订单`)
+	}
+
+	result = make([]Instruction, 0, len(orders))
+
+	for _, order := range orders {
+		result = append(result, newInstruction(s.accounts[order.Account], order))
+	}
+
+	return result, nil
+}
+
+/*Match 通过银行流水的收款卡号和金额找到对应的订单
+参数:
+*	accountNo  	string         	收款卡号
+*	amount     	decimal.Decimal	到账金额
+返回值:
+*	instruction	Instruction    	订单的转账说明
+*	err        	error          	错误
+*/
+func (s Service) Match(accountNo string, amount decimal.Decimal) (instruction Instruction, err error) {
+	var order deposit.Order
+
+	if order, err = s.pool.Find(accountNo, amount); err != nil {
+		return instruction, err
+	}
+
+	return newInstruction(s.accounts[order.Account], order), nil
+}
+
+/*Confirm 人工确认到账
+参数:
+*	orderNo   	string         	商户订单号
+*	tradeNo   	string         	银行流水号,用于对账,可以为空
+*	realAmount	decimal.Decimal	实际到账金额
+*	operator  	string         	操作人
+返回值:
+*	err       	error          	错误
+*/
+func (s Service) Confirm(orderNo, tradeNo string, realAmount decimal.Decimal, operator string) (err error) {
+	if !realAmount.IsPositive() {
+		return errors.New(`到账金额必须大于0`)
+	}
+
+	return s.finish(orderNo, operator, func(order *deposit.Order) {
+		if !realAmount.Equal(order.PayAmount) {
+			s.logger.Warn(`到账金额与订单不一致`, zap.String(`订单号`, orderNo), zap.String(`订单金额`, order.PayAmount.String()),
+				zap.String(`到账金额`, realAmount.String()), zap.String(`操作人`, operator))
+		}
+
+		order.Status, order.RealAmount, order.TradeNo = chargechannel.Paid, realAmount, tradeNo
+	})
+}
+
+/*Reject 人工驳回订单
+参数:
+*	orderNo 	string	商户订单号
+*	reason  	string	驳回原因
+*	operator	string	操作人
+返回值:
+*	err     	error 	错误
+*/
+func (s Service) Reject(orderNo, reason, operator string) (err error) {
+	if reason == `` {
+		return errors.New(`驳回原因不能为空`)
+	}
+
+	return s.finish(orderNo, operator, func(order *deposit.Order) {
+		order.Status, order.Reason = chargechannel.PaidFail, reason
+	})
+}
+
+/*finish 人工处理订单,先在订单存储中原子的记下结果,然后保存到accessor,最后释放尾数,保证同一个订单只入账一次(包括多实例部署)
+记下结果之后没有释放的订单(进程退出或者保存失败)可以重试,重试时保存的是已经记下的结果
+参数:
+*	orderNo 	string                    	商户订单号
+*	operator	string                    	操作人
+*	mark    	func(order *deposit.Order)	把这次处理的结果记在订单上
+返回值:
+*	err     	error                     	错误,订单已经处理或者正在处理时返回deposit.ErrFinished
+*/
+func (s Service) finish(orderNo, operator string, mark func(order *deposit.Order)) (err error) {
+	var order deposit.Order
+
+	if order, err = s.pool.Load(orderNo); err != nil {
+		return errors.Wrap(err, `加载订单`)
+	}
+
+	if order.Released {
+		return errors.Wrapf(deposit.ErrFinished, `订单[%s]`, orderNo)
+	}
+
+	if order.Finished() && time.Since(order.FinishedAt) < finishLease {
+		return errors.Wrapf(deposit.ErrFinished, `订单[%s]正在处理`, orderNo)
+	}
+
+	requested := order
+	mark(&requested)
+
+	// 已经记下的结果还没有保存到accessor时重新保存这个结果,不使用这次的处理
+	result := order
+	if !order.Finished() {
+		result = requested
+	}
+
+	result.FinishedAt = time.Now()
+
+	// 以加载时的记录时间为条件保存,并发的确认或者驳回只有一个能成功
+	if err = s.pool.Finish(result, order.FinishedAt); err != nil {
+		return errors.Wrap(err, `记录订单结果`)
+	}
+
+	if err = s.record(result); err != nil {
+		// 提前让记录时间超时,运营人员可以立即重试,失败时等待超时之后重试
+		result.FinishedAt = result.FinishedAt.Add(-finishLease)
+
+		if updateErr := s.pool.Update(result); updateErr != nil {
+			s.logger.Warn(`重置订单记录时间失败`, zap.String(`订单号`, orderNo), helpers.ZapError(updateErr))
+		}
+
+		return errors.Wrap(err, `保存订单结果`)
+	}
+
+	if err = s.pool.Release(orderNo); err != nil {
+		s.logger.Warn(`释放收款卡尾数失败`, zap.String(`订单号`, orderNo), helpers.ZapError(err))
+	}
+
+	s.logger.Info(`人工处理订单`, zap.String(`订单号`, orderNo), zap.String(`操作人`, operator))
+
+	if !sameResult(result, requested) {
+		return errors.Wrapf(deposit.ErrFinished, `订单[%s]已经有不同的处理结果`, orderNo)
+	}
+
+	return nil
+}
+
+// record 把订单上记下的结果保存到accessor,重试时同一个订单可能重复保存同样的结果
+func (s Service) record(order deposit.Order) error {
+	if order.Status == chargechannel.Paid {
+		return s.accessor.SetRecordFinish(s.Key(), order.OrderNo, order.TradeNo, order.RealAmount, nil)
+	}
+
+	return s.accessor.SetRecordFinish(s.Key(), order.OrderNo, ``, decimal.Zero, errors.New(order.Reason))
+}
+
+// sameResult 两次处理的结果是否相同
+func sameResult(a, b deposit.Order) bool {
+	return a.Status == b.Status && a.RealAmount.Equal(b.RealAmount) && a.TradeNo == b.TradeNo && a.Reason == b.Reason
+}
+
+/*StartOperator 注册运营接口，调用方负责在group上做鉴权
+参数:
+*	group	gin.IRoutes	路由
+返回值:
+*/
+func (s Service) StartOperator(group gin.IRoutes) {
+	group.GET(`/orders`, s.httpPending)
+	group.POST(`/orders/:orderNo/confirm`, s.httpConfirm)
+	group.POST(`/orders/:orderNo/reject`, s.httpReject)
+}
+
+func (s Service) httpPending(ctx *gin.Context) {
+	pending, err := s.Pending()
+	if err != nil {
+		helpers.GetLogger(ctx, s.logger).Error(`加载待处理订单失败`, helpers.ZapError(err))
+		ctx.String(http.StatusInternalServerError, err.Error())
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, pending)
+}
+
+func (s Service) httpConfirm(ctx *gin.Context) {
+	argument := &confirmArgument{}
+
+	if err := ctx.ShouldBindJSON(argument); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Confirm(ctx.Param(`orderNo`), argument.TradeNo, argument.Amount, argument.Operator); err != nil {
+		helpers.GetLogger(ctx, s.logger).Error(`确认到账失败`, helpers.ZapError(err))
+		ctx.String(http.StatusOK, err.Error())
+
+		return
+	}
+
+	ctx.String(http.StatusOK, `ok`)
+}
+
+func (s Service) httpReject(ctx *gin.Context) {
+	argument := &rejectArgument{}
+
+	if err := ctx.ShouldBindJSON(argument); err != nil {
+		ctx.String(http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := s.Reject(ctx.Param(`orderNo`), argument.Reason, argument.Operator); err != nil {
+		helpers.GetLogger(ctx, s.logger).Error(`驳回订单失败`, helpers.ZapError(err))
+		ctx.String(http.StatusOK, err.Error())
+
+		return
+	}
+
+	ctx.String(http.StatusOK, `ok`)
+}
@@ -0,0 +1,280 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/fighterlyt/log"
+	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	logger log.Logger
+	err    error
+)
+
+func TestMain(m *testing.M) {
+	if logger, err = log.NewEasyLogger(true, false, ``, `test`); err != nil {
+		panic(err.Error())
+	}
+
+	os.Exit(m.Run())
+}
+
+type record struct {
+	tradeNo string
+	amount  decimal.Decimal
+	err     error
+}
+
+// accessor 记录SetRecordFinish的调用
+type accessor struct {
+	lock     sync.Mutex
+	finishes map[string]record
+	calls    int   // SetRecordFinish调用次数
+	setErr   error // 不为nil时SetRecordFinish返回这个错误
+}
+
+func (a *accessor) SetRecordStarted(_ int64, _ chargechannel.ChannelKey, _, _ string, _ error) error {
+	return nil
+}
+
+func (a *accessor) SetRecordFinish(_ chargechannel.ChannelKey, orderNo, tradeNo string, realAmount decimal.Decimal, err error) error { //nolint:lll
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.calls++
+
+	if a.setErr != nil {
+		return a.setErr
+	}
+
+	a.finishes[orderNo] = record{tradeNo: tradeNo, amount: realAmount, err: err}
+
+	return nil
+}
+
+func newTestService(t *testing.T) (*Service, *accessor) {
+	return newTestServiceWith(t, deposit.NewMemoryStore(time.Hour), time.Hour)
+}
+
+func newTestServiceWith(t *testing.T, store deposit.Store, ttl time.Duration) (*Service, *accessor) {
+	recorder := &accessor{finishes: map[string]record{}}
+
+	service, err := NewService([]Account{{BankName: `工商银行`, Branch: `北京分行`, AccountNo: `6222000000000001`, Holder: `张三`}},
+		ttl, store, recorder, logger)
+	require.NoError(t, err)
+
+	return service, recorder
+}
+
+func createOrder(t *testing.T, service *Service, amount decimal.Decimal) Instruction {
+	orderNo := service.CreateOrderNo(0, amount)
+
+	result, err := service.CreateOrder(context.Background(), orderNo, amount, ``, nil)
+	require.NoError(t, err)
+
+	instruction, err := service.Instruction(orderNo)
+	require.NoError(t, err)
+	require.Contains(t, result.PayHTML, instruction.AccountNo)
+	require.Contains(t, result.PayHTML, instruction.PayAmount.StringFixed(amountPrecision))
+	require.Equal(t, instruction.AccountNo, result.Instruction.AccountNo)
+	require.True(t, instruction.PayAmount.Equal(result.Instruction.Amount))
+	require.Equal(t, instruction.ExpireAt, result.ExpireAt)
+
+	return instruction
+}
+
+func TestService_Confirm(t *testing.T) {
+	service, recorder := newTestService(t)
+
+	first := createOrder(t, service, decimal.New(100, 0))
+	second := createOrder(t, service, decimal.New(100, 0))
+
+	require.False(t, first.PayAmount.Equal(second.PayAmount), `同一张卡上金额尾数必须不同`)
+	pending, err := service.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+
+	matched, err := service.Match(second.AccountNo, second.PayAmount)
+	require.NoError(t, err)
+	require.Equal(t, second.OrderNo, matched.OrderNo)
+
+	require.NoError(t, service.Confirm(second.OrderNo, `B20220601001`, second.PayAmount, `admin`))
+	require.True(t, recorder.finishes[second.OrderNo].amount.Equal(second.PayAmount))
+	require.Equal(t, `B20220601001`, recorder.finishes[second.OrderNo].tradeNo)
+	require.NoError(t, recorder.finishes[second.OrderNo].err)
+
+	require.Error(t, service.Confirm(second.OrderNo, ``, second.PayAmount, `admin`), `不能重复确认`)
+
+	require.NoError(t, service.Reject(first.OrderNo, `未收到转账`, `admin`))
+	require.Error(t, recorder.finishes[first.OrderNo].err)
+	pending, err = service.Pending()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	_, need := service.NeedCheck()
+	require.False(t, need)
+}
+
+func TestService_ConfirmAfterRestart(t *testing.T) {
+	store := deposit.NewMemoryStore(time.Hour)
+	service, _ := newTestServiceWith(t, store, time.Millisecond*50)
+
+	instruction := createOrder(t, service, decimal.New(100, 0))
+
+	time.Sleep(time.Millisecond * 100)
+
+	_ = createOrder(t, service, decimal.New(200, 0)) // 新订单不会清理过期但是未处理的订单
+
+	// 重启之后使用同一个存储
+	restarted, recorder := newTestServiceWith(t, store, time.Millisecond*50)
+
+	pending, err := restarted.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+
+	require.NoError(t, restarted.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`), `过期的订单仍然可以人工确认`)
+	require.True(t, recorder.finishes[instruction.OrderNo].amount.Equal(instruction.PayAmount))
+}
+
+func TestService_ConfirmOnce(t *testing.T) {
+	store := deposit.NewMemoryStore(time.Hour)
+	service, recorder := newTestServiceWith(t, store, time.Hour)
+
+	instruction := createOrder(t, service, decimal.New(100, 0))
+
+	recorder.setErr = errors.New(`数据库错误`)
+	require.Error(t, service.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`))
+
+	pending, err := service.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1, `保存失败时订单仍然待处理`)
+
+	recorder.setErr = nil
+
+	// 两个实例共享同一个存储,同时确认同一个订单
+	other, otherRecorder := newTestServiceWith(t, store, time.Hour)
+
+	var (
+		wg      sync.WaitGroup
+		errs    = make([]error, 2)
+		confirm = []*Service{service, other}
+	)
+
+	for i := range confirm {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			errs[i] = confirm[i].Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`)
+		}(i)
+	}
+
+	wg.Wait()
+
+	require.Equal(t, 1, len(recorder.finishes)+len(otherRecorder.finishes), `只入账一次`)
+	require.True(t, (errs[0] == nil) != (errs[1] == nil))
+
+	for _, err := range errs {
+		if err != nil {
+			require.ErrorIs(t, err, deposit.ErrFinished)
+		}
+	}
+
+	require.ErrorIs(t, other.Reject(instruction.OrderNo, `未收到转账`, `admin`), deposit.ErrFinished)
+}
+
+func TestService_ConfirmSaveFailed(t *testing.T) {
+	service, recorder := newTestService(t)
+
+	instruction := createOrder(t, service, decimal.New(100, 0))
+
+	recorder.setErr = errors.New(`数据库错误`)
+	require.Error(t, service.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`))
+	require.Empty(t, recorder.finishes)
+
+	recorder.setErr = nil
+
+	// 结果已经记下,重试时保存记下的结果,不使用新的处理
+	require.ErrorIs(t, service.Reject(instruction.OrderNo, `未收到转账`, `admin`), deposit.ErrFinished)
+	require.NoError(t, recorder.finishes[instruction.OrderNo].err)
+	require.Equal(t, `B1`, recorder.finishes[instruction.OrderNo].tradeNo)
+
+	pending, err := service.Pending()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	require.ErrorIs(t, service.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`), deposit.ErrFinished)
+	require.Equal(t, 2, recorder.calls)
+}
+
+func TestService_ConfirmAfterCrash(t *testing.T) {
+	store := deposit.NewMemoryStore(time.Hour)
+	service, recorder := newTestServiceWith(t, store, time.Hour)
+
+	instruction := createOrder(t, service, decimal.New(100, 0))
+
+	// 记下结果之后,保存到accessor之前进程退出
+	order, err := store.Load(instruction.OrderNo)
+	require.NoError(t, err)
+
+	order.Status, order.RealAmount, order.TradeNo, order.FinishedAt = chargechannel.Paid, order.PayAmount, `B1`, time.Now()
+	require.NoError(t, store.Finish(order, time.Time{}))
+
+	require.ErrorIs(t, service.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`), deposit.ErrFinished,
+		`超时之前认为还在处理`)
+	require.Zero(t, recorder.calls)
+
+	order.FinishedAt = order.FinishedAt.Add(-finishLease)
+	require.NoError(t, store.Update(order))
+
+	require.NoError(t, service.Confirm(instruction.OrderNo, `B1`, instruction.PayAmount, `admin`), `超时之后重新保存`)
+	require.True(t, recorder.finishes[instruction.OrderNo].amount.Equal(instruction.PayAmount))
+	require.Equal(t, 1, recorder.calls)
+}
+
+func TestService_CreateOrderPrecision(t *testing.T) {
+	service, _ := newTestService(t)
+
+	_, err := service.CreateOrder(context.Background(), service.CreateOrderNo(0, decimal.Zero), decimal.RequireFromString(`100.005`), ``, nil)
+	require.True(t, chargechannel.IsInvalidArgument(err), `超过两位小数的金额不能截断,没有请求渠道`)
+
+	pending, err := service.Pending()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+}
+
+func TestService_StartOperator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	service, recorder := newTestService(t)
+	engine := gin.New()
+	service.StartOperator(engine.Group(`/bank`))
+
+	instruction := createOrder(t, service, decimal.New(50, 0))
+
+	resp := httptest.NewRecorder()
+	engine.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, `/bank/orders`, nil))
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Contains(t, resp.Body.String(), instruction.OrderNo)
+
+	resp = httptest.NewRecorder()
+	engine.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, `/bank/orders/`+instruction.OrderNo+`/confirm`,
+		strings.NewReader(`{"amount":"`+instruction.PayAmount.String()+`","tradeNo":"B1","operator":"admin"}`)))
+	require.Equal(t, `ok`, resp.Body.String())
+	require.True(t, recorder.finishes[instruction.OrderNo].amount.Equal(instruction.PayAmount))
+	require.Equal(t, `B1`, recorder.finishes[instruction.OrderNo].tradeNo)
+}
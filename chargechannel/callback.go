@@ -0,0 +1,93 @@
+package chargechannel
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/pkg/errors"
+)
+
+// CallBackEncoding 异步回调的编码方式
+type CallBackEncoding int
+
+const (
+	CallBackJSON  CallBackEncoding = 0 // json body,默认
+	CallBackForm  CallBackEncoding = 1 // application/x-www-form-urlencoded body,字段使用form标签
+	CallBackQuery CallBackEncoding = 2 // url参数,字段使用form标签,通常是GET回调
+)
+
+func (c CallBackEncoding) String() string {
+	switch c {
+	case CallBackJSON:
+		return `json`
+	case CallBackForm:
+		return `form`
+	case CallBackQuery:
+		return `query`
+	default:
+		return `unknown`
+	}
+}
+
+// CallBackEncoder 回调模板声明自己的编码方式,没有实现时是CallBackJSON
+type CallBackEncoder interface {
+	// Encoding 编码方式
+	Encoding() CallBackEncoding
+}
+
+// callBackEncoding 模板的编码方式
+func callBackEncoding(template AsyncCallBackTemplate) CallBackEncoding {
+	if encoder, ok := template.(CallBackEncoder); ok {
+		return encoder.Encoding()
+	}
+
+	return CallBackJSON
+}
+
+/*decodeCallBack 按照模板的编码方式解码回调并且验证签名
+参数:
+*	template  	AsyncCallBackTemplate	回调模板
+*	privateKey	string               	渠道私钥
+*	request   	*http.Request        	回调请求
+返回值:
+*	resp      	AsyncCallBackTemplate	解码后的回调,失败时也不为nil,用于生成应答
+*	err       	error                	错误
+*/
+func decodeCallBack(template AsyncCallBackTemplate, privateKey string, request *http.Request) (resp AsyncCallBackTemplate, err error) {
+	resp = template.New()
+
+	switch encoding := callBackEncoding(resp); encoding {
+	case CallBackForm:
+		err = binding.FormPost.Bind(request, resp)
+	case CallBackQuery:
+		err = binding.Query.Bind(request, resp)
+	case CallBackJSON:
+		if request.Body == nil {
+			return resp, errors.New(`解码失败:回调body为空`)
+		}
+
+		err = json.NewDecoder(request.Body).Decode(resp)
+	default:
+		return resp, errors.Errorf(`不支持的回调编码方式[%d]`, encoding)
+	}
+
+	if err != nil {
+		return resp, errors.Wrap(err, `解码失败`)
+	}
+
+	if err = resp.Validate(privateKey); err != nil {
+		return resp, errors.Wrap(err, `验证失败`)
+	}
+
+	return resp, nil
+}
+
+// callBackPrefix 回调地址的前缀,使用url参数的回调是GET请求,走/callback路径
+func callBackPrefix(channel Channel) string {
+	if template, _ := channel.NeedCheck(); template != nil && callBackEncoding(template) == CallBackQuery {
+		return `/callback/`
+	}
+
+	return `/`
+}
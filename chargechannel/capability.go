@@ -0,0 +1,115 @@
+package chargechannel
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// 下单时需要的额外参数,对应CreateOrderExtendParam的字段
+const (
+	ExtendFieldPayCode    = `payCode`    // CreateOrderExtendParam.PayCode
+	ExtendFieldUserID     = `userId`     // CreateOrderExtendParam.UserID
+	ExtendFieldUserIP     = `userIp`     // CreateOrderExtendParam.UserIP
+	ExtendFieldSuccessURL = `successUrl` // CreateOrderExtendParam.SuccessURL
+)
+
+// Capabilities 渠道能力,注册时读取,调用方不需要通过调用之后判断ErrNotSupported来探测
+type Capabilities struct {
+	ActiveQuery  bool     `json:"activeQuery"`  // 支持主动查单(Check)
+	Callback     bool     `json:"callback"`     // 支持异步回调,由NeedCheck返回的模板决定,不需要声明
+	Refund       bool     `json:"refund"`       // 支持退款,实现了Refunder,不需要声明
+	Payout       bool     `json:"payout"`       // 支持代付,实现了PayoutChannel,不需要声明
+	Balance      bool     `json:"balance"`      // 支持余额查询,实现了BalanceQuerier,不需要声明
+	ExtendFields []string `json:"extendFields"` // 下单时必须提供的额外参数,ExtendField开头的常量
+	Currencies   []string `json:"currencies"`   // 支持的币种,例如RUB,USDT
+}
+
+// CapabilityDeclarer 渠道声明自己的能力,只需要声明ActiveQuery,ExtendFields,Currencies,其他能力以实现为准
+type CapabilityDeclarer interface {
+	// Capabilities 渠道能力
+	Capabilities() Capabilities
+}
+
+/*CapabilitiesOf 渠道的能力,没有实现CapabilityDeclarer时,需要主动查单(NeedCheck返回need==true)的渠道认为支持查单
+参数:
+*	channel     	Channel     	渠道
+返回值:
+*	capabilities	Capabilities	能力
+*/
+func CapabilitiesOf(channel Channel) (capabilities Capabilities) {
+	template, need := channel.NeedCheck()
+
+	if declarer, ok := channel.(CapabilityDeclarer); ok {
+		capabilities = declarer.Capabilities()
+	} else {
+		capabilities.ActiveQuery = need
+	}
+
+	_, capabilities.Refund = channel.(Refunder)
+	_, capabilities.Payout = channel.(PayoutChannel)
+	_, capabilities.Balance = channel.(BalanceQuerier)
+	capabilities.Callback = template != nil
+
+	if capabilities.ExtendFields == nil {
+		capabilities.ExtendFields = []string{}
+	}
+
+	if capabilities.Currencies == nil {
+		capabilities.Currencies = []string{}
+	}
+
+	return capabilities
+}
+
+/*CheckExtend 检查下单的额外参数是否齐全
+参数:
+*	extend	*CreateOrderExtendParam	额外参数
+返回值:
+*	error 	error                  	缺少参数时返回ErrExtendRequired
+*/
+func (c Capabilities) CheckExtend(extend *CreateOrderExtendParam) error {
+	if extend == nil {
+		extend = &CreateOrderExtendParam{}
+	}
+
+	missing := make([]string, 0, len(c.ExtendFields))
+
+	for _, field := range c.ExtendFields {
+		var provided bool
+
+		switch field {
+		case ExtendFieldPayCode:
+			provided = extend.PayCode != 0
+		case ExtendFieldUserID:
+			provided = extend.UserID != 0
+		case ExtendFieldUserIP:
+			provided = extend.UserIP != ``
+		case ExtendFieldSuccessURL:
+			provided = extend.SuccessURL != ``
+		default:
+			provided = true // 不认识的参数交给渠道自己检查
+		}
+
+		if !provided {
+			missing = append(missing, field)
+		}
+	}
+
+	if len(missing) > 0 {
+		return errors.Wrapf(ErrExtendRequired, `缺少参数[%s]`, strings.Join(missing, `,`))
+	}
+
+	return nil
+}
+
+func (m manager) Capabilities(key ChannelKey) (capabilities Capabilities, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if data, exist := m.capabilities[key]; exist {
+		return data, nil
+	}
+
+	return capabilities, errors.Errorf(`key[%d]的渠道不存在`, key)
+}
@@ -0,0 +1,73 @@
+package chargechannel
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChannelInfo 渠道列表中的渠道
+type ChannelInfo struct {
+	Key            ChannelKey   `json:"key"`                      // 渠道,包括value和text
+	Limit          AmountLimit  `json:"limit"`                    // 金额限制
+	Enabled        bool         `json:"enabled"`                  // 是否启用
+	DisabledReason string       `json:"disabledReason,omitempty"` // 停用原因
+	Available      bool         `json:"available"`                // 现在是否可以下单,停用和不在可用时间内都是false
+	NextAvailable  time.Time    `json:"nextAvailable"`            // 下次可用时间,可用时是查询时间,停用时是零值(需要人工启用)
+	Capabilities   Capabilities `json:"capabilities"`             // 渠道能力,包括币种和下单需要的额外参数
+}
+
+func (m manager) List() []ChannelInfo {
+	now := time.Now()
+	schedules := make(map[ChannelKey]*schedule, initCapacity)
+
+	// 在同一个锁内读取渠道,限制,停用状态和可用时间,不会看到热更新的中间状态
+	m.lock.RLock()
+
+	result := make([]ChannelInfo, 0, len(m.channels))
+
+	for key := range m.channels {
+		info := ChannelInfo{
+			Key:           key,
+			Limit:         m.limits[key],
+			Enabled:       true,
+			Available:     true,
+			NextAvailable: now,
+			Capabilities:  m.capabilities[key],
+		}
+
+		if reason, disabled := m.disabled[key]; disabled {
+			info.Enabled, info.DisabledReason = false, reason
+			info.Available, info.NextAvailable = false, time.Time{}
+		}
+
+		if compiled, exist := m.schedules[key]; exist && info.Enabled {
+			schedules[key] = compiled
+		}
+
+		result = append(result, info)
+	}
+
+	m.lock.RUnlock()
+
+	for i := range result {
+		if compiled, exist := schedules[result[i].Key]; exist {
+			if reason, next := compiled.check(now); reason != `` {
+				result[i].Available, result[i].NextAvailable = false, next
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+
+	return result
+}
+
+// httpListChannels 渠道列表,前端根据列表展示充值方式
+func (s Service) httpListChannels(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, s.manager.List())
+}
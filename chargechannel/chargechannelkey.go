@@ -1,6 +1,9 @@
 package chargechannel
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/babybabylong/common/model"
 	"github.com/youthlin/t"
 )
@@ -19,30 +22,77 @@ var (
 	_ = t.T("线下银行卡转账")
 	_ = t.T("kab法币转账")
 	_ = t.T("银商渠道")
+	_ = t.T("proxypay(卢布)")
+	_ = t.T("proxypay(U)")
 )
 
+var (
+	textLock = &sync.RWMutex{}
+	texts    = make(map[ChannelKey]string, initCapacity) // 内置key以外的渠道注册的名称
+)
+
+/*RegisterText 为内置key以外的渠道(例如使用自定义key的MGP实例)注册名称
+参数:
+*	key 	ChannelKey	渠道key
+*	text	string    	名称
+返回值:
+*	bool	bool      	是否注册成功,内置key的名称不能覆盖
+*/
+func RegisterText(key ChannelKey, text string) bool {
+	if _, builtin := key.builtinText(); builtin {
+		return false
+	}
+
+	textLock.Lock()
+	defer textLock.Unlock()
+
+	texts[key] = text
+
+	return true
+}
+
+// Text 渠道名称,内置key以外的渠道使用RegisterText注册的名称,没有注册时显示key
 func (c ChannelKey) Text() string {
+	if text, builtin := c.builtinText(); builtin {
+		return text
+	}
+
+	textLock.RLock()
+	defer textLock.RUnlock()
+
+	if text, exist := texts[c]; exist {
+		return text
+	}
+
+	return fmt.Sprintf("未知(%d)", c)
+}
+
+func (c ChannelKey) builtinText() (text string, builtin bool) {
 	switch c {
 	case ChannelKeyAll:
-		return "全部"
+		return "全部", true
 	case ChannelKeyErc:
-		return "ERC20"
+		return "ERC20", true
 	case ChannelKeyTrc:
-		return "TRC20"
+		return "TRC20", true
 	case ChannelKeyEPay:
-		return "E-Pay"
+		return "E-Pay", true
 	case ChannelKeyBank:
-		return "银行卡支付"
+		return "银行卡支付", true
 	case ChannelKeyKab:
-		return "kab法币转账"
+		return "kab法币转账", true
 	case ChannelKeyMerchant:
-		return "银商渠道"
+		return "银商渠道", true
 	case ChannelKeyEPayRuble:
-		return "Eapy(卢布)"
+		return "Eapy(卢布)", true
 	case ChannelKeyEPayU:
-		return "Eapy(U)"
+		return "Eapy(U)", true
+	case ChannelKeyProxyRUR:
+		return "proxypay(卢布)", true
+	case ChannelKeyProxyUSDT:
+		return "proxypay(U)", true
 	default:
-		return "未知"
+		return ``, false
 	}
 }
 
@@ -57,11 +107,11 @@ const (
 	ChannelKeyEPay      ChannelKey = 3  // E-Pay(地平线)
 	ChannelKeyBank      ChannelKey = 4  // 线下银行卡转账(地平线)
 	ChannelKeyKab       ChannelKey = 5  // kab法币转账(zalaro)
-	ChannelKeyMerchant  ChannelKey = 6  // shop_club银商渠道
+	ChannelKeyMerchant  ChannelKey = 6  // shop_club银商渠道,仓库里没有银商的网关文档,还没有接入
 	ChannelKeyEPayRuble ChannelKey = 7  // shop_club Eapy(卢布)
 	ChannelKeyEPayU     ChannelKey = 8  // shop_club Eapy(U)
-	ChannelKeyProxyRUR  ChannelKey = 9  // shop_club proxypay RUR
-	ChannelKeyProxyUSDT ChannelKey = 10 // shop_club proxypay USDT
+	ChannelKeyProxyRUR  ChannelKey = 9  // shop_club proxypay RUR,仓库里没有proxypay的网关文档,还没有接入
+	ChannelKeyProxyUSDT ChannelKey = 10 // shop_club proxypay USDT,仓库里没有proxypay的网关文档,还没有接入
 )
 
 func (c ChannelKey) Protocol() model.Protocol {
@@ -0,0 +1,232 @@
+package deposit
+
+// 入金订单分配,供链上转账、线下转账这类没有三方下单接口的渠道使用
+// 同一个收款账户上同时存在的待支付订单，金额尾数各不相同，到账后通过(账户,金额)匹配到订单
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	initCapacity = 100
+)
+
+var (
+	// ErrNotFound 订单不存在
+	ErrNotFound = errors.New(`订单不存在`)
+	// ErrExhausted 没有可用的收款账户/金额尾数
+	ErrExhausted = errors.New(`没有可用的收款账户`)
+)
+
+// Order 待入账订单
+type Order struct {
+	OrderNo    string                   // 商户订单号
+	Account    string                   // 收款账户(钱包地址或者银行卡号)
+	Amount     decimal.Decimal          // 订单金额
+	PayAmount  decimal.Decimal          // 用户需要支付的精确金额(订单金额+尾数)，用于匹配到账记录
+	CreatedAt  time.Time                // 创建时间
+	ExpireAt   time.Time                // 过期时间
+	Status     chargechannel.PaidStatus // 最终结果,Paid或者PaidFail,零值表示还没有结果
+	RealAmount decimal.Decimal          // 实际到账金额,Status==Paid时有意义
+	TradeNo    string                   // 到账的交易(链上交易哈希或者银行流水号)
+	Reason     string                   // 失败原因,人工驳回时是驳回原因
+	FinishedAt time.Time                // 通过Finish记录结果的时间,结果保存到accessor之前作为并发处理的条件
+	Watch      Watch                    // 链上监听进度,只有需要的渠道使用
+	Released   bool                     // 是否已经释放占用的账户和尾数,由Store维护
+}
+
+// Watch 链上监听进度,和订单一起保存,重启之后从这里继续
+type Watch struct {
+	FromBlock  uint64 // 从这个区块开始查询转账
+	SeenTx     string // 已经看到但是确认数不足的转账交易哈希,为空表示还没有看到
+	SeenBlock  string // 看到的转账所在区块的哈希,和主链不一致表示发生了链重组
+	SeenNumber uint64 // 看到的转账所在区块的高度
+}
+
+// Expired 在now时订单是否已经过期
+func (o Order) Expired(now time.Time) bool {
+	return now.After(o.ExpireAt)
+}
+
+// Finished 订单是否已经有了最终结果,有结果之后重复查单直接返回这个结果
+func (o Order) Finished() bool {
+	return o.Status == chargechannel.Paid || o.Status == chargechannel.PaidFail
+}
+
+// Pool 收款账户池,订单保存在Store中,Pool只负责分配
+type Pool struct {
+	accounts []string        // 收款账户
+	step     decimal.Decimal // 尾数步长
+	slots    int             // 每个账户上同一订单金额最多同时存在的订单数
+	ttl      time.Duration   // 订单有效期
+	store    Store           // 订单存储
+	lock     *sync.Mutex     // 锁,保护next
+	next     int             // 下一次从哪个账户开始分配
+}
+
+/*NewPool 新建收款账户池
+参数:
+*	store   	Store          	订单存储,需要持久化
+*	accounts	[]string       	收款账户，不能为空
+*	step    	decimal.Decimal	金额尾数步长，例如0.01表示按分递增
+*	slots   	int            	同一账户同一订单金额最多可以同时存在的订单数
+*	ttl     	time.Duration  	订单有效期
+返回值:
+*	*Pool   	*Pool          	账户池
+*	error   	error          	错误
+*/
+func NewPool(store Store, accounts []string, step decimal.Decimal, slots int, ttl time.Duration) (*Pool, error) {
+	if store == nil {
+		return nil, errors.New(`订单存储不能为空`)
+	}
+
+	if len(accounts) == 0 {
+		return nil, errors.New(`收款账户不能为空`)
+	}
+
+	if !step.IsPositive() {
+		return nil, errors.New(`金额尾数步长必须大于0`)
+	}
+
+	if slots <= 0 {
+		return nil, errors.New(`尾数个数必须大于0`)
+	}
+
+	if ttl <= 0 {
+		return nil, errors.New(`订单有效期必须大于0`)
+	}
+
+	exists := make(map[string]struct{}, len(accounts))
+
+	for _, account := range accounts {
+		if account == `` {
+			return nil, errors.New(`收款账户不能为空`)
+		}
+
+		if _, exist := exists[account]; exist {
+			return nil, fmt.Errorf(`收款账户[%s]重复`, account)
+		}
+
+		exists[account] = struct{}{}
+	}
+
+	return &Pool{
+		accounts: append([]string{}, accounts...),
+		step:     step,
+		slots:    slots,
+		ttl:      ttl,
+		store:    store,
+		lock:     &sync.Mutex{},
+	}, nil
+}
+
+/*Allocate 为订单分配收款账户和精确支付金额,并保存到Store
+参数:
+*	orderNo	string         	商户订单号
+*	amount 	decimal.Decimal	订单金额
+*	watch  	Watch          	链上监听进度,不需要时传零值
+返回值:
+*	order  	Order          	分配结果
+*	err    	error          	错误,所有账户的尾数都被占用时返回ErrExhausted
+*/
+func (p *Pool) Allocate(orderNo string, amount decimal.Decimal, watch Watch) (order Order, err error) {
+	if !amount.IsPositive() {
+		return order, fmt.Errorf(`订单金额必须大于0:%w`, chargechannel.ErrInvalidArgument)
+	}
+
+	now := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for slot := 0; slot < p.slots; slot++ {
+		payAmount := amount.Add(p.step.Mul(decimal.NewFromInt(int64(slot))))
+
+		for i := range p.accounts {
+			account := p.accounts[(p.next+i)%len(p.accounts)]
+
+			order = Order{
+				OrderNo:   orderNo,
+				Account:   account,
+				Amount:    amount,
+				PayAmount: payAmount,
+				CreatedAt: now,
+				ExpireAt:  now.Add(p.ttl),
+				Watch:     watch,
+			}
+
+			// 占用由Store原子完成,多实例共享同一个Store时也不会分配到同一个尾数
+			if err = p.store.Insert(order, now); errors.Is(err, ErrOccupied) {
+				continue
+			} else if err != nil {
+				return Order{}, fmt.Errorf(`保存订单:%w`, err)
+			}
+
+			p.next = (p.next + i + 1) % len(p.accounts)
+
+			return order, nil
+		}
+	}
+
+	return Order{}, ErrExhausted
+}
+
+/*Load 加载订单,释放之后仍然可以加载
+参数:
+*	orderNo	string	商户订单号
+返回值:
+*	order  	Order 	订单
+*	err    	error 	错误,订单不存在时返回ErrNotFound
+*/
+func (p *Pool) Load(orderNo string) (order Order, err error) {
+	return p.store.Load(orderNo)
+}
+
+/*Find 通过到账的账户和金额查找订单
+参数:
+*	account  	string         	收款账户
+*	payAmount	decimal.Decimal	到账金额
+返回值:
+*	order    	Order          	订单
+*	err      	error          	错误,没有匹配的订单时返回ErrNotFound
+*/
+func (p *Pool) Find(account string, payAmount decimal.Decimal) (order Order, err error) {
+	return p.store.Find(account, payAmount)
+}
+
+// List 所有未释放的订单,按创建时间排序
+func (p *Pool) List() ([]Order, error) {
+	result, err := p.store.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+
+	return result, nil
+}
+
+// Update 保存订单的结果和监听进度
+func (p *Pool) Update(order Order) error {
+	return p.store.Update(order)
+}
+
+// Finish 以previous为条件保存订单的最终结果,条件不满足时返回ErrFinished,用于人工处理这类可能重复提交的场景
+// previous是加载订单时的FinishedAt,订单还没有结果时忽略
+func (p *Pool) Finish(order Order, previous time.Time) error {
+	return p.store.Finish(order, previous)
+}
+
+// Release 订单的结果已经保存，释放占用的账户和尾数,订单本身保留,重复查单返回同样的结果
+func (p *Pool) Release(orderNo string) error {
+	return p.store.Release(orderNo)
+}
@@ -0,0 +1,145 @@
+package deposit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool_Allocate(t *testing.T) {
+	pool, err := NewPool(NewMemoryStore(time.Hour), []string{`a`, `b`}, decimal.New(1, -2), 2, time.Hour)
+	require.NoError(t, err)
+
+	amount := decimal.New(100, 0)
+
+	var orders []Order
+
+	for _, orderNo := range []string{`1`, `2`, `3`, `4`} {
+		order, err := pool.Allocate(orderNo, amount, Watch{})
+		require.NoError(t, err)
+
+		orders = append(orders, order)
+	}
+
+	require.Equal(t, `a`, orders[0].Account)
+	require.Equal(t, `b`, orders[1].Account)
+	require.True(t, orders[0].PayAmount.Equal(amount))
+	require.True(t, orders[2].PayAmount.Equal(decimal.RequireFromString(`100.01`)))
+
+	_, err = pool.Allocate(`5`, amount, Watch{})
+	require.ErrorIs(t, err, ErrExhausted)
+
+	_, err = pool.Allocate(`5`, decimal.New(200, 0), Watch{})
+	require.NoError(t, err, `不同的订单金额不冲突`)
+
+	require.NoError(t, pool.Release(`1`))
+
+	order, err := pool.Allocate(`6`, amount, Watch{})
+	require.NoError(t, err)
+	require.Equal(t, orders[0].Account, order.Account)
+	require.True(t, orders[0].PayAmount.Equal(order.PayAmount))
+
+	released, err := pool.Load(`1`)
+	require.NoError(t, err, `释放之后订单仍然可以查询`)
+	require.True(t, released.Released)
+
+	found, err := pool.Find(order.Account, order.PayAmount)
+	require.NoError(t, err)
+	require.Equal(t, `6`, found.OrderNo)
+
+	_, err = pool.Allocate(`6`, decimal.New(300, 0), Watch{})
+	require.ErrorIs(t, err, ErrDuplicate)
+}
+
+func TestPool_AllocateExpired(t *testing.T) {
+	pool, err := NewPool(NewMemoryStore(time.Hour), []string{`a`}, decimal.New(1, -2), 1, time.Millisecond*50)
+	require.NoError(t, err)
+
+	_, err = pool.Allocate(`1`, decimal.New(100, 0), Watch{})
+	require.NoError(t, err)
+
+	_, err = pool.Allocate(`2`, decimal.New(100, 0), Watch{})
+	require.ErrorIs(t, err, ErrExhausted)
+
+	time.Sleep(time.Millisecond * 60)
+
+	_, err = pool.Allocate(`2`, decimal.New(100, 0), Watch{})
+	require.NoError(t, err, `过期订单占用的尾数可以复用`)
+
+	order, err := pool.Load(`1`)
+	require.NoError(t, err, `过期的订单仍然可以查询`)
+	require.True(t, order.Expired(time.Now()))
+}
+
+func TestPool_Update(t *testing.T) {
+	store := NewMemoryStore(0)
+
+	pool, err := NewPool(store, []string{`a`}, decimal.New(1, -2), 1, time.Millisecond*50)
+	require.NoError(t, err)
+
+	order, err := pool.Allocate(`1`, decimal.New(100, 0), Watch{FromBlock: 10})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), order.Watch.FromBlock)
+
+	order.Status, order.RealAmount = chargechannel.Paid, order.PayAmount
+	require.NoError(t, pool.Update(order))
+	require.NoError(t, pool.Release(`1`))
+
+	order.Watch.FromBlock = 20
+	require.NoError(t, pool.Update(order), `更新不改变释放状态`)
+
+	loaded, err := pool.Load(`1`)
+	require.NoError(t, err)
+	require.True(t, loaded.Finished())
+	require.True(t, loaded.Released)
+	require.Equal(t, uint64(20), loaded.Watch.FromBlock)
+
+	pending, err := pool.List()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	_, err = pool.Allocate(`2`, decimal.New(100, 0), Watch{})
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 60)
+
+	_, err = pool.Allocate(`3`, decimal.New(200, 0), Watch{})
+	require.NoError(t, err)
+
+	_, err = pool.Load(`1`)
+	require.ErrorIs(t, err, ErrNotFound, `释放并且过期超过保留时间的订单被清理`)
+
+	_, err = pool.Load(`2`)
+	require.NoError(t, err, `未释放的订单即使过期也不清理`)
+}
+
+func TestPool_Finish(t *testing.T) {
+	pool, err := NewPool(NewMemoryStore(time.Hour), []string{`a`}, decimal.New(1, -2), 1, time.Hour)
+	require.NoError(t, err)
+
+	order, err := pool.Allocate(`1`, decimal.New(100, 0), Watch{})
+	require.NoError(t, err)
+
+	order.Status, order.FinishedAt = chargechannel.Paid, time.Now()
+	require.NoError(t, pool.Finish(order, time.Time{}))
+
+	previous := order.FinishedAt
+
+	order.Status, order.FinishedAt = chargechannel.PaidFail, time.Now()
+	require.ErrorIs(t, pool.Finish(order, time.Time{}), ErrFinished, `已经有结果的订单不能再保存结果`)
+	require.ErrorIs(t, pool.Finish(order, previous.Add(-time.Second)), ErrFinished, `条件不一致`)
+
+	loaded, err := pool.Load(`1`)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, loaded.Status)
+
+	order.Status = chargechannel.Paid
+	require.NoError(t, pool.Finish(order, previous), `以记录时间为条件可以重新保存`)
+	require.ErrorIs(t, pool.Finish(order, previous), ErrFinished, `同一个条件只有一次能成功`)
+
+	order.OrderNo = `2`
+	require.ErrorIs(t, pool.Finish(order, time.Time{}), ErrNotFound)
+}
@@ -0,0 +1,199 @@
+package deposit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Store 订单存储,和chargechannel.Accessor一样由使用方实现,需要持久化,重启之后待支付的订单仍然可以查单和人工处理
+// 多实例部署时Insert需要保证原子性,例如mongo上(account,payAmount,released==false)的唯一索引
+type Store interface {
+	/*Insert 保存新订单并占用(账户,精确金额)
+	参数:
+	*	order	Order    	订单
+	*	now  	time.Time	当前时间,占用的订单已经过期时可以复用
+	返回值:
+	*	error	error    	错误,被未释放并且未过期的订单占用时返回ErrOccupied,订单号重复时返回ErrDuplicate
+	*/
+	Insert(order Order, now time.Time) error
+	// Load 加载订单,释放之后仍然可以加载,不存在时返回ErrNotFound
+	Load(orderNo string) (order Order, err error)
+	// Find 查找占用(账户,精确金额)的未释放订单,有多个时返回最后创建的,没有时返回ErrNotFound
+	Find(account string, payAmount decimal.Decimal) (order Order, err error)
+	// Pending 所有未释放的订单
+	Pending() (orders []Order, err error)
+	// Update 保存订单的结果和监听进度,不改变占用和释放状态
+	Update(order Order) error
+	// Finish 原子的保存订单的最终结果,订单还没有结果,或者已经有结果并且FinishedAt等于previous(非零)时保存,否则返回ErrFinished
+	// 多实例部署时需要以结果和FinishedAt为条件更新(compare-and-set)
+	Finish(order Order, previous time.Time) error
+	// Release 释放订单占用的(账户,精确金额),订单本身保留,已经释放时不返回错误
+	Release(orderNo string) error
+}
+
+var (
+	// ErrOccupied (账户,精确金额)已经被占用
+	ErrOccupied = errors.New(`金额已经被占用`)
+	// ErrDuplicate 订单号重复
+	ErrDuplicate = errors.New(`订单重复`)
+	// ErrFinished 订单已经有了最终结果
+	ErrFinished = errors.New(`订单已经处理`)
+)
+
+// memoryStore 内存订单存储,只适用于测试和不需要重启恢复的单实例部署
+type memoryStore struct {
+	lock      *sync.Mutex
+	retention time.Duration     // 释放的订单在过期之后保留多久
+	orders    map[string]Order  // 订单号->订单
+	used      map[string]string // (账户,精确金额)->订单号
+}
+
+/*NewMemoryStore 新建内存订单存储
+参数:
+*	retention	time.Duration	释放的订单在过期之后保留多久,这段时间内重复查单返回同样的结果
+返回值:
+*	Store    	Store        	存储
+*/
+func NewMemoryStore(retention time.Duration) Store {
+	return &memoryStore{
+		lock:      &sync.Mutex{},
+		retention: retention,
+		orders:    make(map[string]Order, initCapacity),
+		used:      make(map[string]string, initCapacity),
+	}
+}
+
+func (m *memoryStore) Insert(order Order, now time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.purge(now)
+
+	if _, exist := m.orders[order.OrderNo]; exist {
+		return fmt.Errorf(`订单[%s]:%w`, order.OrderNo, ErrDuplicate)
+	}
+
+	key := usedKey(order.Account, order.PayAmount)
+
+	if orderNo, exist := m.used[key]; exist && !m.orders[orderNo].Expired(now) {
+		return ErrOccupied
+	}
+
+	order.Released = false
+	m.orders[order.OrderNo] = order
+	m.used[key] = order.OrderNo
+
+	return nil
+}
+
+func (m *memoryStore) Load(orderNo string) (order Order, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var exist bool
+
+	if order, exist = m.orders[orderNo]; !exist {
+		return order, ErrNotFound
+	}
+
+	return order, nil
+}
+
+func (m *memoryStore) Find(account string, payAmount decimal.Decimal) (order Order, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	orderNo, exist := m.used[usedKey(account, payAmount)]
+	if !exist {
+		return order, ErrNotFound
+	}
+
+	return m.orders[orderNo], nil
+}
+
+func (m *memoryStore) Pending() (orders []Order, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	orders = make([]Order, 0, len(m.orders))
+
+	for _, order := range m.orders {
+		if !order.Released {
+			orders = append(orders, order)
+		}
+	}
+
+	return orders, nil
+}
+
+func (m *memoryStore) Update(order Order) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing, exist := m.orders[order.OrderNo]
+	if !exist {
+		return ErrNotFound
+	}
+
+	order.Released = existing.Released
+	m.orders[order.OrderNo] = order
+
+	return nil
+}
+
+func (m *memoryStore) Finish(order Order, previous time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	existing, exist := m.orders[order.OrderNo]
+	if !exist {
+		return ErrNotFound
+	}
+
+	if existing.Finished() && (previous.IsZero() || !existing.FinishedAt.Equal(previous)) {
+		return fmt.Errorf(`订单[%s]:%w`, order.OrderNo, ErrFinished)
+	}
+
+	order.Released = existing.Released
+	m.orders[order.OrderNo] = order
+
+	return nil
+}
+
+func (m *memoryStore) Release(orderNo string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	order, exist := m.orders[orderNo]
+	if !exist {
+		return ErrNotFound
+	}
+
+	order.Released = true
+	m.orders[orderNo] = order
+
+	key := usedKey(order.Account, order.PayAmount)
+
+	if m.used[key] == orderNo {
+		delete(m.used, key)
+	}
+
+	return nil
+}
+
+// purge 删除过期超过retention的已释放订单,未释放的订单一直保留,等待查单或者人工处理
+func (m *memoryStore) purge(now time.Time) {
+	for orderNo, order := range m.orders {
+		if order.Released && order.Expired(now.Add(-m.retention)) {
+			delete(m.orders, orderNo)
+		}
+	}
+}
+
+func usedKey(account string, payAmount decimal.Decimal) string {
+	return account + `|` + payAmount.String()
+}
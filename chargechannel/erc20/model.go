@@ -0,0 +1,44 @@
+package erc20
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	// amountStep 金额尾数步长,同一地址上同时存在的订单，通过尾数区分
+	amountStep = `0.0001`
+	// amountSlots 同一地址同一订单金额最多同时存在的订单数
+	amountSlots = 100
+	// network 转账说明中的网络名称
+	network = `ERC20`
+	// transferTopicCount Transfer事件的topic个数,事件签名+from+to
+	transferTopicCount = 3
+	// transferDataLength Transfer事件的data长度，只有value
+	transferDataLength = 32
+)
+
+var (
+	// transferTopic Transfer(address,address,uint256) 事件签名
+	transferTopic = crypto.Keccak256Hash([]byte(`Transfer(address,address,uint256)`))
+)
+
+// Client 以太坊节点客户端,ethclient.Client 和 backends.SimulatedBackend 都实现了这个接口
+type Client interface {
+	// HeaderByNumber 获取区块头,number==nil时返回最新区块
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+	// FilterLogs 查询日志
+	FilterLogs(ctx context.Context, query ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// Token 监听的ERC20代币
+type Token struct {
+	Contract common.Address // 合约地址
+	Decimals int32          // 精度
+	Symbol   string         // 币种,例如USDT,用于渠道能力和转账说明
+}
@@ -0,0 +1,388 @@
+package erc20
+
+// ERC20 链上充值
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Service 服务
+type Service struct {
+	client        Client                   // 节点客户端
+	tokens        map[common.Address]Token // 监听的代币
+	symbols       []string                 // 监听的代币的币种,按配置顺序去重
+	confirmations uint64                   // 需要的确认数
+	pool          *deposit.Pool            // 收款地址池,监听进度和订单一起保存
+	logger        log.Logger               // 日志器
+	grace         time.Duration            // 订单到期之后继续等待转账的时间
+	timeout       time.Duration            // 查询节点超时
+}
+
+/*NewService 新建服务
+参数:
+*	client       	Client          	节点客户端
+*	tokens       	[]Token         	监听的代币，转入其中任意一种都可以
+*	addresses    	[]common.Address	收款地址
+*	confirmations	uint64          	需要的确认数，达到之后才认为已支付
+*	ttl          	time.Duration   	订单有效期，只接受有效期内的区块中的转账
+*	grace        	time.Duration   	到期之后继续等待的时间,到期前发出的转账可能还没有被节点看到,超过之后没有到账认为支付失败
+*	timeout      	time.Duration   	查询节点超时,必须大于0
+*	store        	deposit.Store   	订单存储,需要持久化,重启之后继续查单
+*	logger       	log.Logger      	日志器
+返回值:
+*	*Service     	*Service        	服务
+*	error        	error           	错误
+*/
+func NewService(client Client, tokens []Token, addresses []common.Address, confirmations uint64, ttl, grace, timeout time.Duration, store deposit.Store, logger log.Logger) (*Service, error) { //nolint:lll
+	if client == nil {
+		return nil, errors.New(`节点客户端不能为空`)
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New(`代币不能为空`)
+	}
+
+	if confirmations == 0 {
+		return nil, errors.New(`确认数必须大于0`)
+	}
+
+	if grace < 0 {
+		return nil, errors.New(`等待时间不能小于0`)
+	}
+
+	if timeout <= 0 {
+		return nil, errors.New(`查询超时必须大于0`)
+	}
+
+	tokenMap := make(map[common.Address]Token, len(tokens))
+	symbols := make([]string, 0, len(tokens))
+
+	for _, token := range tokens {
+		if token.Symbol == `` {
+			return nil, fmt.Errorf(`代币[%s]的币种不能为空`, token.Contract.Hex())
+		}
+
+		tokenMap[token.Contract] = token
+
+		if !helpers.Contains(token.Symbol, symbols...) {
+			symbols = append(symbols, token.Symbol)
+		}
+	}
+
+	accounts := make([]string, 0, len(addresses))
+
+	for _, address := range addresses {
+		accounts = append(accounts, address.Hex())
+	}
+
+	pool, err := deposit.NewPool(store, accounts, decimal.RequireFromString(amountStep), amountSlots, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, `收款地址池`)
+	}
+
+	return &Service{
+		client:        client,
+		tokens:        tokenMap,
+		symbols:       symbols,
+		confirmations: confirmations,
+		pool:          pool,
+		logger:        logger,
+		grace:         grace,
+		timeout:       timeout,
+	}, nil
+}
+
+func (s Service) Key() chargechannel.ChannelKey {
+	return chargechannel.ChannelKeyErc
+}
+
+// PrivateKey 链上充值没有回调，也就没有私钥
+func (s Service) PrivateKey() string {
+	return ``
+}
+
+// Capabilities 渠道能力,链上充值只能主动查单,币种是监听的代币
+func (s Service) Capabilities() chargechannel.Capabilities {
+	return chargechannel.Capabilities{
+		ActiveQuery: true,
+		Currencies:  append([]string{}, s.symbols...),
+	}
+}
+
+// NeedCheck 链上充值只能主动查单
+func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need bool) {
+	return nil, true
+}
+
+func (s Service) CreateOrderNo(_ int64, _ decimal.Decimal) string {
+	return primitive.NewObjectID().Hex()
+}
+
+/*CreateOrder 创建订单,分配收款地址和精确支付金额,从当前最新区块之后开始监听
+参数:
+*	ctx    	context.Context                      	上下文
+*	orderNo	string                               	商户订单号
+*	amount 	decimal.Decimal                      	订单金额
+*	_      	string                               	回调地址(无用)
+*	_      	*chargechannel.CreateOrderExtendParam	额外参数(无用)
+返回值:
+*	result 	*chargechannel.CreateOrderResult	转账说明和收款账户
+*	err    	error                           	错误
+*/
+func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, _ string, _ *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) { //nolint:lll
+	var (
+		head  *types.Header
+		order deposit.Order
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if head, err = s.client.HeaderByNumber(ctx, nil); err != nil {
+		return nil, errors.Wrap(err, `获取最新区块`)
+	}
+
+	if order, err = s.pool.Allocate(orderNo, amount, deposit.Watch{FromBlock: head.Number.Uint64() + 1}); err != nil {
+		return nil, errors.Wrap(err, `分配收款地址`)
+	}
+
+	payHtml := fmt.Sprintf(`<p>请在%s之前向ERC20地址<b>%s</b>转账<b>%s</b> %s,金额必须完全一致</p>`,
+		order.ExpireAt.Format(time.RFC3339), html.EscapeString(order.Account), order.PayAmount.String(),
+		html.EscapeString(strings.Join(s.symbols, `/`)))
+
+	return &chargechannel.CreateOrderResult{
+		PayHTML:     payHtml,
+		QRContent:   order.Account,
+		Instruction: &chargechannel.TransferInstruction{BankName: network, AccountNo: order.Account, Amount: order.PayAmount},
+		ExpireAt:    order.ExpireAt,
+	}, nil
+}
+
+/*Order 加载订单的收款地址和精确支付金额
+参数:
+*	orderNo	string       	商户订单号
+返回值:
+*	order  	deposit.Order	订单
+*	err    	error        	错误
+*/
+func (s Service) Order(orderNo string) (order deposit.Order, err error) {
+	return s.pool.Load(orderNo)
+}
+
+/*Check 查单,在订单有效期内收到精确金额的转账，并且确认数足够时认为已支付。
+之前看到的转账如果因为链重组不在主链上了，订单回到等待转账，重新累计确认数。
+监听进度和结果保存在订单上，重复查单返回同样的结果，直到Service保存结果之后调用Release才释放收款地址
+参数:
+*	channelOrderNo	string                  	商户订单号
+返回值:
+*	paid          	chargechannel.PaidStatus	支付状态
+*	realAmount    	decimal.Decimal         	实际支付金额
+*	tradeNo       	string                  	到账的交易哈希,支付成功时才有
+*	err           	error                   	错误
+*/
+func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	var (
+		order deposit.Order
+		head  *types.Header
+		found *types.Log
+	)
+
+	if order, err = s.pool.Load(channelOrderNo); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `加载订单`)
+	}
+
+	if order.Finished() {
+		return order.Status, order.RealAmount, order.TradeNo, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if head, err = s.client.HeaderByNumber(ctx, nil); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `获取最新区块`)
+	}
+
+	if found, err = s.find(ctx, order, order.Watch.FromBlock, head.Number.Uint64()); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `查询转账`)
+	}
+
+	reorged, err := s.watch(&order, found)
+	if err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, err
+	}
+
+	if found == nil {
+		// 转账刚被链重组移除时可能还会重新打包,这次不判断过期;到期前发出的转账可能晚一些才被看到,超过等待时间之后才认为支付失败
+		if !reorged && order.Expired(time.Now().Add(-s.grace)) {
+			order.Status = chargechannel.PaidFail
+
+			return s.save(order)
+		}
+
+		return chargechannel.PaidProcessing, decimal.Zero, ``, nil
+	}
+
+	if head.Number.Uint64()-found.BlockNumber+1 < s.confirmations {
+		return chargechannel.PaidProcessing, decimal.Zero, ``, nil
+	}
+
+	s.logger.Info(`ERC20订单到账`, zap.String(`订单号`, channelOrderNo), zap.String(`交易`, found.TxHash.Hex()),
+		zap.String(`代币`, found.Address.Hex()))
+
+	order.Status, order.RealAmount, order.TradeNo = chargechannel.Paid, s.value(*found), found.TxHash.Hex()
+
+	return s.save(order)
+}
+
+/*watch 记录这次看到的转账并保存监听进度,之前看到的转账被链重组移除时撤销确认
+参数:
+*	order  	*deposit.Order	订单
+*	found  	*types.Log    	这次看到的转账,没有时为nil
+返回值:
+*	reorged	bool          	之前看到的转账是否被链重组移除
+*	err    	error         	错误
+*/
+func (s Service) watch(order *deposit.Order, found *types.Log) (reorged bool, err error) {
+	current := deposit.Watch{FromBlock: order.Watch.FromBlock}
+
+	if found != nil {
+		current.SeenTx, current.SeenBlock, current.SeenNumber = found.TxHash.Hex(), found.BlockHash.Hex(), found.BlockNumber
+	}
+
+	if current == order.Watch {
+		return false, nil
+	}
+
+	if order.Watch.SeenTx != `` {
+		reorged = true
+
+		s.logger.Warn(`转账被链重组移除,订单重新等待转账`, zap.String(`订单号`, order.OrderNo), zap.String(`交易`, order.Watch.SeenTx),
+			zap.Uint64(`区块`, order.Watch.SeenNumber))
+	}
+
+	order.Watch = current
+
+	if err = s.pool.Update(*order); err != nil {
+		return reorged, errors.Wrap(err, `保存监听进度`)
+	}
+
+	return reorged, nil
+}
+
+// save 保存订单的最终结果,保存失败时返回PaidUnknown,下次查单重新计算
+func (s Service) save(order deposit.Order) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	if err = s.pool.Update(order); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `保存查单结果`)
+	}
+
+	return order.Status, order.RealAmount, order.TradeNo, nil
+}
+
+// Release 结果已经由Service保存，释放收款地址上的金额尾数
+func (s Service) Release(orderNo string) error {
+	return s.pool.Release(orderNo)
+}
+
+/*find 在[from,to]区块中查找订单对应的转账,只返回仍然在主链上的转账
+参数:
+*	ctx  	context.Context	上下文
+*	order	deposit.Order  	订单
+*	from 	uint64         	开始区块
+*	to   	uint64         	结束区块
+返回值:
+*	found	*types.Log     	找到的转账,没有时返回nil
+*	err  	error          	错误
+*/
+func (s Service) find(ctx context.Context, order deposit.Order, from, to uint64) (found *types.Log, err error) {
+	if from > to {
+		return nil, nil
+	}
+
+	contracts := make([]common.Address, 0, len(s.tokens))
+
+	for contract := range s.tokens {
+		contracts = append(contracts, contract)
+	}
+
+	var logs []types.Log
+
+	if logs, err = s.client.FilterLogs(ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: contracts,
+		Topics:    [][]common.Hash{{transferTopic}, nil, {common.HexToAddress(order.Account).Hash()}},
+	}); err != nil {
+		return nil, errors.Wrap(err, `查询日志`)
+	}
+
+	for i := range logs {
+		if !s.match(order, logs[i]) {
+			continue
+		}
+
+		var canonical bool
+
+		if canonical, err = s.canonical(ctx, order, logs[i]); err != nil {
+			return nil, err
+		}
+
+		if canonical {
+			return &logs[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// match 日志是否是订单对应的转账:监听的代币，收款地址和金额完全一致
+func (s Service) match(order deposit.Order, item types.Log) bool {
+	if _, exist := s.tokens[item.Address]; !exist {
+		return false
+	}
+
+	if item.Removed || len(item.Topics) != transferTopicCount || len(item.Data) != transferDataLength {
+		return false
+	}
+
+	if common.BytesToAddress(item.Topics[2].Bytes()).Hex() != order.Account {
+		return false
+	}
+
+	return s.value(item).Equal(order.PayAmount)
+}
+
+// value 转账金额,调用前需要确认日志来自监听的代币
+func (s Service) value(item types.Log) decimal.Decimal {
+	return decimal.NewFromBigInt(new(big.Int).SetBytes(item.Data), -s.tokens[item.Address].Decimals)
+}
+
+// canonical 日志所在区块是否仍然在主链上,并且在订单有效期内
+func (s Service) canonical(ctx context.Context, order deposit.Order, item types.Log) (bool, error) {
+	header, err := s.client.HeaderByNumber(ctx, new(big.Int).SetUint64(item.BlockNumber))
+	if err != nil {
+		return false, errors.Wrapf(err, `获取区块[%d]`, item.BlockNumber)
+	}
+
+	if header.Hash() != item.BlockHash {
+		return false, nil
+	}
+
+	return header.Time <= uint64(order.ExpireAt.Unix()), nil
+}
@@ -0,0 +1,243 @@
+package erc20
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/fighterlyt/log"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	gasLimit = 8000000
+	chainID  = 1337 // 模拟链固定的chainID
+)
+
+var (
+	logger log.Logger
+	err    error
+	// tokenCode 测试用代币的部署代码，调用时把calldata中的(to,value)作为Transfer(msg.sender,to,value)事件发出
+	// 运行时代码: CALLDATACOPY(0,32,32) LOG3(0,32,TransferTopic,CALLER,CALLDATALOAD(0)) STOP
+	tokenCode = append(append(
+		common.FromHex(`0x6032600c60003960326000f3`+`60206020600037600035337f`),
+		transferTopic.Bytes()...),
+		common.FromHex(`0x60206000a300`)...)
+)
+
+func TestMain(m *testing.M) {
+	if logger, err = log.NewEasyLogger(true, false, ``, `test`); err != nil {
+		panic(err.Error())
+	}
+
+	os.Exit(m.Run())
+}
+
+// chain 模拟链
+type chain struct {
+	*backends.SimulatedBackend
+	key   *ecdsa.PrivateKey
+	token common.Address
+}
+
+func newChain(t *testing.T) *chain {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		crypto.PubkeyToAddress(key.PublicKey): {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+	}, gasLimit)
+	t.Cleanup(func() {
+		_ = sim.Close()
+	})
+
+	c := &chain{SimulatedBackend: sim, key: key}
+
+	tx := c.send(t, nil, tokenCode)
+	sim.Commit()
+
+	receipt, err := sim.TransactionReceipt(context.Background(), tx.Hash())
+	require.NoError(t, err)
+
+	c.token = receipt.ContractAddress
+
+	return c
+}
+
+func (c *chain) send(t *testing.T, to *common.Address, data []byte) *types.Transaction {
+	ctx := context.Background()
+
+	nonce, err := c.PendingNonceAt(ctx, crypto.PubkeyToAddress(c.key.PublicKey))
+	require.NoError(t, err)
+
+	gasPrice, err := c.SuggestGasPrice(ctx)
+	require.NoError(t, err)
+
+	tx, err := types.SignTx(types.NewTx(&types.LegacyTx{Nonce: nonce, To: to, Gas: gasLimit / 10, GasPrice: gasPrice, Data: data}),
+		types.LatestSignerForChainID(big.NewInt(chainID)), c.key)
+	require.NoError(t, err)
+	require.NoError(t, c.SendTransaction(ctx, tx))
+
+	return tx
+}
+
+// transfer 发送一笔代币转账，只进入待打包区块
+func (c *chain) transfer(t *testing.T, to string, value decimal.Decimal) {
+	data := append(common.HexToAddress(to).Hash().Bytes(), common.LeftPadBytes(value.Shift(6).BigInt().Bytes(), 32)...)
+
+	c.send(t, &c.token, data)
+}
+
+func (c *chain) mine(blocks int) {
+	for i := 0; i < blocks; i++ {
+		c.Commit()
+	}
+}
+
+func newTestService(t *testing.T, c *chain, ttl, grace time.Duration) *Service {
+	service, err := NewService(c, []Token{{Contract: c.token, Decimals: 6, Symbol: `USDC`}},
+		[]common.Address{common.HexToAddress(`0x1111111111111111111111111111111111111111`)}, 3, ttl, grace, time.Second, deposit.NewMemoryStore(time.Hour), logger)
+	require.NoError(t, err)
+
+	return service
+}
+
+func createOrder(t *testing.T, service *Service) string {
+	orderNo := service.CreateOrderNo(0, decimal.New(10, 0))
+
+	_, err := service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), ``, nil)
+	require.NoError(t, err)
+
+	return orderNo
+}
+
+func check(t *testing.T, service *Service, orderNo string, want chargechannel.PaidStatus) {
+	paid, _, _, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, want, paid)
+}
+
+func TestService_Check(t *testing.T) {
+	c := newChain(t)
+	service := newTestService(t, c, time.Hour, 0)
+	orderNo := createOrder(t, service)
+
+	order, err := service.Order(orderNo)
+	require.NoError(t, err)
+
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+
+	c.transfer(t, order.Account, order.PayAmount.Add(decimal.New(1, -2)))
+	c.transfer(t, order.Account, order.PayAmount)
+	c.mine(1)
+
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+
+	c.mine(2)
+
+	paid, realAmount, tradeNo, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid)
+	require.True(t, realAmount.Equal(order.PayAmount))
+	require.NotEmpty(t, tradeNo, `交易号是到账的交易哈希`)
+
+	require.NoError(t, service.Release(orderNo))
+	check(t, service, orderNo, chargechannel.Paid) // 释放之后重复查单返回同样的结果
+}
+
+func TestService_CreateOrder(t *testing.T) {
+	c := newChain(t)
+	service := newTestService(t, c, time.Hour, 0)
+
+	result, err := service.CreateOrder(context.Background(), service.CreateOrderNo(0, decimal.New(10, 0)), decimal.New(10, 0), ``, nil)
+	require.NoError(t, err)
+	require.Contains(t, result.PayHTML, `USDC`, `币种来自代币配置`)
+	require.Equal(t, []string{`USDC`}, service.Capabilities().Currencies)
+
+	_, err = NewService(c, []Token{{Contract: c.token, Decimals: 6}}, []common.Address{common.HexToAddress(`0x1111111111111111111111111111111111111111`)},
+		3, time.Hour, 0, time.Second, deposit.NewMemoryStore(time.Hour), logger)
+	require.Error(t, err, `代币必须配置币种`)
+
+	_, err = NewService(c, []Token{{Contract: c.token, Decimals: 6, Symbol: `USDC`}}, []common.Address{common.HexToAddress(`0x1111111111111111111111111111111111111111`)},
+		3, time.Hour, 0, 0, deposit.NewMemoryStore(time.Hour), logger)
+	require.Error(t, err, `查询超时为0时每次查询都已经超时`)
+}
+
+func TestService_CheckReorg(t *testing.T) {
+	c := newChain(t)
+	service := newTestService(t, c, time.Hour, 0)
+	orderNo := createOrder(t, service)
+
+	order, err := service.Order(orderNo)
+	require.NoError(t, err)
+
+	parent := c.Blockchain().CurrentBlock().Hash()
+
+	c.transfer(t, order.Account, order.PayAmount)
+	c.mine(2)
+
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+
+	// 从转账之前的区块分叉出一条更长的链，转账不在新的主链上
+	require.NoError(t, c.Fork(context.Background(), parent))
+	c.mine(4)
+
+	require.Equal(t, uint64(0), c.seen(t, service, orderNo), `转账被回滚后应该撤销确认`)
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+
+	// 转账在新链上重新打包,需要重新累计确认数
+	c.transfer(t, order.Account, order.PayAmount)
+	c.mine(1)
+
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+	require.NotZero(t, c.seen(t, service, orderNo))
+
+	c.mine(2)
+
+	check(t, service, orderNo, chargechannel.Paid)
+}
+
+// seen 订单已经看到的转账所在区块,没有时返回0
+func (c *chain) seen(t *testing.T, service *Service, orderNo string) uint64 {
+	check(t, service, orderNo, chargechannel.PaidProcessing)
+
+	order, err := service.Order(orderNo)
+	require.NoError(t, err)
+
+	return order.Watch.SeenNumber
+}
+
+func TestService_CheckExpired(t *testing.T) {
+	c := newChain(t)
+	service := newTestService(t, c, time.Millisecond*50, time.Millisecond*100)
+	late := createOrder(t, service)
+	orderNo := createOrder(t, service)
+
+	order, err := service.Order(late)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 70)
+
+	check(t, service, late, chargechannel.PaidProcessing) // 到期之后在等待时间内不认为支付失败
+
+	// 模拟链的区块时间早于订单到期时间,相当于到期前发出但是晚一些才被节点看到的转账
+	c.transfer(t, order.Account, order.PayAmount)
+	c.mine(3)
+
+	check(t, service, late, chargechannel.Paid)
+
+	time.Sleep(time.Millisecond * 100)
+
+	check(t, service, orderNo, chargechannel.PaidFail) // 超过等待时间
+}
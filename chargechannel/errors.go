@@ -1,11 +1,77 @@
 package chargechannel
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrNotSupported = errors.New(`不支持的操作`)
+	ErrDisabled     = errors.New(`渠道已停用`)
+	// ErrNoAvailableChannel 路由分组中没有可用的渠道
+	ErrNoAvailableChannel = errors.New(`没有可用的渠道`)
+	// ErrAmountLimit 金额不满足渠道的金额限制
+	ErrAmountLimit = errors.New(`金额超出渠道限制`)
+	// ErrUnavailable 渠道不在可用时间内
+	ErrUnavailable = errors.New(`渠道不在可用时间内`)
+	// ErrCircuitOpen 渠道已熔断
+	ErrCircuitOpen = errors.New(`渠道已熔断`)
+	// ErrExtendRequired 缺少渠道下单需要的额外参数
+	ErrExtendRequired = errors.New(`缺少下单参数`)
+	// ErrInvalidArgument 渠道请求之前本地校验参数失败,没有请求渠道,不计入健康统计
+	ErrInvalidArgument = errors.New(`下单参数错误`)
+	// ErrCanceled 调用方已经取消或者超时,这时渠道的错误不计入健康统计
+	ErrCanceled = errors.New(`调用方已经取消`)
+	// ErrRefundExceeded 订单没有支付成功或者退款金额超过可退金额,由RefundAccessor.ReserveRefund返回
+	ErrRefundExceeded = errors.New(`超过可退金额`)
 )
 
 func IsNotSupported(err error) bool {
-	return errors.As(err, &ErrNotSupported)
+	return errors.Is(err, ErrNotSupported)
+}
+
+// DisabledError 渠道已停用,errors.Is(err, ErrDisabled)为true
+type DisabledError struct {
+	Key    ChannelKey // 渠道
+	Reason string     // 停用原因
+}
+
+func (d *DisabledError) Error() string {
+	return fmt.Sprintf(`渠道[%s]已停用:%s`, d.Key.Text(), d.Reason)
+}
+
+func (d *DisabledError) Is(target error) bool {
+	return target == ErrDisabled
+}
+
+func IsDisabled(err error) bool {
+	return errors.Is(err, ErrDisabled)
+}
+
+func IsNoAvailableChannel(err error) bool {
+	return errors.Is(err, ErrNoAvailableChannel)
+}
+
+func IsAmountLimit(err error) bool {
+	return errors.Is(err, ErrAmountLimit)
+}
+
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
+func IsCircuitOpen(err error) bool {
+	return errors.Is(err, ErrCircuitOpen)
+}
+
+func IsExtendRequired(err error) bool {
+	return errors.Is(err, ErrExtendRequired)
+}
+
+func IsInvalidArgument(err error) bool {
+	return errors.Is(err, ErrInvalidArgument)
+}
+
+func IsRefundExceeded(err error) bool {
+	return errors.Is(err, ErrRefundExceeded)
 }
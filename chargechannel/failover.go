@@ -0,0 +1,57 @@
+package chargechannel
+
+import (
+	"context"
+)
+
+// FailoverPolicy 下单失败时的切换策略,每个渠道配置依次尝试的备用渠道
+// 下单前检查没有通过(停用,金额限制,不在可用时间,熔断,缺少参数)的渠道没有请求渠道,被跳过时通过Accessor保存,订单号为空
+type FailoverPolicy struct {
+	Fallbacks map[ChannelKey][]ChannelKey // 渠道->备用渠道,按顺序尝试
+	// Retryable 哪些错误需要切换,为nil时渠道请求失败和渠道拒绝都切换,下单前检查没有通过时由SkipRejected决定
+	Retryable func(err error) bool
+	// SkipRejected 下单前检查没有通过时是否切换到下一个渠道,只在Retryable为nil时生效
+	SkipRejected bool
+}
+
+// chain 下单时依次尝试的渠道,第一个是指定的渠道,重复的备用渠道只尝试一次
+func (f *FailoverPolicy) chain(key ChannelKey) []ChannelKey {
+	if f == nil {
+		return []ChannelKey{key}
+	}
+
+	result := make([]ChannelKey, 0, len(f.Fallbacks[key])+1)
+	result = append(result, key)
+
+	tried := map[ChannelKey]bool{key: true}
+
+	for _, fallback := range f.Fallbacks[key] {
+		if tried[fallback] {
+			continue
+		}
+
+		tried[fallback] = true
+
+		result = append(result, fallback)
+	}
+
+	return result
+}
+
+// retryable 错误是否需要切换到下一个渠道,请求已经被取消时不再切换
+func (f *FailoverPolicy) retryable(ctx context.Context, err error) bool {
+	if f == nil || ctx.Err() != nil {
+		return false
+	}
+
+	if f.Retryable == nil {
+		return !rejected(err) || f.SkipRejected
+	}
+
+	return f.Retryable(err)
+}
+
+// rejected 下单前检查没有通过,没有请求渠道
+func rejected(err error) bool {
+	return IsDisabled(err) || IsAmountLimit(err) || IsUnavailable(err) || IsCircuitOpen(err) || IsExtendRequired(err)
+}
@@ -0,0 +1,343 @@
+package chargechannel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CircuitState 熔断状态
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = 0 // 正常
+	CircuitOpen     CircuitState = 1 // 熔断,不能下单
+	CircuitHalfOpen CircuitState = 2 // 冷却结束,允许一个探测请求
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return `closed`
+	case CircuitOpen:
+		return `open`
+	case CircuitHalfOpen:
+		return `half-open`
+	default:
+		return `unknown`
+	}
+}
+
+func (c CircuitState) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// HealthConfig 健康统计和熔断配置
+type HealthConfig struct {
+	Window      time.Duration // 滑动窗口,只统计这段时间内的请求
+	MinRequests int           // 窗口内请求数达到这个值才判断是否熔断
+	ErrorRate   float64       // 错误率达到这个值时熔断,0-1
+	SlowLatency time.Duration // 平均耗时达到这个值时熔断,0表示不按耗时熔断
+	Cooldown    time.Duration // 熔断之后经过这段时间允许一个探测请求
+}
+
+// DefaultHealthConfig 默认的健康统计和熔断配置
+var DefaultHealthConfig = HealthConfig{
+	Window:      time.Minute,
+	MinRequests: 10,  //nolint:gomnd
+	ErrorRate:   0.5, //nolint:gomnd
+	Cooldown:    time.Second * 30,
+}
+
+// Validate 检查配置是否合理
+func (h HealthConfig) Validate() error {
+	if h.Window <= 0 || h.Cooldown <= 0 {
+		return errors.New(`滑动窗口和冷却时间必须大于0`)
+	}
+
+	if h.MinRequests <= 0 {
+		return errors.New(`最小请求数必须大于0`)
+	}
+
+	if h.ErrorRate <= 0 || h.ErrorRate > 1 {
+		return errors.New(`错误率必须在0到1之间`)
+	}
+
+	return nil
+}
+
+// ChannelHealth 渠道的健康情况,统计的是滑动窗口内的下单请求
+type ChannelHealth struct {
+	Key         ChannelKey    `json:"key"`                // 渠道
+	State       CircuitState  `json:"state"`              // 熔断状态
+	Requests    int           `json:"requests"`           // 请求数
+	Failures    int           `json:"failures"`           // 失败数
+	SuccessRate float64       `json:"successRate"`        // 成功率,没有请求时为1
+	ErrorRate   float64       `json:"errorRate"`          // 错误率,没有请求时为0
+	AvgLatency  time.Duration `json:"avgLatency"`         // 平均耗时
+	OpenedAt    time.Time     `json:"openedAt,omitempty"` // 熔断时间,没有熔断时为零值
+}
+
+// CircuitOpenError 渠道已经熔断,errors.Is(err, ErrCircuitOpen)为true
+type CircuitOpenError struct {
+	Key     ChannelKey // 渠道
+	RetryAt time.Time  // 允许探测的时间
+}
+
+func (c *CircuitOpenError) Error() string {
+	return fmt.Sprintf(`渠道[%s]已熔断,%s之后重试`, c.Key.Text(), c.RetryAt.Format(time.RFC3339))
+}
+
+func (c *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// outcome 一次请求的结果
+type outcome struct {
+	at      time.Time
+	failed  bool
+	latency time.Duration
+}
+
+// channelHealth 单个渠道的统计和熔断状态
+type channelHealth struct {
+	outcomes  []outcome // 按时间升序
+	state     CircuitState
+	openedAt  time.Time
+	probingAt time.Time // 半开时探测请求的发起时间,零值表示没有探测中的请求
+}
+
+// prune 删除窗口之外的请求
+func (c *channelHealth) prune(since time.Time) {
+	index := sort.Search(len(c.outcomes), func(i int) bool {
+		return !c.outcomes[i].at.Before(since)
+	})
+
+	c.outcomes = c.outcomes[index:]
+}
+
+func (c *channelHealth) stats(key ChannelKey) ChannelHealth {
+	result := ChannelHealth{Key: key, State: c.state, Requests: len(c.outcomes), SuccessRate: 1, OpenedAt: c.openedAt}
+
+	if result.Requests == 0 {
+		return result
+	}
+
+	var total time.Duration
+
+	for _, item := range c.outcomes {
+		total += item.latency
+
+		if item.failed {
+			result.Failures++
+		}
+	}
+
+	result.ErrorRate = float64(result.Failures) / float64(result.Requests)
+	result.SuccessRate = 1 - result.ErrorRate
+	result.AvgLatency = total / time.Duration(result.Requests)
+
+	return result
+}
+
+// healthTracker 所有渠道的健康统计,使用自己的锁,不影响加载渠道
+type healthTracker struct {
+	lock     *sync.Mutex
+	config   HealthConfig
+	channels map[ChannelKey]*channelHealth
+	now      func() time.Time
+}
+
+func newHealthTracker(config HealthConfig) *healthTracker {
+	return &healthTracker{
+		lock:     &sync.Mutex{},
+		config:   config,
+		channels: make(map[ChannelKey]*channelHealth, initCapacity),
+		now:      time.Now,
+	}
+}
+
+func (h *healthTracker) load(key ChannelKey) *channelHealth {
+	data, exist := h.channels[key]
+	if !exist {
+		data = &channelHealth{}
+		h.channels[key] = data
+	}
+
+	return data
+}
+
+// allow 是否允许请求,熔断时冷却结束后转为半开,同一时间只允许一个探测请求
+func (h *healthTracker) allow(key ChannelKey) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	data := h.load(key)
+	now := h.now()
+
+	switch data.state {
+	case CircuitOpen:
+		if now.Before(data.openedAt.Add(h.config.Cooldown)) {
+			return &CircuitOpenError{Key: key, RetryAt: data.openedAt.Add(h.config.Cooldown)}
+		}
+
+		data.state = CircuitHalfOpen
+	case CircuitHalfOpen:
+		// 探测请求一直没有结果时(例如调用方没有记录),冷却之后允许再次探测
+		if !data.probingAt.IsZero() && now.Before(data.probingAt.Add(h.config.Cooldown)) {
+			return &CircuitOpenError{Key: key, RetryAt: data.probingAt.Add(h.config.Cooldown)}
+		}
+	case CircuitClosed:
+		return nil
+	}
+
+	data.probingAt = now
+
+	return nil
+}
+
+// record 记录请求结果,半开时由探测结果决定恢复还是继续熔断
+// 调用方取消(ErrCanceled)和本地参数校验失败(ErrInvalidArgument)不是渠道的问题,不计入统计,半开时释放探测名额
+func (h *healthTracker) record(key ChannelKey, latency time.Duration, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	data := h.load(key)
+	now := h.now()
+
+	if errors.Is(err, ErrCanceled) || IsInvalidArgument(err) {
+		if data.state == CircuitHalfOpen {
+			data.probingAt = time.Time{}
+		}
+
+		return
+	}
+
+	data.prune(now.Add(-h.config.Window))
+	data.outcomes = append(data.outcomes, outcome{at: now, failed: err != nil, latency: latency})
+
+	switch data.state {
+	case CircuitHalfOpen:
+		data.probingAt = time.Time{}
+
+		if err != nil {
+			data.state, data.openedAt = CircuitOpen, now
+			return
+		}
+
+		// 探测成功,之前的统计不再有意义
+		data.state, data.openedAt = CircuitClosed, time.Time{}
+		data.outcomes = data.outcomes[len(data.outcomes)-1:]
+	case CircuitClosed:
+		if h.shouldOpen(data.stats(key)) {
+			data.state, data.openedAt = CircuitOpen, now
+		}
+	case CircuitOpen: // 熔断之前发起的请求,只统计
+	}
+}
+
+func (h *healthTracker) shouldOpen(stats ChannelHealth) bool {
+	if stats.Requests < h.config.MinRequests {
+		return false
+	}
+
+	if stats.ErrorRate >= h.config.ErrorRate {
+		return true
+	}
+
+	return h.config.SlowLatency > 0 && stats.AvgLatency >= h.config.SlowLatency
+}
+
+func (h *healthTracker) health(key ChannelKey) ChannelHealth {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	data := h.load(key)
+	data.prune(h.now().Add(-h.config.Window))
+
+	return data.stats(key)
+}
+
+// healthy 没有熔断,或者可以探测,判断规则和allow一致:半开时已经有探测中的请求则不健康
+func (h *healthTracker) healthy(key ChannelKey) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	data := h.load(key)
+	now := h.now()
+
+	switch data.state {
+	case CircuitOpen:
+		return !now.Before(data.openedAt.Add(h.config.Cooldown))
+	case CircuitHalfOpen:
+		return data.probingAt.IsZero() || !now.Before(data.probingAt.Add(h.config.Cooldown))
+	default:
+		return true
+	}
+}
+
+func (h *healthTracker) setConfig(config HealthConfig) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.config = config
+}
+
+func (h *healthTracker) remove(key ChannelKey) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	delete(h.channels, key)
+}
+
+func (m manager) SetHealthConfig(config HealthConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	m.health.setConfig(config)
+
+	return nil
+}
+
+func (m manager) Allow(key ChannelKey) error {
+	return m.health.allow(key)
+}
+
+func (m manager) Record(key ChannelKey, latency time.Duration, err error) {
+	m.health.record(key, latency, err)
+}
+
+func (m manager) Healthy(key ChannelKey) bool {
+	return m.health.healthy(key)
+}
+
+func (m manager) Health(key ChannelKey) ChannelHealth {
+	return m.health.health(key)
+}
+
+func (m manager) Healths() []ChannelHealth {
+	m.lock.RLock()
+
+	keys := make([]ChannelKey, 0, len(m.channels))
+	for key := range m.channels {
+		keys = append(keys, key)
+	}
+
+	m.lock.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	result := make([]ChannelHealth, 0, len(keys))
+
+	for _, key := range keys {
+		result = append(result, m.health.health(key))
+	}
+
+	return result
+}
@@ -0,0 +1,337 @@
+package chargechannel
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	commonmongo "github.com/babybabylong/common/mongo"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// DefaultCallBackTTL 回调处理记录默认保存时间,渠道一般在一天内停止重试
+	DefaultCallBackTTL = time.Hour * 24
+	// callBackClaimTimeout 回调处理中的超时时间,超过时认为处理的实例已经退出,允许重新处理
+	callBackClaimTimeout = time.Minute
+)
+
+// CallBackKind 回调的业务类型,同一个渠道的充值,代付和退款订单号不在同一个命名空间
+type CallBackKind string
+
+const (
+	CallBackKindCharge CallBackKind = `charge` // 充值回调
+	CallBackKindPayout CallBackKind = `payout` // 代付回调
+	CallBackKindRefund CallBackKind = `refund` // 退款回调
+)
+
+// CallBackKey 回调的幂等键,同一个业务类型的同一个渠道订单的同一笔渠道交易只处理一次
+type CallBackKey struct {
+	Kind    CallBackKind // 业务类型
+	Key     ChannelKey   // 渠道
+	OrderNo string       // 商户订单号,代付回调时是代付订单号
+	TradeNo string       // 渠道交易号,渠道没有返回时为空
+}
+
+// order 同一个订单的键,不区分渠道交易号
+func (c CallBackKey) order() CallBackKey {
+	return CallBackKey{Kind: c.Kind, Key: c.Key, OrderNo: c.OrderNo}
+}
+
+// CallBackStore 回调幂等存储,多实例部署时需要使用共享的存储(例如mongo)
+// 订单成功处理过Paid之后,之后的失败回调都是重复回调;同一笔渠道交易处理过PaidFail之后,只有Paid可以重新处理(先失败后成功)
+type CallBackStore interface {
+	/*Claim 占用回调,同一时间只有一个请求能占用
+	参数:
+	*	key    	CallBackKey	幂等键
+	*	status 	PaidStatus 	回调的支付结果
+	返回值:
+	*	claimed	bool       	是否占用成功,成功时由调用方处理
+	*	result 	[]byte     	占用失败时,已经处理完成的应答,还在处理中时为nil
+	*	err    	error      	错误
+	*/
+	Claim(key CallBackKey, status PaidStatus) (claimed bool, result []byte, err error)
+	// Complete 处理完成,保存返回给渠道的应答
+	Complete(key CallBackKey, result []byte) error
+	// Release 处理失败,释放占用,渠道重试时可以重新处理
+	Release(key CallBackKey) error
+}
+
+// callBackEntry 内存中的回调处理记录
+type callBackEntry struct {
+	status    PaidStatus
+	result    []byte
+	done      bool
+	claimedAt time.Time
+}
+
+// duplicate 已经处理完成的记录,status是重复回调:成功之后的任何结果,失败之后的失败
+func (c callBackEntry) duplicate(status PaidStatus) bool {
+	return c.done && (c.status == Paid || c.status == status)
+}
+
+// memoryCallBackStore 内存回调幂等存储,只适用于单实例部署
+type memoryCallBackStore struct {
+	lock      *sync.Mutex
+	ttl       time.Duration
+	entries   map[CallBackKey]*callBackEntry
+	paid      map[CallBackKey]*callBackEntry // 订单->成功处理的记录,不区分渠道交易号,用于拒绝之后的失败回调
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+/*NewMemoryCallBackStore 新建内存回调幂等存储
+参数:
+*	ttl      	time.Duration	处理记录保存时间,<=0时使用DefaultCallBackTTL
+返回值:
+*	CallBackStore	CallBackStore	存储
+*/
+func NewMemoryCallBackStore(ttl time.Duration) CallBackStore {
+	if ttl <= 0 {
+		ttl = DefaultCallBackTTL
+	}
+
+	return &memoryCallBackStore{
+		lock:    &sync.Mutex{},
+		ttl:     ttl,
+		entries: make(map[CallBackKey]*callBackEntry, initCapacity),
+		paid:    make(map[CallBackKey]*callBackEntry, initCapacity),
+		now:     time.Now,
+	}
+}
+
+func (m *memoryCallBackStore) Claim(key CallBackKey, status PaidStatus) (claimed bool, result []byte, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	// 订单已经成功,其他渠道交易号的失败回调也不再处理
+	if paid, exist := m.paid[key.order()]; exist && status != Paid {
+		return false, paid.result, nil
+	}
+
+	entry, exist := m.entries[key]
+
+	switch {
+	case !exist:
+	case entry.duplicate(status):
+		return false, entry.result, nil
+	case entry.done: // 先失败后成功
+	case now.Before(entry.claimedAt.Add(callBackClaimTimeout)):
+		return false, nil, nil
+	}
+
+	m.entries[key] = &callBackEntry{status: status, claimedAt: now}
+
+	return true, nil, nil
+}
+
+func (m *memoryCallBackStore) Complete(key CallBackKey, result []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	entry := &callBackEntry{result: result, done: true, claimedAt: m.now()}
+
+	if existing, exist := m.entries[key]; exist {
+		entry.status = existing.status
+	}
+
+	m.entries[key] = entry
+
+	if entry.status == Paid {
+		m.paid[key.order()] = entry
+	}
+
+	return nil
+}
+
+func (m *memoryCallBackStore) Release(key CallBackKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if entry, exist := m.entries[key]; exist && !entry.done {
+		delete(m.entries, key)
+	}
+
+	return nil
+}
+
+// prune 删除过期的记录,每个ttl最多执行一次
+func (m *memoryCallBackStore) prune(now time.Time) {
+	if now.Before(m.lastPrune.Add(m.ttl)) {
+		return
+	}
+
+	for key, entry := range m.entries {
+		if !now.Before(entry.claimedAt.Add(m.ttl)) {
+			delete(m.entries, key)
+		}
+	}
+
+	for key, entry := range m.paid {
+		if !now.Before(entry.claimedAt.Add(m.ttl)) {
+			delete(m.paid, key)
+		}
+	}
+
+	m.lastPrune = now
+}
+
+// callBackDocument mongo中的回调处理记录
+type callBackDocument struct {
+	Kind      CallBackKind `bson:"kind"`
+	Key       ChannelKey   `bson:"key"`
+	OrderNo   string       `bson:"orderNo"`
+	TradeNo   string       `bson:"tradeNo"`
+	Status    PaidStatus   `bson:"status"` // 占用时的支付结果,不是幂等键的一部分
+	Result    []byte       `bson:"result"`
+	Done      bool         `bson:"done"`
+	ClaimedAt time.Time    `bson:"claimedAt"` // 占用时间,处理完成时更新为完成时间,用于过期删除
+}
+
+// duplicate 同callBackEntry.duplicate
+func (c callBackDocument) duplicate(status PaidStatus) bool {
+	return callBackEntry{status: c.Status, done: c.Done}.duplicate(status)
+}
+
+// mongoCallBackStore mongo回调幂等存储,依赖唯一索引保证多实例只有一个占用成功
+type mongoCallBackStore struct {
+	collection *mongo.Collection
+	timeout    time.Duration
+}
+
+/*NewMongoCallBackStore 新建mongo回调幂等存储,会创建唯一索引和过期索引
+参数:
+*	collection   	*mongo.Collection	集合
+*	ttl          	time.Duration    	处理记录保存时间,<=0时使用DefaultCallBackTTL
+*	timeout      	time.Duration    	单次操作超时时间
+*	logger       	log.Logger       	日志
+返回值:
+*	CallBackStore	CallBackStore    	存储
+*	error        	error            	错误
+*/
+func NewMongoCallBackStore(collection *mongo.Collection, ttl, timeout time.Duration, logger log.Logger) (CallBackStore, error) { //nolint:lll
+	if ttl <= 0 {
+		ttl = DefaultCallBackTTL
+	}
+
+	indexes := []commonmongo.Index{
+		{
+			Name:    `callback`,
+			Version: 3, // 2:增加status 3:增加kind,去掉status
+			Data: mongo.IndexModel{
+				Keys:    bson.D{{Key: `kind`, Value: 1}, {Key: `key`, Value: 1}, {Key: `orderNo`, Value: 1}, {Key: `tradeNo`, Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+		},
+		{
+			Name:    `expire`,
+			Version: 1,
+			Data: mongo.IndexModel{
+				Keys:    bson.D{{Key: `claimedAt`, Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds())),
+			},
+		},
+	}
+
+	if err := commonmongo.EnsureIndex(collection, indexes, logger); err != nil {
+		return nil, errors.Wrap(err, `创建回调幂等索引`)
+	}
+
+	return &mongoCallBackStore{collection: collection, timeout: timeout}, nil
+}
+
+func (m mongoCallBackStore) filter(key CallBackKey) bson.M {
+	return bson.M{`kind`: key.Kind, `key`: key.Key, `orderNo`: key.OrderNo, `tradeNo`: key.TradeNo}
+}
+
+func (m mongoCallBackStore) Claim(key CallBackKey, status PaidStatus) (claimed bool, result []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	// 订单已经成功,其他渠道交易号的失败回调也不再处理
+	if status != Paid {
+		paid := callBackDocument{}
+		order := bson.M{`kind`: key.Kind, `key`: key.Key, `orderNo`: key.OrderNo, `status`: Paid, `done`: true}
+
+		if err = m.collection.FindOne(ctx, order).Decode(&paid); err == nil {
+			return false, paid.Result, nil
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil, errors.Wrap(err, `查询订单回调`)
+		}
+	}
+
+	now := time.Now()
+	document := callBackDocument{Kind: key.Kind, Key: key.Key, OrderNo: key.OrderNo, TradeNo: key.TradeNo, Status: status, ClaimedAt: now}
+
+	if _, err = m.collection.InsertOne(ctx, document); err == nil {
+		return true, nil, nil
+	} else if !mongo.IsDuplicateKeyError(err) {
+		return false, nil, errors.Wrap(err, `占用回调`)
+	}
+
+	existing := callBackDocument{}
+
+	if err = m.collection.FindOne(ctx, m.filter(key)).Decode(&existing); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil, nil // 刚好被释放,按处理中返回,等待渠道重试
+		}
+
+		return false, nil, errors.Wrap(err, `查询回调`)
+	}
+
+	if existing.duplicate(status) {
+		return false, existing.Result, nil
+	}
+
+	// 处理中并且没有超时
+	if !existing.Done && now.Before(existing.ClaimedAt.Add(callBackClaimTimeout)) {
+		return false, nil, nil
+	}
+
+	// 处理超时或者先失败后成功,用完成状态和占用时间做条件抢占,同一时间只有一个实例成功
+	filter := m.filter(key)
+	filter[`done`], filter[`claimedAt`] = existing.Done, existing.ClaimedAt
+
+	update := bson.M{`$set`: bson.M{`status`: status, `done`: false, `result`: nil, `claimedAt`: now}}
+
+	updated, err := m.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, nil, errors.Wrap(err, `抢占回调`)
+	}
+
+	return updated.ModifiedCount == 1, nil, nil
+}
+
+func (m mongoCallBackStore) Complete(key CallBackKey, result []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	update := bson.M{`$set`: bson.M{`result`: result, `done`: true, `claimedAt`: time.Now()}}
+
+	if _, err := m.collection.UpdateOne(ctx, m.filter(key), update, options.Update().SetUpsert(true)); err != nil {
+		return errors.Wrap(err, `保存回调应答`)
+	}
+
+	return nil
+}
+
+func (m mongoCallBackStore) Release(key CallBackKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	filter := m.filter(key)
+	filter[`done`] = false
+
+	if _, err := m.collection.DeleteOne(ctx, filter); err != nil {
+		return errors.Wrap(err, `释放回调`)
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package chargechannel
 import (
 	"context"
 	"io"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -17,9 +18,16 @@ type Channel interface {
 	// CreateOrderNo 返回一个商户订单号(每个渠道的规则不同,由实现生成)
 	CreateOrderNo(id int64, amount decimal.Decimal) string
 	// CreateOrder 创建订单，分别是商户订单号，金额，回调地址
-	CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *CreateOrderExtendParam) (payUrl, payHtml string, err error)
-	// Check 查单
-	Check(channelOrderNo string) (paid PaidStatus, err error)
+	CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *CreateOrderExtendParam) (result *CreateOrderResult, err error)
+	// Check 查单,返回支付状态、实际支付金额(单位为元)和渠道交易号,只有paid==Paid时realAmount有意义,渠道没有返回交易号时为空
+	Check(channelOrderNo string) (paid PaidStatus, realAmount decimal.Decimal, tradeNo string, err error)
+}
+
+// Releaser 释放订单占用的资源(例如收款地址上的金额尾数),是充值渠道的可选能力
+// Service在订单结果保存成功之后调用,保存失败时不释放,重试查单会得到同样的结果
+type Releaser interface {
+	// Release 释放订单占用的资源
+	Release(orderNo string) error
 }
 
 // CreateOrderExtendParam 创建订单额外参数
@@ -30,14 +38,92 @@ type CreateOrderExtendParam struct { // 注意：这个参数目前只有shop-cl
 	SuccessURL string // 成功后跳转的URL
 }
 
+// CreateOrderResult 创建订单结果,每个渠道只填写自己知道的字段，前端根据有值的字段渲染收银台
+type CreateOrderResult struct {
+	PayURL      string               `json:"payUrl,omitempty"`      // 支付链接
+	PayHTML     string               `json:"payHtml,omitempty"`     // 支付表单或者转账说明(html)
+	QRContent   string               `json:"qrContent,omitempty"`   // 二维码内容,可能是链接也可能是码值
+	Instruction *TransferInstruction `json:"instruction,omitempty"` // 转账说明,需要用户自行转账的渠道(银行卡、链上地址)才有
+	TradeNo     string               `json:"tradeNo,omitempty"`     // 渠道交易号
+	ExpireAt    time.Time            `json:"expireAt"`              // 过期时间,零值表示渠道没有返回
+	ChannelKey  ChannelKey           `json:"channelKey"`            // 实际下单的渠道,由Service填写,渠道不需要
+}
+
+// TransferInstruction 转账说明
+type TransferInstruction struct {
+	BankName  string          `json:"bankName,omitempty"` // 银行名称，链上转账时是网络,例如TRC20
+	Branch    string          `json:"branch,omitempty"`   // 开户支行
+	AccountNo string          `json:"accountNo"`          // 银行卡号或者链上地址
+	Holder    string          `json:"holder,omitempty"`   // 户名
+	Amount    decimal.Decimal `json:"amount"`             // 需要转账的精确金额
+}
+
 // Manager 充值渠道管理器
 type Manager interface {
-	// Register 注册渠道
-	Register(channel Channel) error
-	// LoadByKey 通过key加载渠道
+	// Register 注册渠道,options可以设置金额限制(WithAmountLimit),校验失败时不注册
+	Register(channel Channel, options ...RegisterOption) error
+	// Replace 原子的替换渠道和它的回调模板,渠道不存在时相当于Register,停用状态保持不变
+	Replace(channel Channel) error
+	// Apply 在同一个锁内替换渠道并且设置金额限制和可用时间,已经注册了代付的key同时替换代付渠道,用于热更新
+	Apply(channel Channel, limit AmountLimit, schedule Schedule) error
+	// ApplyAll 在同一个锁内替换多个渠道并且注销removed,全部校验通过之后才修改,任何一个失败时不做任何修改
+	ApplyAll(updates []ChannelUpdate, removed ...ChannelKey) error
+	// Unregister 注销渠道和它的回调模板,同一个key的代付渠道一起注销,注销之后在途订单的回调也不能处理,只是临时下线请使用Disable
+	Unregister(key ChannelKey) error
+	// Disable 停用渠道,停用后不能下单,但是在途订单的回调和查单仍然可以处理
+	Disable(key ChannelKey, reason string) error
+	// Enable 启用被停用的渠道
+	Enable(key ChannelKey) error
+	// CheckEnabled 渠道是否可以下单,停用时返回*DisabledError
+	CheckEnabled(key ChannelKey) error
+	// SetLimit 设置渠道的金额限制,Replace不改变金额限制,零值表示不限制
+	SetLimit(key ChannelKey, limit AmountLimit) error
+	// CheckAmount 检查金额是否满足渠道的金额限制,不满足时返回ErrAmountLimit
+	CheckAmount(key ChannelKey, amount decimal.Decimal) error
+	// Limits 所有设置了金额限制的渠道,用于前端展示
+	Limits() map[ChannelKey]AmountLimit
+	// SetSchedule 设置渠道的可用时间和维护窗口,Replace不改变可用时间,零值表示一直可用
+	SetSchedule(key ChannelKey, schedule Schedule) error
+	// CheckAvailable 检查渠道在now时是否可用,不可用时返回*UnavailableError
+	CheckAvailable(key ChannelKey, now time.Time) error
+	// Availabilities 所有渠道在now时的可用情况以及下次可用时间,按key升序
+	Availabilities(now time.Time) []ChannelAvailability
+	// SetHealthConfig 设置健康统计和熔断配置,默认是DefaultHealthConfig
+	SetHealthConfig(config HealthConfig) error
+	// Allow 熔断检查,下单之前调用,熔断时返回*CircuitOpenError,半开时只允许一个探测请求
+	Allow(key ChannelKey) error
+	// Record 记录下单结果和耗时,Allow之后必须调用,err是ErrCanceled或者ErrInvalidArgument时不计入统计
+	Record(key ChannelKey, latency time.Duration, err error)
+	// Healthy 渠道是否健康(没有熔断或者可以探测),Manager本身就是路由可以使用的HealthChecker
+	Healthy(key ChannelKey) bool
+	// Health 渠道在滑动窗口内的健康情况
+	Health(key ChannelKey) ChannelHealth
+	// Healths 所有渠道的健康情况,按key升序,用于监控面板
+	Healths() []ChannelHealth
+	// Capabilities 渠道能力,注册(替换)时读取
+	Capabilities(key ChannelKey) (capabilities Capabilities, err error)
+	// List 所有注册的渠道,包括停用的,按key升序,用于前端展示充值方式
+	List() []ChannelInfo
+	// LoadByKey 通过key加载渠道,包括已经停用的渠道
 	LoadByKey(key ChannelKey) (channel Channel, err error)
+	// Prepare 下单前在同一个锁内读取渠道,停用状态,金额限制,可用时间和能力并且检查,读取方不会看到热更新前后混合的配置
+	// 错误同CheckEnabled,CheckAmount和CheckAvailable
+	Prepare(key ChannelKey, amount decimal.Decimal, now time.Time) (channel Channel, capabilities Capabilities, err error)
 	// LoadTemplateBy 通过key加载回调模板
 	LoadTemplateBy(key ChannelKey) (template AsyncCallBackTemplate, err error)
+	// LoadWithTemplate 同时加载渠道和回调模板,保证两者来自同一次注册(Replace不会让两者不一致)
+	LoadWithTemplate(key ChannelKey) (channel Channel, template AsyncCallBackTemplate, err error)
+	// RegisterPayout 注册代付渠道
+	RegisterPayout(channel PayoutChannel) error
+	// LoadPayoutByKey 通过key加载代付渠道
+	LoadPayoutByKey(key ChannelKey) (channel PayoutChannel, err error)
+	// LoadPayoutTemplateBy 通过key加载代付回调模板
+	LoadPayoutTemplateBy(key ChannelKey) (template AsyncCallBackTemplate, err error)
+	// LoadPayoutWithTemplate 同时加载代付渠道和回调模板,保证两者来自同一次注册
+	LoadPayoutWithTemplate(key ChannelKey) (channel PayoutChannel, template AsyncCallBackTemplate, err error)
+	// Balances 并发查询支持余额查询(实现BalanceQuerier)的渠道的余额,按key升序
+	// keys为空时查询所有渠道,timeout是单个渠道的超时时间,<=0时不限制
+	Balances(ctx context.Context, timeout time.Duration, keys ...ChannelKey) []ChannelBalance
 }
 
 // AsyncCallBackTemplate 异步回调接口
@@ -52,10 +138,15 @@ type AsyncCallBackTemplate interface {
 	Result() io.Reader
 	// RealPayAmount 真实支付金额
 	RealPayAmount() decimal.Decimal
+	// TradeNo 渠道交易号,渠道没有返回时为空
+	TradeNo() string
 }
 
+// Accessor 充值记录存储,tradeNo是渠道交易号,用于客诉和对账，为空时表示渠道没有返回，不应该覆盖已经保存的值
 type Accessor interface {
-	// SetRecordStarted 设置订单下单情况
-	SetRecordStarted(id int64, orderNo string, err error) error
-	SetRecordFinish(key ChannelKey, orderNo string, realAmount decimal.Decimal, err error) error
+	// SetRecordStarted 设置订单下单情况,key是实际下单的渠道(通过路由充值时由路由选择)
+	// 切换渠道时每次尝试都会保存,下单前检查没有通过而被跳过的渠道orderNo为空,err是没有通过的原因
+	SetRecordStarted(id int64, key ChannelKey, orderNo, tradeNo string, err error) error
+	// SetRecordFinish 设置订单支付结果
+	SetRecordFinish(key ChannelKey, orderNo, tradeNo string, realAmount decimal.Decimal, err error) error
 }
@@ -0,0 +1,199 @@
+package shopclub
+
+// shop_club网关共用的签名,请求和应答处理,接入同一网关的其他产品(proxypay,银商)时复用
+// 签名:参数按key排序后拼接key=商户私钥,转大写后md5;应答code!=0时msg是错误原因
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+type parameter struct {
+	key   string
+	value string
+}
+
+func (p parameter) Encode() string {
+	return fmt.Sprintf(`%s=%s`, p.key, p.value)
+}
+
+/*Sign 签名,参数按key排序后拼接key=privateKey,转大写后md5
+参数:
+*	value     	url.Values	参与签名的参数,不包括sign
+*	privateKey	string    	商户私钥
+返回值:
+*	string    	string    	签名
+*/
+func Sign(value url.Values, privateKey string) string {
+	parameters := make([]parameter, 0, len(value)+1)
+
+	for key := range value {
+		parameters = append(parameters, parameter{
+			key:   key,
+			value: value.Get(key),
+		})
+	}
+
+	sort.Slice(parameters, func(i, j int) bool {
+		return parameters[i].key < parameters[j].key
+	})
+
+	parameters = append(parameters, parameter{
+		key:   "key",
+		value: privateKey,
+	})
+
+	result := make([]string, 0, len(parameters))
+
+	for _, parameter := range parameters {
+		result = append(result, parameter.Encode())
+	}
+
+	combinedStr := strings.ToUpper(strings.Join(result, `&`))
+
+	return fmt.Sprintf("%x", md5.Sum([]byte(combinedStr))) //nolint:gosec
+}
+
+// ResponseCode 应答的结果码,code!=0时msg是错误原因
+type ResponseCode struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+func (r ResponseCode) Validate() error {
+	if r.Code == 0 {
+		return nil
+	}
+
+	return errors.New(r.Msg)
+}
+
+// QueryArgument 查单参数,order_no和dis_order_no二选一
+type QueryArgument struct {
+	MchID      int    `json:"mch_id"`
+	OrderNo    string `json:"order_no,omitempty"`     // 商户订单号
+	DisOrderNo string `json:"dis_order_no,omitempty"` // 支付平台的单号
+	Time       int64  `json:"time"`
+	Sign       string `json:"sign"`
+}
+
+func NewQueryArgument(mchID int, orderNo, disOrderNo string) *QueryArgument {
+	return &QueryArgument{MchID: mchID, OrderNo: orderNo, DisOrderNo: disOrderNo, Time: time.Now().Unix()}
+}
+
+func (q QueryArgument) Values() url.Values {
+	result := url.Values{}
+
+	result.Set("mch_id", fmt.Sprintf("%d", q.MchID))
+
+	if q.OrderNo != `` {
+		result.Set("order_no", q.OrderNo)
+	}
+
+	if q.DisOrderNo != `` {
+		result.Set("dis_order_no", q.DisOrderNo)
+	}
+
+	result.Set("time", fmt.Sprintf("%d", q.Time))
+
+	return result
+}
+
+// Match 应答中的订单是否是查询的订单
+func (q QueryArgument) Match(orderNo, disOrderNo string) error {
+	if (q.OrderNo != `` && orderNo != q.OrderNo) || (q.DisOrderNo != `` && disOrderNo != q.DisOrderNo) {
+		return fmt.Errorf(`应答订单[%s/%s]与查询订单不一致`, orderNo, disOrderNo)
+	}
+
+	return nil
+}
+
+// Client 网关客户端
+type Client struct {
+	host   string       // 服务地址，包括schema 地址 端口
+	client *http.Client // http 客户端
+	logger log.Logger   // 日志器
+}
+
+func NewClient(host string, client *http.Client, logger log.Logger) Client {
+	return Client{host: host, client: client, logger: logger}
+}
+
+/*Post 以json发送已经签名的参数,应答code==0时解析到value
+参数:
+*	ctx     	context.Context	上下文,超时由调用方设置
+*	path    	string         	路径
+*	argument	interface{}    	请求参数
+*	value   	interface{}    	应答
+返回值:
+*	err     	error          	错误,应答code!=0时是msg
+*/
+func (c Client) Post(ctx context.Context, path string, argument, value interface{}) (err error) {
+	var (
+		logger   = helpers.GetLogger(ctx, c.logger)
+		body     []byte
+		req      *http.Request
+		resp     *http.Response
+		response []byte
+		code     = &ResponseCode{}
+	)
+
+	if body, err = json.Marshal(argument); err != nil {
+		return errors.Wrap(err, `json序列化`)
+	}
+
+	logger.Info("请求参数", zap.String(`路径`, path), zap.ByteString("body", body))
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.host+path, bytes.NewReader(body)); err != nil {
+		return errors.Wrap(err, `构建请求`)
+	}
+
+	req.Header.Set(`Content-Type`, `application/json`)
+
+	if resp, err = c.client.Do(req); err != nil {
+		return errors.Wrap(err, `执行请求`)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if response, err = ioutil.ReadAll(resp.Body); err != nil {
+		return errors.Wrap(err, `读取应答`)
+	}
+
+	logger.Info(`读取到应答`, zap.String(`路径`, path), zap.ByteString(`应答`, response))
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	// 失败时data可能不是对象,先只解析结果码
+	if err = json.Unmarshal(response, code); err != nil {
+		return errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = code.Validate(); err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(response, value); err != nil {
+		return errors.Wrap(err, `解析应答错误`)
+	}
+
+	return nil
+}
@@ -3,10 +3,12 @@ package kab
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/babybabylong/first-business/chargechannel"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"io"
+	"strconv"
 	"strings"
 )
 
@@ -40,28 +42,38 @@ func (c chargeResponse) Validate() error {
 	return errors.New(c.Message)
 }
 
-// PayAsyncResponse 支付异步回调
+// PayAsyncResponse 支付异步回调,GET请求,参数在url中
 type payAsyncResponse struct {
-	Orderid string          `json:"orderid"`
-	Amount  decimal.Decimal `json:"amount"`
-	PayNo   string          `json:"payno"`
-	Sign    string          `json:"sign"`
+	Orderid string      `json:"orderid" form:"orderid"`
+	Amount  looseString `json:"amount" form:"amount"` // 支付金额,以分为单位,签名使用原始字符串
+	PayNo   string      `json:"payno" form:"payno"`
+	Sign    string      `json:"sign" form:"sign"`
 }
 
 func (p payAsyncResponse) New() chargechannel.AsyncCallBackTemplate {
 	return &payAsyncResponse{}
 }
 
+// Encoding 回调参数在url中
+func (p payAsyncResponse) Encoding() chargechannel.CallBackEncoding {
+	return chargechannel.CallBackQuery
+}
+
 func (p payAsyncResponse) Validate(privateKey string) error {
 	if p.sign(privateKey) != p.Sign {
 		return errors.New("签名错误")
 	}
 
+	if _, err := decimal.NewFromString(string(p.Amount)); err != nil {
+		return errors.Wrapf(err, `金额[%s]格式错误`, p.Amount)
+	}
+
 	return nil
 }
 
+// sign 签名：md5(orderid + amount + payno + apikey)
 func (p payAsyncResponse) sign(privateKey string) (result string) {
-	return sign(p.Orderid + p.Amount.StringFixed(2) + p.PayNo + privateKey)
+	return sign(p.Orderid + string(p.Amount) + p.PayNo + privateKey)
 }
 
 func (p payAsyncResponse) Status() chargechannel.PaidStatus {
@@ -73,7 +85,132 @@ func (p payAsyncResponse) Result() io.Reader {
 }
 
 func (p payAsyncResponse) RealPayAmount() decimal.Decimal {
-	return p.Amount.Div(decimal.NewFromInt(100)) // 单位为分
+	amount, _ := decimal.NewFromString(string(p.Amount)) // Validate中已经检查过格式
+
+	return amount.Shift(-2) // 单位为分
+}
+
+// TradeNo 支付单号
+func (p payAsyncResponse) TradeNo() string {
+	return p.PayNo
+}
+
+// 订单支付状态
+const (
+	stateCancel = -1 // 取消
+	stateUnpaid = 0  // 未支付
+	statePaid   = 1  // 支付成功
+)
+
+// queryResponse 订单状态查询应答
+type queryResponse struct {
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Data    queryResponseData `json:"data"`
+}
+
+func (q queryResponse) Validate(apiKey string) error {
+	if q.Status != 1 {
+		return errors.New(q.Message)
+	}
+
+	if q.Data.sign(apiKey) != strings.TrimSpace(q.Data.Sign) {
+		return errors.New("签名错误")
+	}
+
+	return nil
+}
+
+type queryResponseData struct {
+	OrderID string `json:"orderid"` // 商户订单号
+	PayNo   string `json:"payno"`   // 支付单号
+	State   int    `json:"state"`   // 1为支付成功，0为未支付，-1为取消
+	Amount  int64  `json:"amount"`  // 支付金额,以分为单位
+	PayTime string `json:"paytime"` // 支付时间
+	Sign    string `json:"sign"`    // 签名
+}
+
+// sign 签名：md5(orderid + payno + state + amount +apikey)
+func (q queryResponseData) sign(apiKey string) string {
+	return sign(q.OrderID + q.PayNo + strconv.Itoa(q.State) + strconv.FormatInt(q.Amount, 10) + apiKey)
+}
+
+func (q queryResponseData) Status() chargechannel.PaidStatus {
+	switch q.State {
+	case statePaid:
+		return chargechannel.Paid
+	case stateCancel:
+		return chargechannel.PaidFail
+	case stateUnpaid:
+		return chargechannel.PaidProcessing
+	default:
+		return chargechannel.PaidUnknown
+	}
+}
+
+func (q queryResponseData) RealPayAmount() decimal.Decimal {
+	return decimal.New(q.Amount, -2) // 单位为分
+}
+
+// balanceResponse 商户余额查询应答
+type balanceResponse struct {
+	Status  int                 `json:"status"`
+	Message string              `json:"message"`
+	Data    balanceResponseData `json:"data"`
+}
+
+func (b balanceResponse) Validate(apiKey string) error {
+	if b.Status != 1 {
+		return errors.New(b.Message)
+	}
+
+	if b.Data.sign(apiKey) != strings.TrimSpace(b.Data.Sign) {
+		return errors.New("签名错误")
+	}
+
+	return nil
+}
+
+type balanceResponseData struct {
+	UID    looseString `json:"uid"`    // 商户渠道代码
+	Amount looseString `json:"amount"` // 商户余额,以分为单位
+	Sign   string      `json:"sign"`   // 签名
+}
+
+// sign 签名：md5(uid + amount + apikey)
+func (b balanceResponseData) sign(apiKey string) string {
+	return sign(string(b.UID) + string(b.Amount) + apiKey)
+}
+
+func (b balanceResponseData) Available() (decimal.Decimal, error) {
+	amount, err := decimal.NewFromString(string(b.Amount))
+	if err != nil {
+		return decimal.Zero, errors.Wrapf(err, `余额[%s]格式错误`, b.Amount)
+	}
+
+	return amount.Shift(-2), nil // 单位为分
+}
+
+// looseString 文档中是字符串，实际返回的是数字，两种都接受
+type looseString string
+
+func (l *looseString) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err == nil {
+		*l = looseString(value)
+		return nil
+	}
+
+	var number json.Number
+
+	if err := json.Unmarshal(data, &number); err != nil {
+		return errors.Wrap(err, `既不是字符串也不是数字`)
+	}
+
+	*l = looseString(number)
+
+	return nil
 }
 
 func sign(source string) (result string) {
@@ -49,6 +49,11 @@ func (s Service) PrivateKey() string {
 	return s.apiKey
 }
 
+// Capabilities 渠道能力,支持主动查单,币种由商户后台配置,这里不声明
+func (s Service) Capabilities() chargechannel.Capabilities {
+	return chargechannel.Capabilities{ActiveQuery: true}
+}
+
 func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need bool) {
 	return &payAsyncResponse{}, true
 }
@@ -61,21 +66,23 @@ func (s Service) generateChannelOrderNo(_ decimal.Decimal) string {
 	return primitive.NewObjectID().Hex()
 }
 
-func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (payUrl, payHtml string, err error) {
-	if payUrl, err = s.charge(ctx, orderNo, amount, callbackURL); err != nil {
-		return "", "", errors.Wrap(err, "下单失败")
+func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) {
+	var data *chargeResponseData
+
+	if data, err = s.charge(ctx, orderNo, amount, callbackURL); err != nil {
+		return nil, errors.Wrap(err, "下单失败")
 	}
 
-	return payUrl, "", nil
+	return &chargechannel.CreateOrderResult{PayURL: data.PayURL, QRContent: data.Qrcode, TradeNo: data.TradeNo}, nil
 }
 
-func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string) (payUrl string, err error) {
+func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string) (data *chargeResponseData, err error) {
 	if amount.LessThanOrEqual(decimal.Zero) {
-		return payUrl, errors.New(`订单金额必须大于0`)
+		return nil, errors.Wrap(chargechannel.ErrInvalidArgument, `订单金额必须大于0`)
 	}
 
 	if !helpers.IsURL(callbackURL) {
-		return payUrl, fmt.Errorf(`非法的回调地址[%s]`, callbackURL)
+		return nil, errors.Wrapf(chargechannel.ErrInvalidArgument, `非法的回调地址[%s]`, callbackURL)
 	}
 
 	// 2. 准备请求相关
@@ -89,40 +96,44 @@ func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Deci
 	)
 
 	if argument, err = s.prepareArgument(orderNo, amount, callbackURL, logger); err != nil {
-		return "", errors.Wrap(err, "构造请求")
+		return nil, errors.Wrap(err, "构造请求")
 	}
 
 	logger.Info(`获取支付参数`, zap.String(`参数`, argument.Encode()))
 
 	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.host+`/pay_index.php?`+argument.Encode(), nil); err != nil {
-		return "", errors.Wrap(err, `构建请求`)
+		return nil, errors.Wrap(err, `构建请求`)
 	}
 
 	if resp, err = s.client.Do(req); err != nil {
-		return "", errors.Wrap(err, `执行请求`)
+		return nil, errors.Wrap(err, `执行请求`)
 	}
 
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
 	if responseByte, err = ioutil.ReadAll(resp.Body); err != nil {
-		return "", errors.Wrap(err, `读取应答`)
+		return nil, errors.Wrap(err, `读取应答`)
 	}
 
 	logger.Info(`读取到应答`, zap.ByteString(`应答`, responseByte))
 
 	if resp.StatusCode != http.StatusOK {
-		return "", errors.New(resp.Status)
+		return nil, errors.New(resp.Status)
 	}
 
 	if err = json.Unmarshal(responseByte, result); err != nil {
-		return "", errors.Wrap(err, `解析应答错误`)
+		return nil, errors.Wrap(err, `解析应答错误`)
 	}
 
 	logger.Info(`应答解析成功`, zap.Any(`应答`, result))
 
 	if err = result.Validate(); err != nil {
-		return payUrl, errors.Wrap(err, "下单失败")
+		return nil, errors.Wrap(err, "下单失败")
 	}
 
-	return result.Data.PayURL, nil
+	return &result.Data, nil
 }
 
 func (s Service) prepareArgument(orderNo string, amount decimal.Decimal, callbackURL string, logger log.Logger) (url.Values, error) {
@@ -142,6 +153,125 @@ func (s Service) prepareArgument(orderNo string, amount decimal.Decimal, callbac
 	return argument, nil
 }
 
-func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, err error) {
-	return chargechannel.PaidUnknown, chargechannel.ErrNotSupported
+/*Check 查单
+参数:
+*	channelOrderNo	string                  	商户订单号
+返回值:
+*	paid          	chargechannel.PaidStatus	支付状态
+*	realAmount    	decimal.Decimal         	实际支付金额,单位为元
+*	tradeNo       	string                  	支付单号(payno)
+*	err           	error                   	错误
+*/
+func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	var (
+		argument     = url.Values{}
+		req          *http.Request
+		resp         *http.Response
+		result       = &queryResponse{}
+		responseByte []byte
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	argument.Set("u", s.channelCode)
+	argument.Set("id", channelOrderNo)
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.host+`/query.php?`+argument.Encode(), nil); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `构建请求`)
+	}
+
+	if resp, err = s.client.Do(req); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `执行请求`)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if responseByte, err = ioutil.ReadAll(resp.Body); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `读取应答`)
+	}
+
+	s.logger.Info(`读取到查单应答`, zap.ByteString(`应答`, responseByte))
+
+	if resp.StatusCode != http.StatusOK {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.New(resp.Status)
+	}
+
+	if err = json.Unmarshal(responseByte, result); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = result.Validate(s.apiKey); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `查单失败`)
+	}
+
+	if result.Data.OrderID != channelOrderNo {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, fmt.Errorf(`应答订单号[%s]与查询订单号[%s]不一致`, result.Data.OrderID, channelOrderNo)
+	}
+
+	return result.Data.Status(), result.Data.RealPayAmount(), result.Data.PayNo, nil
+}
+
+/*Balance 查询商户余额
+参数:
+*	ctx    	context.Context      	上下文
+返回值:
+*	balance	chargechannel.Balance	余额,单位为元,kab没有冻结余额
+*	err    	error                	错误
+*/
+func (s Service) Balance(ctx context.Context) (balance chargechannel.Balance, err error) {
+	var (
+		argument     = url.Values{}
+		req          *http.Request
+		resp         *http.Response
+		result       = &balanceResponse{}
+		responseByte []byte
+		cancel       context.CancelFunc
+	)
+
+	logger := helpers.GetLogger(ctx, s.logger)
+
+	ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	argument.Set("u", s.channelCode)
+	argument.Set("sign", sign(s.channelCode+s.apiKey))
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet, s.host+`/checkbalances.php?`+argument.Encode(), nil); err != nil {
+		return balance, errors.Wrap(err, `构建请求`)
+	}
+
+	if resp, err = s.client.Do(req); err != nil {
+		return balance, errors.Wrap(err, `执行请求`)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if responseByte, err = ioutil.ReadAll(resp.Body); err != nil {
+		return balance, errors.Wrap(err, `读取应答`)
+	}
+
+	logger.Info(`读取到余额应答`, zap.ByteString(`应答`, responseByte))
+
+	if resp.StatusCode != http.StatusOK {
+		return balance, errors.New(resp.Status)
+	}
+
+	if err = json.Unmarshal(responseByte, result); err != nil {
+		return balance, errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = result.Validate(s.apiKey); err != nil {
+		return balance, errors.Wrap(err, `查询余额失败`)
+	}
+
+	if balance.Available, err = result.Data.Available(); err != nil {
+		return balance, err
+	}
+
+	return balance, nil
 }
@@ -2,7 +2,15 @@ package kab
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/babybabylong/first-business/chargechannel"
 	"github.com/fighterlyt/log"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -30,10 +38,105 @@ func TestMain(m *testing.M) {
 func TestService_CreateOrder(t *testing.T) {
 	orderNo := primitive.NewObjectID().Hex()
 
-	var payUrl string
-	payUrl, _, err = service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), `http://baidu.com`, nil)
+	var result *chargechannel.CreateOrderResult
+	result, err = service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), `http://baidu.com`, nil)
 
 	require.NoError(t, err)
 
-	t.Log(payUrl)
+	t.Log(result.PayURL)
+}
+
+func TestService_Check(t *testing.T) {
+	const apiKey = `5QzzwZh4MjbexiOiW1Guz19Fm6Xe0JOq`
+
+	states := map[string]int{`paid`: statePaid, `unpaid`: stateUnpaid, `cancel`: stateCancel, `forged`: statePaid}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orderNo := r.URL.Query().Get(`id`)
+
+		state, exist := states[orderNo]
+		if !exist || r.URL.Path != `/query.php` {
+			_ = json.NewEncoder(w).Encode(queryResponse{Status: 0, Message: `订单不存在`})
+			return
+		}
+
+		data := queryResponseData{OrderID: orderNo, PayNo: `TLO` + orderNo, State: state, Amount: 10050}
+		data.Sign = data.sign(apiKey)
+
+		if orderNo == `forged` {
+			data.Amount = 1
+		}
+
+		_ = json.NewEncoder(w).Encode(queryResponse{Status: 1, Data: data})
+	}))
+	defer server.Close()
+
+	service := NewService(server.URL, apiKey, `97`, `c3301`, time.Second, logger)
+
+	for orderNo, want := range map[string]chargechannel.PaidStatus{
+		`paid`:   chargechannel.Paid,
+		`unpaid`: chargechannel.PaidProcessing,
+		`cancel`: chargechannel.PaidFail,
+	} {
+		paid, realAmount, tradeNo, err := service.Check(orderNo)
+		require.NoError(t, err)
+		require.Equal(t, want, paid, orderNo)
+		require.Equal(t, `TLO`+orderNo, tradeNo)
+		require.True(t, realAmount.Equal(decimal.RequireFromString(`100.5`)), `金额单位应该是元`)
+	}
+
+	_, _, _, err = service.Check(`forged`)
+	require.Error(t, err, `签名错误`)
+
+	_, _, _, err = service.Check(`unknown`)
+	require.Error(t, err)
+}
+
+func TestService_Balance(t *testing.T) {
+	const apiKey = `123456`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != `/checkbalances.php` || r.URL.Query().Get(`sign`) != sign(r.URL.Query().Get(`u`)+apiKey) {
+			_ = json.NewEncoder(w).Encode(balanceResponse{Status: 0, Message: `签名错误`})
+			return
+		}
+
+		// 文档示例,uid和amount都是数字
+		if r.URL.Query().Get(`u`) == `1` {
+			_, _ = fmt.Fprintf(w, `{"status":1,"message":"ok","data":{"uid":1,"amount":30000,"sign":"%s"}}`, sign(`1`+`30000`+apiKey))
+			return
+		}
+
+		_, _ = fmt.Fprintf(w, `{"status":1,"message":"ok","data":{"uid":"%s","amount":"100","sign":"forged"}}`, r.URL.Query().Get(`u`))
+	}))
+	defer server.Close()
+
+	balance, err := NewService(server.URL, apiKey, `1`, `c3301`, time.Second, logger).Balance(context.Background())
+	require.NoError(t, err)
+	require.True(t, balance.Available.Equal(decimal.New(300, 0)), `金额单位应该是元`)
+
+	_, err = NewService(server.URL, apiKey, `97`, `c3301`, time.Second, logger).Balance(context.Background())
+	require.Error(t, err, `签名错误`)
+}
+
+func TestPayAsyncResponse(t *testing.T) {
+	apiKey := `5QzzwZh4MjbexiOiW1Guz19Fm6Xe0JOq`
+	query := url.Values{
+		`orderid`: {`TLO190601000001`},
+		`amount`:  {`10000`},
+		`payno`:   {`WX2019060112040001`},
+		`sign`:    {sign(`TLO190601000001` + `10000` + `WX2019060112040001` + apiKey)},
+	}
+
+	resp := payAsyncResponse{}.New()
+	require.Equal(t, chargechannel.CallBackQuery, resp.(chargechannel.CallBackEncoder).Encoding())
+	require.NoError(t, binding.Query.Bind(httptest.NewRequest(http.MethodGet, `/callback/9/order?`+query.Encode(), nil), resp))
+	require.NoError(t, resp.Validate(apiKey), `签名使用原始的以分为单位的金额`)
+	require.True(t, decimal.New(100, 0).Equal(resp.RealPayAmount()))
+	require.Equal(t, `WX2019060112040001`, resp.TradeNo())
+
+	query.Set(`amount`, `20000`)
+	resp = payAsyncResponse{}.New()
+	require.NoError(t, binding.Query.Bind(httptest.NewRequest(http.MethodGet, `/callback/9/order?`+query.Encode(), nil), resp))
+	require.Error(t, resp.Validate(apiKey), `金额被修改`)
 }
@@ -0,0 +1,120 @@
+package chargechannel
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// AmountLimit 渠道的金额限制,零值表示不限制
+type AmountLimit struct {
+	Min     decimal.Decimal   `json:"min"`               // 最小金额,0表示不限制
+	Max     decimal.Decimal   `json:"max"`               // 最大金额,0表示不限制
+	Step    decimal.Decimal   `json:"step"`              // 步长,金额必须是步长的整数倍,0表示不限制
+	Allowed []decimal.Decimal `json:"allowed,omitempty"` // 固定金额,不为空时只能使用其中的金额,其他限制不再生效
+}
+
+// Validate 检查限制本身是否合理
+func (a AmountLimit) Validate() error {
+	if a.Min.IsNegative() || a.Max.IsNegative() || a.Step.IsNegative() {
+		return errors.New(`金额限制不能为负数`)
+	}
+
+	if a.Max.IsPositive() && a.Min.GreaterThan(a.Max) {
+		return fmt.Errorf(`最小金额[%s]大于最大金额[%s]`, a.Min, a.Max)
+	}
+
+	for _, allowed := range a.Allowed {
+		if !allowed.IsPositive() {
+			return fmt.Errorf(`固定金额[%s]必须大于0`, allowed)
+		}
+	}
+
+	return nil
+}
+
+/*Check 检查金额是否满足限制
+参数:
+*	amount	decimal.Decimal	金额
+返回值:
+*	error 	error          	不满足时返回ErrAmountLimit
+*/
+func (a AmountLimit) Check(amount decimal.Decimal) error {
+	if !amount.IsPositive() {
+		return errors.Wrap(ErrAmountLimit, `金额必须大于0`)
+	}
+
+	if len(a.Allowed) > 0 {
+		for _, allowed := range a.Allowed {
+			if amount.Equal(allowed) {
+				return nil
+			}
+		}
+
+		return errors.Wrapf(ErrAmountLimit, `金额[%s]不是固定金额%v`, amount, a.Allowed)
+	}
+
+	if a.Min.IsPositive() && amount.LessThan(a.Min) {
+		return errors.Wrapf(ErrAmountLimit, `金额[%s]小于最小金额[%s]`, amount, a.Min)
+	}
+
+	if a.Max.IsPositive() && amount.GreaterThan(a.Max) {
+		return errors.Wrapf(ErrAmountLimit, `金额[%s]大于最大金额[%s]`, amount, a.Max)
+	}
+
+	if a.Step.IsPositive() && !amount.Mod(a.Step).IsZero() {
+		return errors.Wrapf(ErrAmountLimit, `金额[%s]不是[%s]的整数倍`, amount, a.Step)
+	}
+
+	return nil
+}
+
+// WithAmountLimit 注册时设置金额限制,渠道注册之后立即生效,不会出现没有限制的时刻
+func WithAmountLimit(limit AmountLimit) RegisterOption {
+	return func(registration *registration) {
+		registration.limit = &limit
+	}
+}
+
+func (m manager) SetLimit(key ChannelKey, limit AmountLimit) error {
+	if err := limit.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exist := m.channels[key]; !exist {
+		return fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	m.limits[key] = limit
+
+	return nil
+}
+
+func (m manager) CheckAmount(key ChannelKey, amount decimal.Decimal) error {
+	m.lock.RLock()
+	limit := m.limits[key]
+	m.lock.RUnlock()
+
+	if err := limit.Check(amount); err != nil {
+		return errors.Wrapf(err, `渠道[%s]`, key.Text())
+	}
+
+	return nil
+}
+
+func (m manager) Limits() map[ChannelKey]AmountLimit {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := make(map[ChannelKey]AmountLimit, len(m.limits))
+
+	for key, limit := range m.limits {
+		result[key] = limit
+	}
+
+	return result
+}
@@ -1,9 +1,12 @@
 package chargechannel
 
 import (
-	"errors"
 	"fmt"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
 )
 
 const (
@@ -12,9 +15,16 @@ const (
 
 // manager 充值渠道管理器
 type manager struct {
-	channels  map[ChannelKey]Channel
-	lock      *sync.RWMutex
-	templates map[ChannelKey]AsyncCallBackTemplate
+	channels        map[ChannelKey]Channel
+	lock            *sync.RWMutex
+	templates       map[ChannelKey]AsyncCallBackTemplate
+	disabled        map[ChannelKey]string                // 已经停用的渠道->停用原因
+	limits          map[ChannelKey]AmountLimit           // 金额限制
+	schedules       map[ChannelKey]*schedule             // 可用时间
+	health          *healthTracker                       // 健康统计和熔断
+	capabilities    map[ChannelKey]Capabilities          // 渠道能力,注册时读取
+	payouts         map[ChannelKey]PayoutChannel         // 代付渠道
+	payoutTemplates map[ChannelKey]AsyncCallBackTemplate // 代付回调模板
 }
 
 /*NewManager 新建充值渠道管理器
@@ -27,10 +37,27 @@ func NewManager() Manager {
 		lock:      &sync.RWMutex{},
 		channels:  make(map[ChannelKey]Channel, initCapacity),
 		templates: make(map[ChannelKey]AsyncCallBackTemplate, initCapacity),
+		disabled:  make(map[ChannelKey]string, initCapacity),
+		limits:    make(map[ChannelKey]AmountLimit, initCapacity),
+		schedules: make(map[ChannelKey]*schedule, initCapacity),
+		health:    newHealthTracker(DefaultHealthConfig),
+
+		capabilities: make(map[ChannelKey]Capabilities, initCapacity),
+
+		payouts:         make(map[ChannelKey]PayoutChannel, initCapacity),
+		payoutTemplates: make(map[ChannelKey]AsyncCallBackTemplate, initCapacity),
 	}
 }
 
-func (m manager) Register(channel Channel) error {
+// RegisterOption 注册渠道的可选配置,和渠道在同一个锁内生效
+type RegisterOption func(registration *registration)
+
+// registration 注册时和渠道一起生效的配置
+type registration struct {
+	limit *AmountLimit // 金额限制,为nil时不限制
+}
+
+func (m manager) Register(channel Channel, options ...RegisterOption) error {
 	if channel == nil {
 		return errors.New(`充值渠道不能为空`)
 	}
@@ -41,15 +68,32 @@ func (m manager) Register(channel Channel) error {
 		return errors.New(`key不能为空`)
 	}
 
+	config := &registration{}
+
+	for _, option := range options {
+		option(config)
+	}
+
+	if config.limit != nil {
+		if err := config.limit.Validate(); err != nil {
+			return errors.Wrapf(err, `渠道[%d]金额限制配置错误`, key)
+		}
+	}
+
 	m.lock.Lock()
 
 	defer m.lock.Unlock()
 
 	if _, exist := m.channels[key]; exist {
-		return fmt.Errorf(`key[%s]重复`, key)
+		return fmt.Errorf(`key[%d]重复`, key)
 	}
 
 	m.channels[key] = channel
+	m.capabilities[key] = CapabilitiesOf(channel)
+
+	if config.limit != nil {
+		m.limits[key] = *config.limit
+	}
 
 	template, _ := channel.NeedCheck()
 
@@ -60,6 +104,110 @@ func (m manager) Register(channel Channel) error {
 	return nil
 }
 
+func (m manager) Replace(channel Channel) error {
+	if channel == nil {
+		return errors.New(`充值渠道不能为空`)
+	}
+
+	key := channel.Key()
+
+	if key == 0 {
+		return errors.New(`key不能为空`)
+	}
+
+	template, _ := channel.NeedCheck()
+	capabilities := CapabilitiesOf(channel)
+
+	m.lock.Lock()
+
+	defer m.lock.Unlock()
+
+	m.replace(channel, template, capabilities)
+
+	return nil
+}
+
+// replace 替换渠道和它的回调模板,调用方需要持有写锁
+func (m manager) replace(channel Channel, template AsyncCallBackTemplate, capabilities Capabilities) {
+	key := channel.Key()
+
+	m.channels[key] = channel
+	m.capabilities[key] = capabilities
+
+	if template != nil {
+		m.templates[key] = template
+	} else {
+		delete(m.templates, key)
+	}
+}
+
+func (m manager) Unregister(key ChannelKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exist := m.channels[key]; !exist {
+		return fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	m.unregister(key)
+
+	return nil
+}
+
+// unregister 删除渠道的全部数据,调用方需要持有写锁
+func (m manager) unregister(key ChannelKey) {
+	delete(m.channels, key)
+	delete(m.templates, key)
+	delete(m.disabled, key)
+	delete(m.limits, key)
+	delete(m.schedules, key)
+	delete(m.capabilities, key)
+	delete(m.payouts, key)
+	delete(m.payoutTemplates, key)
+	m.health.remove(key)
+}
+
+func (m manager) Disable(key ChannelKey, reason string) error {
+	if reason == `` {
+		return errors.New(`停用原因不能为空`)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exist := m.channels[key]; !exist {
+		return fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	m.disabled[key] = reason
+
+	return nil
+}
+
+func (m manager) Enable(key ChannelKey) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exist := m.channels[key]; !exist {
+		return fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	delete(m.disabled, key)
+
+	return nil
+}
+
+func (m manager) CheckEnabled(key ChannelKey) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if reason, exist := m.disabled[key]; exist {
+		return &DisabledError{Key: key, Reason: reason}
+	}
+
+	return nil
+}
+
 func (m manager) LoadByKey(key ChannelKey) (channel Channel, err error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -68,7 +216,37 @@ func (m manager) LoadByKey(key ChannelKey) (channel Channel, err error) {
 		return data, nil
 	}
 
-	return nil, fmt.Errorf(`key[%s]的渠道不存在`, key)
+	return nil, fmt.Errorf(`key[%d]的渠道不存在`, key)
+}
+
+func (m manager) Prepare(key ChannelKey, amount decimal.Decimal, now time.Time) (channel Channel, capabilities Capabilities, err error) { //nolint:lll
+	m.lock.RLock()
+	channel, exist := m.channels[key]
+	reason, disabled := m.disabled[key]
+	limit := m.limits[key]
+	compiled := m.schedules[key]
+	capabilities = m.capabilities[key]
+	m.lock.RUnlock()
+
+	if !exist {
+		return nil, capabilities, fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	if disabled {
+		return nil, capabilities, &DisabledError{Key: key, Reason: reason}
+	}
+
+	if err = limit.Check(amount); err != nil {
+		return nil, capabilities, errors.Wrapf(err, `渠道[%s]`, key.Text())
+	}
+
+	if compiled != nil {
+		if reason, next := compiled.check(now); reason != `` {
+			return nil, capabilities, &UnavailableError{Key: key, Reason: reason, NextAvailable: next}
+		}
+	}
+
+	return channel, capabilities, nil
 }
 
 func (m manager) LoadTemplateBy(key ChannelKey) (template AsyncCallBackTemplate, err error) {
@@ -81,3 +259,81 @@ func (m manager) LoadTemplateBy(key ChannelKey) (template AsyncCallBackTemplate,
 
 	return nil, fmt.Errorf(`key[%d]的渠道不存在`, key)
 }
+
+func (m manager) LoadWithTemplate(key ChannelKey) (channel Channel, template AsyncCallBackTemplate, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if channel, exist := m.channels[key]; exist {
+		if template, exist = m.templates[key]; exist {
+			return channel, template, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf(`key[%d]的渠道不存在`, key)
+}
+
+func (m manager) RegisterPayout(channel PayoutChannel) error {
+	if channel == nil {
+		return errors.New(`代付渠道不能为空`)
+	}
+
+	key := channel.Key()
+
+	if key == 0 {
+		return errors.New(`key不能为空`)
+	}
+
+	m.lock.Lock()
+
+	defer m.lock.Unlock()
+
+	if _, exist := m.payouts[key]; exist {
+		return fmt.Errorf(`代付key[%d]重复`, key)
+	}
+
+	m.payouts[key] = channel
+
+	template, _ := channel.NeedCheckPayout()
+
+	if template != nil {
+		m.payoutTemplates[key] = template
+	}
+
+	return nil
+}
+
+func (m manager) LoadPayoutByKey(key ChannelKey) (channel PayoutChannel, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if data, exist := m.payouts[key]; exist {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf(`key[%d]的代付渠道不存在`, key)
+}
+
+func (m manager) LoadPayoutWithTemplate(key ChannelKey) (channel PayoutChannel, template AsyncCallBackTemplate, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if channel, exist := m.payouts[key]; exist {
+		if template, exist = m.payoutTemplates[key]; exist {
+			return channel, template, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf(`key[%d]的代付渠道不存在`, key)
+}
+
+func (m manager) LoadPayoutTemplateBy(key ChannelKey) (template AsyncCallBackTemplate, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if data, exist := m.payoutTemplates[key]; exist {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf(`key[%d]的代付渠道不存在`, key)
+}
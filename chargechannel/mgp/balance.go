@@ -0,0 +1,55 @@
+package mgp
+
+// MGP余额查询
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/pkg/errors"
+)
+
+/*Balance 查询商户余额
+参数:
+*	ctx    	context.Context      	上下文
+返回值:
+*	balance	chargechannel.Balance	余额,可用余额是D0余额
+*	err    	error                	错误
+*/
+func (s Service) Balance(ctx context.Context) (balance chargechannel.Balance, err error) {
+	var (
+		body     io.Reader
+		resp     *http.Response
+		response = &balanceResponse{}
+		cancel   context.CancelFunc
+	)
+
+	logger := helpers.GetLogger(ctx, s.logger)
+
+	ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	argument := newBalanceArgument(s.merchantNo, s.ChannelType)
+	argument.Sign = argument.sign(s.privateKey)
+
+	if body, err = s.marshal(argument); err != nil {
+		return balance, errors.Wrap(err, `准备参数`)
+	}
+
+	if resp, err = s.doHTTPRequest(ctx, balancePath, body); err != nil {
+		return balance, errors.Wrap(err, `执行请求`)
+	}
+
+	if err = s.processResult(logger, resp, response); err != nil {
+		return balance, errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = response.Validate(); err != nil {
+		return balance, errors.Wrap(err, `查询余额失败`)
+	}
+
+	return response.Detail.balance(), nil
+}
@@ -28,6 +28,26 @@ const (
 	ChannelTypeEcuador ChannelType = "0"
 )
 
+// text 通道类型的名称,未知的通道类型显示原值
+func (c ChannelType) text() string {
+	switch c {
+	case ChannelTypeEcuador:
+		return `厄瓜多尔`
+	default:
+		return string(c)
+	}
+}
+
+// currency 通道类型对应的币种
+func (c ChannelType) currency() string {
+	switch c {
+	case ChannelTypeEcuador:
+		return `USD`
+	default:
+		return ``
+	}
+}
+
 const (
 	success    = "1"
 	fail       = "2"
@@ -39,6 +59,13 @@ const (
 	signType = `MD5`
 )
 
+const (
+	payPath     = `/api/pay/V2`         // 支付接口
+	queryPath   = `/api/defray/queryV2` // 交易查询接口
+	payoutPath  = `/api/defray/V2`      // 代付接口
+	balancePath = `/api/balance/V2`     // 余额查询接口
+)
+
 // payArgument 支付接口的参数
 type payArgument struct {
 	Version     string          `json:"version"`     // 版本号
@@ -81,8 +108,17 @@ func (p payArgument) values() url.Values {
 	return result
 }
 func (p payArgument) sign(privateKey string) string {
-	value := p.values()
+	return sign(p.values(), privateKey)
+}
 
+/*sign 签名,除sign外的参数按照key升序排序，拼接为key1=value1&key2=value2,末尾追加私钥后md5
+参数:
+*	value     	url.Values	参数
+*	privateKey	string    	商户私钥
+返回值:
+*	string    	string    	签名
+*/
+func sign(value url.Values, privateKey string) string {
 	parameters := make([]parameter, 0, len(value))
 
 	for key := range value {
@@ -106,8 +142,6 @@ func (p payArgument) sign(privateKey string) string {
 
 	combinedStr := strings.Join(result, `&`)
 
-	println(`combinedStr`, combinedStr)
-
 	return fmt.Sprintf("%x", md5.Sum([]byte(combinedStr))) //nolint:gosec
 }
 
@@ -146,7 +180,7 @@ type payResponseInfo struct {
 	BankCode    string `json:"bankCode"`        // 银行编码
 	BankName    string `json:"bankName"`        // 银行名称
 	Holder      string `json:"bankAccountName"` // 持卡人
-	Money       string `json:"money"`           // 余额
+	Money       string `json:"money"`           // 金额
 }
 
 // payAsyncResponse 支付异步回调
@@ -166,6 +200,11 @@ func (p payAsyncResponse) RealPayAmount() decimal.Decimal {
 	return p.PayAmount
 }
 
+// TradeNo MGP的回调中没有平台单号
+func (p payAsyncResponse) TradeNo() string {
+	return ``
+}
+
 func (p payAsyncResponse) Validate(privateKey string) error {
 	if p.sign(privateKey) != p.Sign {
 		return errors.New("签名错误")
@@ -191,41 +230,19 @@ func (p payAsyncResponse) values() url.Values {
 }
 
 func (p payAsyncResponse) sign(privateKey string) string {
-	value := p.values()
-
-	parameters := make([]parameter, 0, len(value))
-
-	for key := range value {
-		parameters = append(parameters, parameter{
-			key:   key,
-			value: value.Get(key),
-		})
-	}
-
-	sort.Slice(parameters, func(i, j int) bool {
-		return parameters[i].key < parameters[j].key
-	})
-
-	parameters[len(parameters)-1].value += privateKey
-
-	result := make([]string, 0, len(parameters))
-
-	for _, parameter := range parameters {
-		result = append(result, parameter.Encode())
-	}
-
-	combinedStr := strings.Join(result, `&`)
-
-	println(`combinedStr`, combinedStr)
-
-	return fmt.Sprintf("%x", md5.Sum([]byte(combinedStr))) //nolint:gosec
+	return sign(p.values(), privateKey)
 }
 
 func (p payAsyncResponse) New() chargechannel.AsyncCallBackTemplate {
 	return &payAsyncResponse{}
 }
 func (p payAsyncResponse) Status() chargechannel.PaidStatus {
-	switch p.PaidStatus {
+	return status(p.PaidStatus)
+}
+
+// status 订单状态转为支付状态，1 成功，2失败，0处理中
+func status(code string) chargechannel.PaidStatus {
+	switch code {
 	case success:
 		return chargechannel.Paid
 	case fail:
@@ -244,3 +261,213 @@ func (p payAsyncResponse) Result() io.Reader {
 
 	return strings.NewReader(``)
 }
+
+// queryArgument 交易查询接口的参数
+type queryArgument struct {
+	Version    string `json:"version"`    // 版本号
+	SignType   string `json:"signType"`   // 签名类型
+	MerchantNo string `json:"merchantNo"` // 商户号
+	Date       string `json:"date"`       // 时间戳,使用厄瓜多尔时区
+	OrderNo    string `json:"orderNo"`    // 订单号
+	Sign       string `json:"sign"`       // 加密串
+}
+
+func newQueryArgument(merchantNo, orderNo string) *queryArgument {
+	location, _ := time.LoadLocation("America/Guayaquil")
+
+	return &queryArgument{
+		Version:    version,
+		SignType:   signType,
+		MerchantNo: merchantNo,
+		Date:       time.Now().In(location).Format(`20060102150405`),
+		OrderNo:    orderNo,
+	}
+}
+
+func (q queryArgument) values() url.Values {
+	result := url.Values{}
+	result.Set(`version`, q.Version)
+	result.Set(`signType`, q.SignType)
+	result.Set(`merchantNo`, q.MerchantNo)
+	result.Set(`date`, q.Date)
+	result.Set(`orderNo`, q.OrderNo)
+
+	return result
+}
+
+func (q queryArgument) sign(privateKey string) string {
+	return sign(q.values(), privateKey)
+}
+
+type queryResponse struct {
+	Code   string              `json:"code"`   // 响应码， 0成功，-1失败
+	Msg    string              `json:"msg"`    // 错误信息
+	Detail queryResponseDetail `json:"detail"` // 详情
+}
+
+func (q queryResponse) Validate() error {
+	if q.Code == `0` {
+		return nil
+	}
+
+	return errors.New(q.Msg)
+}
+
+type queryResponseDetail struct {
+	OrderNo    string          `json:"orderNo"` // 商户订单号
+	Amount     decimal.Decimal `json:"bizAmt"`  // 交易金额
+	PaidStatus string          `json:"status"`  // 交易状态，1 成功，2失败，0处理中
+	Remark     string          `json:"remark"`  // 订单信息
+}
+
+// payoutArgument 代付接口的参数
+type payoutArgument struct {
+	Version        string          `json:"version"`             // 版本号
+	SignType       string          `json:"signType"`            // 签名类型
+	MerchantNo     string          `json:"merchantNo"`          // 商户号
+	Date           string          `json:"date"`                // 时间戳,使用厄瓜多尔时区
+	ChannelType    string          `json:"channleType"`         // 通道类型
+	Sign           string          `json:"sign"`                // 加密串
+	OrderNo        string          `json:"orderNo"`             // 订单号,36字符内
+	Amount         decimal.Decimal `json:"bizAmt"`              // 金额,单位为元
+	AccName        string          `json:"accName"`             // 收款人姓名
+	BankCode       string          `json:"bankCode"`            // 银行编码
+	BankBranchName string          `json:"bankBranchName"`      // 支行名称,可以用银行名称
+	CardNo         string          `json:"cardNo"`              // 卡号
+	NoticeURL      string          `json:"noticeUrl,omitempty"` // 异步回调地址
+	Phone          string          `json:"phone,omitempty"`     // 手机号
+}
+
+func newPayoutArgument(merchantNo, noticeURL, orderNo string, request chargechannel.PayoutRequest, channelType ChannelType) *payoutArgument { //nolint:lll
+	location, _ := time.LoadLocation("America/Guayaquil")
+
+	branch := request.BankBranch
+	if branch == `` {
+		branch = request.BankName
+	}
+
+	return &payoutArgument{
+		Version:        version,
+		SignType:       signType,
+		MerchantNo:     merchantNo,
+		Date:           time.Now().In(location).Format(`20060102150405`),
+		ChannelType:    string(channelType),
+		OrderNo:        orderNo,
+		Amount:         request.Amount,
+		AccName:        request.AccountName,
+		BankCode:       request.BankCode,
+		BankBranchName: branch,
+		CardNo:         request.AccountNo,
+		NoticeURL:      noticeURL,
+		Phone:          request.Phone,
+	}
+}
+
+func (p payoutArgument) values() url.Values {
+	result := url.Values{}
+	result.Set(`version`, p.Version)
+	result.Set(`signType`, p.SignType)
+	result.Set(`merchantNo`, p.MerchantNo)
+	result.Set(`date`, p.Date)
+	result.Set(`channleType`, p.ChannelType) // 注意:这里是对方接口的拼写错误，与代码无关
+	result.Set(`orderNo`, p.OrderNo)
+	result.Set(`bizAmt`, p.Amount.String())
+	result.Set(`accName`, p.AccName)
+	result.Set(`bankCode`, p.BankCode)
+	result.Set(`bankBranchName`, p.BankBranchName)
+	result.Set(`cardNo`, p.CardNo)
+
+	if p.NoticeURL != "" {
+		result.Set(`noticeUrl`, p.NoticeURL)
+	}
+
+	if p.Phone != "" {
+		result.Set(`phone`, p.Phone)
+	}
+
+	return result
+}
+
+func (p payoutArgument) sign(privateKey string) string {
+	return sign(p.values(), privateKey)
+}
+
+// payoutResponse 代付应答，只有受理结果
+type payoutResponse struct {
+	Code string `json:"code"` // 响应码， 0成功，-1失败
+	Msg  string `json:"msg"`  // 错误信息
+}
+
+func (p payoutResponse) Validate() error {
+	if p.Code == `0` {
+		return nil
+	}
+
+	return errors.New(p.Msg)
+}
+
+// balanceArgument 余额查询接口的参数
+type balanceArgument struct {
+	Version     string `json:"version"`     // 版本号
+	SignType    string `json:"signType"`    // 签名类型
+	MerchantNo  string `json:"merchantNo"`  // 商户号
+	Date        string `json:"date"`        // 时间戳,使用厄瓜多尔时区
+	ChannelType string `json:"channleType"` // 通道类型
+	Sign        string `json:"sign"`        // 加密串
+}
+
+func newBalanceArgument(merchantNo string, channelType ChannelType) *balanceArgument {
+	location, _ := time.LoadLocation("America/Guayaquil")
+
+	return &balanceArgument{
+		Version:     version,
+		SignType:    signType,
+		MerchantNo:  merchantNo,
+		Date:        time.Now().In(location).Format(`20060102150405`),
+		ChannelType: string(channelType),
+	}
+}
+
+func (b balanceArgument) values() url.Values {
+	result := url.Values{}
+	result.Set(`version`, b.Version)
+	result.Set(`signType`, b.SignType)
+	result.Set(`merchantNo`, b.MerchantNo)
+	result.Set(`date`, b.Date)
+	result.Set(`channleType`, b.ChannelType) // 注意:这里是对方接口的拼写错误，与代码无关
+
+	return result
+}
+
+func (b balanceArgument) sign(privateKey string) string {
+	return sign(b.values(), privateKey)
+}
+
+type balanceResponse struct {
+	Code   string                `json:"code"`   // 响应码， 0成功，-1失败
+	Msg    string                `json:"msg"`    // 错误信息
+	Detail balanceResponseDetail `json:"detail"` // 详情
+}
+
+func (b balanceResponse) Validate() error {
+	if b.Code == `0` {
+		return nil
+	}
+
+	return errors.New(b.Msg)
+}
+
+type balanceResponseDetail struct {
+	D0Balance decimal.Decimal `json:"D0Balance"` // D0余额,可以立即代付
+	T1Balance decimal.Decimal `json:"T1Balance"` // T1余额,次日才能代付
+	D0Freeze  decimal.Decimal `json:"D0Freeze"`  // D0冻结金额
+	T1Freeze  decimal.Decimal `json:"T1Freeze"`  // T1冻结金额
+}
+
+// balance 可用余额只算D0余额,T1余额当天不能代付
+func (b balanceResponseDetail) balance() chargechannel.Balance {
+	return chargechannel.Balance{
+		Available: b.D0Balance,
+		Frozen:    b.D0Freeze.Add(b.T1Freeze),
+	}
+}
@@ -0,0 +1,88 @@
+package mgp
+
+// MGP代付
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+/*NeedCheckPayout 代付是否需要主动查单,代付回调和支付回调格式相同
+参数:
+返回值:
+*	template	chargechannel.AsyncCallBackTemplate	代付回调模板
+*	need    	bool                               	是否需要主动查单
+*/
+func (s Service) NeedCheckPayout() (template chargechannel.AsyncCallBackTemplate, need bool) {
+	return &payAsyncResponse{}, false
+}
+
+func (s Service) CreatePayoutNo(_ int64, amount decimal.Decimal) string {
+	return s.generateChannelOrderNo(amount)
+}
+
+/*CreatePayout 创建代付订单
+参数:
+*	ctx        	context.Context              	上下文
+*	payoutNo   	string                       	代付订单号
+*	request    	chargechannel.PayoutRequest  	收款信息
+*	callbackURL	string                       	回调地址
+返回值:
+*	result     	*chargechannel.PayoutResult  	代付结果,受理成功时是处理中
+*	err        	error                        	错误
+*/
+func (s Service) CreatePayout(ctx context.Context, payoutNo string, request chargechannel.PayoutRequest, callbackURL string) (result *chargechannel.PayoutResult, err error) { //nolint:lll
+	if err = request.Validate(); err != nil {
+		return nil, err
+	}
+
+	if request.BankCode == `` {
+		return nil, errors.New(`银行编码不能为空`)
+	}
+
+	var (
+		body     io.Reader
+		resp     *http.Response
+		response = &payoutResponse{}
+		cancel   context.CancelFunc
+	)
+
+	logger := helpers.GetLogger(ctx, s.logger)
+
+	ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	argument := newPayoutArgument(s.merchantNo, callbackURL, payoutNo, request, s.ChannelType)
+	argument.Sign = argument.sign(s.privateKey)
+
+	if body, err = s.marshal(argument); err != nil {
+		return nil, errors.Wrap(err, `准备参数`)
+	}
+
+	if resp, err = s.doHTTPRequest(ctx, payoutPath, body); err != nil {
+		return nil, errors.Wrap(err, `执行请求`)
+	}
+
+	if err = s.processResult(logger, resp, response); err != nil {
+		return nil, errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = response.Validate(); err != nil {
+		return nil, errors.Wrap(err, `代付失败`)
+	}
+
+	return &chargechannel.PayoutResult{Status: chargechannel.PaidProcessing}, nil
+}
+
+// CheckPayout 代付查单,和支付使用同一个交易查询接口
+func (s Service) CheckPayout(payoutNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, err error) {
+	paid, realAmount, _, err = s.Check(payoutNo)
+
+	return paid, realAmount, err
+}
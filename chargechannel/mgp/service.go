@@ -21,16 +21,33 @@ import (
 
 // Service 服务
 type Service struct {
-	host        string        // 服务地址，包括schema 地址 端口
-	privateKey  string        // 商户私钥
-	merchantNo  string        // 商户号
-	client      *http.Client  // http 客户端
-	logger      log.Logger    // 日志器
-	timeout     time.Duration // http请求超时
-	ChannelType ChannelType   // 通道类型
+	host        string                   // 服务地址，包括schema 地址 端口
+	privateKey  string                   // 商户私钥
+	merchantNo  string                   // 商户号
+	client      *http.Client             // http 客户端
+	logger      log.Logger               // 日志器
+	timeout     time.Duration            // http请求超时
+	ChannelType ChannelType              // 通道类型
+	channelKey  chargechannel.ChannelKey // 充值渠道key
 }
 
-func NewService(host, privateKey, merchantNo string, client *http.Client, logger log.Logger, timeout time.Duration, channelType ChannelType) *Service {
+/*NewService 新建服务,不同的通道类型或者商户号需要使用不同的channelKey,才能同时注册,
+内置key以外的channelKey会注册名称MGP(通道类型)
+参数:
+*	host       	string                  	服务地址，包括schema 地址 端口
+*	privateKey 	string                  	商户私钥
+*	merchantNo 	string                  	商户号
+*	client     	*http.Client            	http 客户端
+*	logger     	log.Logger              	日志器
+*	timeout    	time.Duration           	http请求超时
+*	channelType	ChannelType             	通道类型
+*	channelKey 	chargechannel.ChannelKey	充值渠道key
+返回值:
+*	*Service   	*Service                	服务
+*/
+func NewService(host, privateKey, merchantNo string, client *http.Client, logger log.Logger, timeout time.Duration, channelType ChannelType, channelKey chargechannel.ChannelKey) *Service { //nolint:lll
+	chargechannel.RegisterText(channelKey, fmt.Sprintf(`MGP(%s)`, channelType.text()))
+
 	return &Service{
 		host:        host,
 		privateKey:  privateKey,
@@ -39,6 +56,7 @@ func NewService(host, privateKey, merchantNo string, client *http.Client, logger
 		logger:      logger,
 		timeout:     timeout,
 		ChannelType: channelType,
+		channelKey:  channelKey,
 	}
 }
 
@@ -46,13 +64,31 @@ func (s Service) PrivateKey() string {
 	return s.privateKey
 }
 
+// currency 币种,由通道类型决定
+func (s Service) currency() string {
+	return s.ChannelType.currency()
+}
+
+// Capabilities 渠道能力
+func (s Service) Capabilities() chargechannel.Capabilities {
+	capabilities := chargechannel.Capabilities{
+		ActiveQuery: true,
+	}
+
+	if currency := s.currency(); currency != `` {
+		capabilities.Currencies = []string{currency}
+	}
+
+	return capabilities
+}
+
 /*Key 支付渠道的key
 参数:
 返回值:
 *	string	string	key
 */
 func (s Service) Key() chargechannel.ChannelKey {
-	return chargechannel.ChannelKeyEPay
+	return s.channelKey
 }
 
 /*NeedCheck 是否需要主动查单
@@ -72,10 +108,10 @@ func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need
 *	amount        	decimal.Decimal	订单金额
 *	callbackURL   	string         	回调地址
 返回值:
-*	channelOrderNo	string         	商户订单号(生成)
+*	result        	*chargechannel.CreateOrderResult	支付链接或者表单，以及收银台信息
 *	err           	error          	错误
 */
-func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (payUrl, payHtml string, err error) { //nolint:lll
+func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) { //nolint:lll
 	return s.charge(ctx, orderNo, amount, callbackURL)
 }
 
@@ -83,15 +119,49 @@ func (s Service) CreateOrderNo(_ int64, amount decimal.Decimal) string {
 	return s.generateChannelOrderNo(amount)
 }
 
-/*Check 主动查询支付状态，本实现不需要
+/*Check 主动查询支付状态,用于回调一直没有到达的订单
 参数:
-*	_   	string                  	参数1
+*	channelOrderNo	string                  	商户订单号
 返回值:
-*	paid	chargechannel.PaidStatus	返回值1
-*	err 	error                   	返回值2
+*	paid          	chargechannel.PaidStatus	支付状态
+*	realAmount    	decimal.Decimal         	实际支付金额
+*	tradeNo       	string                  	渠道交易号,MGP查单不返回,为空
+*	err           	error                   	错误
 */
-func (s Service) Check(_ string) (paid chargechannel.PaidStatus, err error) {
-	return chargechannel.PaidUnknown, chargechannel.ErrNotSupported
+func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	var (
+		body   io.Reader
+		resp   *http.Response
+		result = &queryResponse{}
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	argument := newQueryArgument(s.merchantNo, channelOrderNo)
+	argument.Sign = argument.sign(s.privateKey)
+
+	if body, err = s.marshal(argument); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `准备参数`)
+	}
+
+	if resp, err = s.doHTTPRequest(ctx, queryPath, body); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `执行请求`)
+	}
+
+	if err = s.processResult(s.logger, resp, result); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `解析应答错误`)
+	}
+
+	if err = result.Validate(); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `查单失败`)
+	}
+
+	if result.Detail.OrderNo != channelOrderNo {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, fmt.Errorf(`应答订单号[%s]与查询订单号[%s]不一致`, result.Detail.OrderNo, channelOrderNo)
+	}
+
+	return status(result.Detail.PaidStatus), result.Detail.Amount, ``, nil
 }
 
 /*charge 获取充值订单
@@ -100,17 +170,17 @@ func (s Service) Check(_ string) (paid chargechannel.PaidStatus, err error) {
 *	amount        	decimal.Decimal	金额
 *	callbackURL   	string         	回调地址
 返回值:
-*	channelOrderNo	string         	商户订单号(实现生成,并非服务端返回)
+*	created       	*chargechannel.CreateOrderResult	创建订单结果
 *	err           	error           错误
 */
-func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string) (payUrl, payHtml string, err error) { //nolint:lll
+func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string) (created *chargechannel.CreateOrderResult, err error) { //nolint:lll
 	// 1. 校验参数
 	if amount.LessThanOrEqual(decimal.Zero) {
-		return payUrl, payHtml, errors.New(`订单金额必须大于0`)
+		return nil, errors.Wrap(chargechannel.ErrInvalidArgument, `订单金额必须大于0`)
 	}
 
 	if !helpers.IsURL(callbackURL) {
-		return payUrl, payHtml, fmt.Errorf(`非法的回调地址[%s]`, callbackURL)
+		return nil, errors.Wrapf(chargechannel.ErrInvalidArgument, `非法的回调地址[%s]`, callbackURL)
 	}
 
 	var (
@@ -128,29 +198,42 @@ func (s Service) charge(ctx context.Context, orderNo string, amount decimal.Deci
 
 	// 3. 准备请求参数
 	if body, err = s.prepareArgument(amount, callbackURL, orderNo); err != nil {
-		return payUrl, payHtml, errors.Wrap(err, `准备参数`)
+		return nil, errors.Wrap(err, `准备参数`)
 	}
 
 	// 5. 执行HTTP请求
-	if resp, err = s.doHTTPRequest(ctx, body); err != nil {
-		return payUrl, payHtml, errors.Wrap(err, `执行请求`)
+	if resp, err = s.doHTTPRequest(ctx, payPath, body); err != nil {
+		return nil, errors.Wrap(err, `执行请求`)
 	}
 
 	// 6. 处理应答
 	if err = s.processResult(logger, resp, result); err != nil {
-		return payUrl, payHtml, errors.Wrap(err, `解析应答错误`)
+		return nil, errors.Wrap(err, `解析应答错误`)
 	}
 
 	if err = result.Validate(); err != nil {
-		return payUrl, payHtml, nil
+		return nil, errors.Wrap(err, `下单失败`)
 	}
 
+	created = &chargechannel.CreateOrderResult{QRContent: result.Info.QRCodeURL}
+
 	// 如果code=0 先判断PayURL，如果为空字符串，则取PayHtml
 	if result.Detail.PayURL != "" {
-		return result.Detail.PayURL, "", nil
+		created.PayURL = result.Detail.PayURL
+	} else {
+		created.PayHTML = result.Detail.PayHTML
 	}
 
-	return "", result.Detail.PayHTML, nil
+	if result.Info.BankAccount != "" {
+		created.Instruction = &chargechannel.TransferInstruction{
+			BankName:  result.Info.BankName,
+			AccountNo: result.Info.BankAccount,
+			Holder:    result.Info.Holder,
+			Amount:    amount,
+		}
+	}
+
+	return created, nil
 }
 
 func (s Service) processResult(logger log.Logger, resp *http.Response, value interface{}) error {
@@ -185,17 +268,18 @@ func (s Service) processResult(logger log.Logger, resp *http.Response, value int
 /*doHTTPRequest 执行http请求
 参数:
 *	ctx 	context.Context	上下文
+*	path	string         	接口路径
 *	body	io.Reader      	body
 返回值:
 *	resp	*http.Response 	应答
 *	err 	error          	错误
 */
-func (s Service) doHTTPRequest(ctx context.Context, body io.Reader) (resp *http.Response, err error) {
+func (s Service) doHTTPRequest(ctx context.Context, path string, body io.Reader) (resp *http.Response, err error) {
 	var (
 		req *http.Request
 	)
 
-	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.host+`/api/pay/V2`, body); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.host+path, body); err != nil {
 		return nil, errors.Wrap(err, `构建请求`)
 	}
 
@@ -213,6 +297,11 @@ func (s Service) prepareArgument(amount decimal.Decimal, callbackURL, channelOrd
 
 	argument.Sign = argument.sign(s.privateKey)
 
+	return s.marshal(argument)
+}
+
+// marshal 请求参数json序列化
+func (s Service) marshal(argument interface{}) (reader io.Reader, err error) {
 	var (
 		body []byte
 	)
@@ -2,11 +2,15 @@ package mgp_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/babybabylong/first-business/chargechannel"
 	"github.com/babybabylong/first-business/chargechannel/mgp"
 	"github.com/fighterlyt/log"
 	"github.com/shopspring/decimal"
@@ -28,7 +32,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestService(t *testing.T) {
-	service = mgp.NewService(`https://mgp-pay.com:8443`, `c0b13dbb814e4a5297f97e6f5ee0aabf`, `API21337616880378620`, &http.Client{}, logger, time.Second, "0")
+	service = mgp.NewService(`https://mgp-pay.com:8443`, `c0b13dbb814e4a5297f97e6f5ee0aabf`, `API21337616880378620`, &http.Client{}, logger, time.Second, "0", chargechannel.ChannelKeyEPay)
 }
 
 func TestService_CreateOrderNo(t *testing.T) {
@@ -36,5 +40,157 @@ func TestService_CreateOrderNo(t *testing.T) {
 
 	orderNo := service.CreateOrderNo(0, decimal.New(10, 0))
 
-	require.NoError(t, service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), `http://baidu.com`))
+	_, err = service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), `http://baidu.com`, nil)
+	require.NoError(t, err)
+}
+
+func TestService_Check(t *testing.T) {
+	statuses := map[string]string{`paid`: `1`, `fail`: `2`, `processing`: `0`}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		argument := map[string]string{}
+		require.Equal(t, `/api/defray/queryV2`, r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&argument))
+		require.NotEmpty(t, argument[`sign`])
+
+		code, exist := statuses[argument[`orderNo`]]
+		if !exist {
+			_, _ = w.Write([]byte(`{"code":"-1","msg":"订单不存在"}`))
+			return
+		}
+
+		_, _ = fmt.Fprintf(w, `{"code":"0","detail":{"orderNo":"%s","bizAmt":10,"status":"%s"}}`, argument[`orderNo`], code)
+	}))
+	defer server.Close()
+
+	service = mgp.NewService(server.URL, `c0b13dbb814e4a5297f97e6f5ee0aabf`, `API21337616880378620`, server.Client(), logger, time.Second, "0", chargechannel.ChannelKeyEPay)
+
+	for orderNo, want := range map[string]chargechannel.PaidStatus{
+		`paid`:       chargechannel.Paid,
+		`fail`:       chargechannel.PaidFail,
+		`processing`: chargechannel.PaidProcessing,
+	} {
+		paid, realAmount, _, err := service.Check(orderNo)
+		require.NoError(t, err)
+		require.Equal(t, want, paid, orderNo)
+		require.True(t, realAmount.Equal(decimal.New(10, 0)), orderNo)
+	}
+
+	_, _, _, err = service.Check(`unknown`)
+	require.Error(t, err)
+}
+
+func TestService_Key(t *testing.T) {
+	manager := chargechannel.NewManager()
+
+	for _, key := range []chargechannel.ChannelKey{chargechannel.ChannelKeyEPay, chargechannel.ChannelKey(100)} {
+		instance := mgp.NewService(`https://mgp-pay.com:8443`, `key`, `API`+key.Text(), &http.Client{}, logger, time.Second, mgp.ChannelTypeEcuador, key)
+		require.Equal(t, key, instance.Key())
+		require.NoError(t, manager.Register(instance), `不同key的MGP实例可以同时注册`)
+
+		_, err := manager.LoadTemplateBy(key)
+		require.NoError(t, err, `每个实例都有自己的回调模板`)
+	}
+
+	require.Equal(t, `E-Pay`, chargechannel.ChannelKeyEPay.Text(), `内置key的名称不变`)
+	require.Equal(t, `MGP(厄瓜多尔)`, chargechannel.ChannelKey(100).Text())
+}
+
+// payoutAccessor 记录代付的保存情况
+type payoutAccessor struct {
+	started  map[string]error
+	finished map[string]decimal.Decimal
+}
+
+func (p *payoutAccessor) SetPayoutStarted(_ int64, payoutNo, _ string, err error) error {
+	p.started[payoutNo] = err
+	return nil
+}
+
+func (p *payoutAccessor) SetPayoutFinish(_ chargechannel.ChannelKey, payoutNo, _ string, realAmount decimal.Decimal, err error) error {
+	if err == nil {
+		p.finished[payoutNo] = realAmount
+	}
+
+	return nil
+}
+
+func TestService_Payout(t *testing.T) {
+	payouts := map[string]map[string]string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		argument := map[string]string{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&argument))
+		require.NotEmpty(t, argument[`sign`])
+
+		switch r.URL.Path {
+		case `/api/defray/V2`:
+			payouts[argument[`orderNo`]] = argument
+			_, _ = w.Write([]byte(`{"code":"0"}`))
+		case `/api/defray/queryV2`:
+			_, _ = fmt.Fprintf(w, `{"code":"0","detail":{"orderNo":"%s","bizAmt":%s,"status":"1"}}`,
+				argument[`orderNo`], payouts[argument[`orderNo`]][`bizAmt`])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	manager := chargechannel.NewManager()
+	require.NoError(t, manager.RegisterPayout(mgp.NewService(server.URL, `c0b13dbb814e4a5297f97e6f5ee0aabf`, `API21337616880378620`, server.Client(),
+		logger, time.Second, mgp.ChannelTypeEcuador, chargechannel.ChannelKeyEPay)))
+
+	recorder := &payoutAccessor{started: map[string]error{}, finished: map[string]decimal.Decimal{}}
+	service := chargechannel.NewService(manager, logger, nil, nil, `http://example.com`, chargechannel.WithPayoutAccessor(recorder))
+
+	result, err := service.Payout(context.Background(), 1, chargechannel.ChannelKeyEPay, chargechannel.PayoutRequest{
+		Amount:      decimal.New(100, 0),
+		AccountName: `张三`,
+		AccountNo:   `6222000000000001`,
+		BankCode:    `ICBC`,
+		BankName:    `工商银行`,
+	})
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, result.Status)
+	require.Len(t, payouts, 1)
+
+	for payoutNo, argument := range payouts {
+		require.NoError(t, recorder.started[payoutNo])
+		require.Equal(t, `工商银行`, argument[`bankBranchName`], `没有支行时使用银行名称`)
+		require.Equal(t, `http://example.com/payout/3/`+payoutNo, argument[`noticeUrl`])
+
+		paid, err := service.CheckPayout(chargechannel.ChannelKeyEPay, payoutNo)
+		require.NoError(t, err)
+		require.Equal(t, chargechannel.Paid, paid)
+		require.True(t, recorder.finished[payoutNo].Equal(decimal.New(100, 0)))
+	}
+
+	_, err = service.Payout(context.Background(), 2, chargechannel.ChannelKeyEPay, chargechannel.PayoutRequest{Amount: decimal.New(100, 0)})
+	require.Error(t, err, `收款信息不完整`)
+}
+
+func TestService_Balance(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		argument := map[string]string{}
+		require.Equal(t, `/api/balance/V2`, r.URL.Path)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&argument))
+		require.NotEmpty(t, argument[`sign`])
+		require.Equal(t, string(mgp.ChannelTypeEcuador), argument[`channleType`])
+
+		_, _ = w.Write([]byte(`{"code":"0","detail":{"D0Balance":"120.5","T1Balance":30,"D0Freeze":"10","T1Freeze":"2.5"}}`))
+	}))
+	defer server.Close()
+
+	service := mgp.NewService(server.URL, `c0b13dbb814e4a5297f97e6f5ee0aabf`, `API21337616880378620`, server.Client(), logger, time.Second,
+		mgp.ChannelTypeEcuador, chargechannel.ChannelKeyEPay)
+
+	manager := chargechannel.NewManager()
+	require.NoError(t, manager.Register(service))
+
+	balances := manager.Balances(context.Background(), time.Second)
+	require.Len(t, balances, 1)
+	require.NoError(t, balances[0].Err)
+	require.Equal(t, chargechannel.ChannelKeyEPay, balances[0].Key)
+	require.True(t, balances[0].Balance.Available.Equal(decimal.RequireFromString(`120.5`)), `可用余额只算D0`)
+	require.True(t, balances[0].Balance.Frozen.Equal(decimal.RequireFromString(`12.5`)))
 }
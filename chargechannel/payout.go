@@ -0,0 +1,192 @@
+package chargechannel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// PayoutChannel 代付渠道,和充值渠道共用ChannelKey,同一个key可以同时注册充值和代付
+type PayoutChannel interface {
+	// Key 代付渠道key
+	Key() ChannelKey
+	PrivateKey() string
+	// NeedCheckPayout 是否需要主动查单,当need==false时，template!=nil,表示是代付异步回调的模板
+	NeedCheckPayout() (template AsyncCallBackTemplate, need bool)
+	// CreatePayoutNo 返回一个代付订单号(每个渠道的规则不同,由实现生成)
+	CreatePayoutNo(id int64, amount decimal.Decimal) string
+	// CreatePayout 创建代付订单，分别是代付订单号，收款信息，回调地址
+	CreatePayout(ctx context.Context, payoutNo string, request PayoutRequest, callbackURL string) (result *PayoutResult, err error)
+	// CheckPayout 代付查单,返回代付状态和实际出款金额(单位为元),只有paid==Paid时realAmount有意义
+	CheckPayout(payoutNo string) (paid PaidStatus, realAmount decimal.Decimal, err error)
+}
+
+// PayoutRequest 代付请求
+type PayoutRequest struct {
+	Amount      decimal.Decimal `json:"amount"`      // 代付金额,单位为元
+	AccountName string          `json:"accountName"` // 收款人姓名
+	AccountNo   string          `json:"accountNo"`   // 收款卡号(或者PIX码等账号)
+	BankCode    string          `json:"bankCode"`    // 银行编码,每个渠道不同
+	BankName    string          `json:"bankName"`    // 银行名称
+	BankBranch  string          `json:"bankBranch"`  // 开户支行,可以为空
+	Phone       string          `json:"phone"`       // 收款人手机号,可以为空
+}
+
+// Validate 校验代付请求
+func (p PayoutRequest) Validate() error {
+	if !p.Amount.IsPositive() {
+		return errors.New(`代付金额必须大于0`)
+	}
+
+	if p.AccountName == `` || p.AccountNo == `` {
+		return errors.New(`收款人姓名和账号不能为空`)
+	}
+
+	return nil
+}
+
+// PayoutResult 创建代付订单结果
+type PayoutResult struct {
+	TradeNo string     `json:"tradeNo,omitempty"` // 渠道交易号
+	Status  PaidStatus `json:"status"`            // 代付状态,渠道受理后一般是PaidProcessing
+}
+
+// PayoutAccessor 代付记录存储,tradeNo的含义同Accessor
+type PayoutAccessor interface {
+	// SetPayoutStarted 设置代付下单情况
+	SetPayoutStarted(id int64, payoutNo, tradeNo string, err error) error
+	// SetPayoutFinish 设置代付结果
+	SetPayoutFinish(key ChannelKey, payoutNo, tradeNo string, realAmount decimal.Decimal, err error) error
+}
+
+/*Payout 代付,创建渠道代付订单并保存发起状态
+参数:
+*	ctx       	context.Context	上下文
+*	id        	int64          	代付记录ID
+*	channelKey	ChannelKey     	代付渠道
+*	request   	PayoutRequest  	代付请求
+返回值:
+*	result    	*PayoutResult  	代付结果
+*	err       	error          	错误,没有指定PayoutAccessor时返回ErrNotSupported
+*/
+func (s Service) Payout(ctx context.Context, id int64, channelKey ChannelKey, request PayoutRequest) (result *PayoutResult, err error) {
+	// 没有存储时不能请求渠道,否则渠道已经出款但是没有记录
+	if s.payoutAccessor == nil {
+		return nil, errors.Wrap(ErrNotSupported, `代付记录存储`)
+	}
+
+	if err = request.Validate(); err != nil {
+		return nil, err
+	}
+
+	channel, err := s.manager.LoadPayoutByKey(channelKey)
+	if err != nil {
+		return nil, errors.Wrap(err, `加载代付渠道`)
+	}
+
+	payoutNo := channel.CreatePayoutNo(id, request.Amount)
+
+	result, err = channel.CreatePayout(ctx, payoutNo, request, s.generatePayoutCallBackURL(channelKey, payoutNo))
+
+	var tradeNo string
+
+	if result != nil {
+		tradeNo = result.TradeNo
+	}
+
+	if setErr := s.payoutAccessor.SetPayoutStarted(id, payoutNo, tradeNo, err); setErr != nil {
+		s.logger.Error(`保存代付发起状态失败`, helpers.ZapError(setErr))
+	}
+
+	return result, err
+}
+
+/*CheckPayout 代付主动查单，成功或者失败时保存结果
+参数:
+*	channelKey	ChannelKey	代付渠道
+*	payoutNo  	string    	代付订单号
+返回值:
+*	paid      	PaidStatus	代付状态,保存失败时是PaidUnknown
+*	err       	error     	错误,包括保存结果失败,没有指定PayoutAccessor时返回ErrNotSupported
+*/
+func (s Service) CheckPayout(channelKey ChannelKey, payoutNo string) (paid PaidStatus, err error) {
+	if s.payoutAccessor == nil {
+		return PaidUnknown, errors.Wrap(ErrNotSupported, `代付记录存储`)
+	}
+
+	channel, err := s.manager.LoadPayoutByKey(channelKey)
+	if err != nil {
+		return PaidUnknown, errors.Wrap(err, `加载代付渠道`)
+	}
+
+	paid, realAmount, err := channel.CheckPayout(payoutNo)
+	if err != nil {
+		return PaidUnknown, errors.Wrap(err, `代付查单`)
+	}
+
+	if err = s.finish(s.payoutAccessor.SetPayoutFinish, channelKey, payoutNo, ``, paid, realAmount, `查单结果代付失败`); err != nil {
+		return PaidUnknown, errors.Wrap(err, `保存代付结果`)
+	}
+
+	return paid, nil
+}
+
+func (s Service) httpOnPayoutCallBack(ctx *gin.Context) {
+	channelKey, err := strconv.Atoi(ctx.Param(`key`))
+	if err != nil {
+		ctx.String(http.StatusOK, err.Error())
+		return
+	}
+
+	result, err := s.OnPayoutCallBack(ChannelKey(channelKey), ctx.Param(`payoutNo`), ctx.Request)
+
+	reply(ctx, result, err)
+}
+
+/*OnPayoutCallBack 代付异步回调,和充值回调一样通过CallBackStore去重,保存失败时返回错误让渠道重试
+参数:
+*	channelKey	ChannelKey   	代付渠道
+*	payoutNo  	string       	代付订单号
+*	request   	*http.Request	回调请求
+返回值:
+*	result    	io.Reader    	返回给渠道的应答
+*	err       	error        	错误,没有指定PayoutAccessor时返回ErrNotSupported
+*/
+func (s Service) OnPayoutCallBack(channelKey ChannelKey, payoutNo string, request *http.Request) (result io.Reader, err error) {
+	if request.Body != nil {
+		defer func() {
+			_ = request.Body.Close()
+		}()
+	}
+
+	if s.payoutAccessor == nil {
+		return nil, errors.Wrap(ErrNotSupported, `代付记录存储`)
+	}
+
+	var (
+		resp AsyncCallBackTemplate
+	)
+
+	// 渠道和模板一起加载,和充值回调相同
+	channel, template, err := s.manager.LoadPayoutWithTemplate(channelKey)
+	if err != nil {
+		return nil, errors.Wrap(err, `加载代付渠道和模板`)
+	}
+
+	if resp, err = decodeCallBack(template, channel.PrivateKey(), request); err != nil {
+		return resp.Result(), err
+	}
+
+	return s.finishCallBack(CallBackKindPayout, s.payoutAccessor.SetPayoutFinish, channel, channelKey, payoutNo, resp, `回调通知代付失败`)
+}
+
+func (s Service) generatePayoutCallBackURL(channelKey ChannelKey, payoutNo string) string {
+	return s.baseURL + `/payout/` + fmt.Sprintf("%d", channelKey) + `/` + payoutNo
+}
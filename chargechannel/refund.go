@@ -0,0 +1,152 @@
+package chargechannel
+
+import (
+	"context"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// Refunder 退款,是充值渠道的可选能力,支持退款的渠道实现这个接口
+type Refunder interface {
+	// Refund 对已支付的订单发起退款，分别是商户订单号，退款金额(单位为元),退款原因
+	Refund(ctx context.Context, orderNo string, amount decimal.Decimal, reason string) (result *RefundResult, err error)
+	// CheckRefund 退款查询
+	CheckRefund(refundNo string) (status PaidStatus, err error)
+}
+
+// RefundResult 发起退款结果
+type RefundResult struct {
+	RefundNo string     `json:"refundNo"`          // 退款单号,用于查询
+	TradeNo  string     `json:"tradeNo,omitempty"` // 渠道退款交易号
+	Status   PaidStatus `json:"status"`            // 退款状态,Paid表示已退款
+}
+
+// RefundAccessor 退款记录存储,Accessor 同时实现这个接口时才能退款
+type RefundAccessor interface {
+	/*ReserveRefund 检查并预留退款金额,已经退款的金额(包括预留和处理中的退款)加上amount不能超过实际支付金额(SetRecordFinish保存的),
+	检查和预留必须是一个原子操作(例如mongo上带条件的更新),多实例同时退款时才不会超退
+	参数:
+	*	key          	ChannelKey     	充值渠道
+	*	orderNo      	string         	商户订单号
+	*	amount       	decimal.Decimal	退款金额
+	返回值:
+	*	reservationID	string         	预留ID,发起退款之后传给SetRefundStarted
+	*	err          	error          	错误,订单没有支付成功或者超过可退金额时返回ErrRefundExceeded
+	*/
+	ReserveRefund(key ChannelKey, orderNo string, amount decimal.Decimal) (reservationID string, err error)
+	// SetRefundStarted 保存发起的退款,err!=nil 表示发起失败,释放预留的金额
+	SetRefundStarted(key ChannelKey, reservationID string, result *RefundResult, err error) error
+	// SetRefundFinish 保存退款结果,err==nil表示退款成功，否则退款失败,不再计入已退款金额
+	SetRefundFinish(key ChannelKey, refundNo string, err error) error
+}
+
+/*Refund 退款,退款金额加上已经退款的金额不能超过实际支付金额
+参数:
+*	ctx       	context.Context	上下文
+*	channelKey	ChannelKey     	充值渠道
+*	orderNo   	string         	商户订单号
+*	amount    	decimal.Decimal	退款金额
+*	reason    	string         	退款原因
+返回值:
+*	result    	*RefundResult  	退款结果
+*	err       	error          	错误,渠道或者存储不支持退款时返回ErrNotSupported,超过可退金额时返回ErrRefundExceeded
+*/
+func (s Service) Refund(ctx context.Context, channelKey ChannelKey, orderNo string, amount decimal.Decimal, reason string) (result *RefundResult, err error) { //nolint:lll
+	if !amount.IsPositive() {
+		return nil, errors.New(`退款金额必须大于0`)
+	}
+
+	refunder, accessor, err := s.loadRefunder(channelKey)
+	if err != nil {
+		return nil, err
+	}
+
+	reservationID, err := accessor.ReserveRefund(channelKey, orderNo, amount)
+	if err != nil {
+		return nil, errors.Wrap(err, `预留退款金额`)
+	}
+
+	if result, err = refunder.Refund(ctx, orderNo, amount, reason); err == nil && result == nil {
+		err = errors.New(`渠道没有返回退款结果`)
+	}
+
+	if setErr := accessor.SetRefundStarted(channelKey, reservationID, result, err); setErr != nil {
+		helpers.GetLogger(ctx, s.logger).Error(`保存退款发起状态失败`, helpers.ZapError(setErr))
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, `退款`)
+	}
+
+	s.finishRefund(accessor, channelKey, result.RefundNo, result.Status)
+
+	return result, nil
+}
+
+/*CheckRefund 退款查询,成功或者失败时保存结果
+参数:
+*	channelKey	ChannelKey	充值渠道
+*	refundNo  	string    	退款单号
+返回值:
+*	status    	PaidStatus	退款状态
+*	err       	error     	错误
+*/
+func (s Service) CheckRefund(channelKey ChannelKey, refundNo string) (status PaidStatus, err error) {
+	refunder, accessor, err := s.loadRefunder(channelKey)
+	if err != nil {
+		return PaidUnknown, err
+	}
+
+	if status, err = refunder.CheckRefund(refundNo); err != nil {
+		return PaidUnknown, errors.Wrap(err, `退款查询`)
+	}
+
+	s.finishRefund(accessor, channelKey, refundNo, status)
+
+	return status, nil
+}
+
+// loadRefunder 加载支持退款的渠道和退款记录存储
+func (s Service) loadRefunder(channelKey ChannelKey) (refunder Refunder, accessor RefundAccessor, err error) {
+	channel, err := s.manager.LoadByKey(channelKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, `加载渠道`)
+	}
+
+	capabilities, err := s.manager.Capabilities(channelKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, `加载渠道能力`)
+	}
+
+	var ok bool
+
+	if refunder, ok = channel.(Refunder); !capabilities.Refund || !ok {
+		return nil, nil, errors.Wrapf(ErrNotSupported, `渠道[%s]退款`, channelKey.Text())
+	}
+
+	if accessor, ok = s.accessor.(RefundAccessor); !ok {
+		return nil, nil, errors.Wrap(ErrNotSupported, `退款记录存储`)
+	}
+
+	return refunder, accessor, nil
+}
+
+// finishRefund 退款成功或者失败时保存结果,其他状态忽略
+func (s Service) finishRefund(accessor RefundAccessor, channelKey ChannelKey, refundNo string, status PaidStatus) {
+	var setErr error
+
+	switch status {
+	case Paid:
+		setErr = accessor.SetRefundFinish(channelKey, refundNo, nil)
+	case PaidFail:
+		setErr = accessor.SetRefundFinish(channelKey, refundNo, errors.New(`渠道退款失败`))
+	default:
+		return
+	}
+
+	if setErr != nil {
+		s.logger.Error(`设置退款状态失败`, helpers.ZapError(setErr))
+	}
+}
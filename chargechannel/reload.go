@@ -0,0 +1,386 @@
+package chargechannel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// ChannelConfig 渠道配置,由ChannelBuilder解释成渠道
+type ChannelConfig struct {
+	Key      ChannelKey        `json:"key"`      // 渠道
+	Provider string            `json:"provider"` // 渠道实现,对应Reloader的builders,例如mgp
+	Params   map[string]string `json:"params"`   // 渠道参数,例如host,privateKey,merchantNo,含义由builder决定
+	Limit    AmountLimit       `json:"limit"`    // 金额限制,没有配置时不限制
+	Schedule Schedule          `json:"schedule"` // 可用时间,没有配置时一直可用
+}
+
+// ChannelBuilder 根据配置构建渠道,构建出的渠道的Key()必须等于config.Key
+type ChannelBuilder func(config ChannelConfig) (Channel, error)
+
+// ConfigSource 渠道配置来源
+type ConfigSource interface {
+	// Load 加载全部渠道配置
+	Load() (configs []ChannelConfig, err error)
+	// Watch 配置变化时通知,ctx结束时关闭
+	Watch(ctx context.Context) <-chan struct{}
+}
+
+// FileSource 文件配置来源,文件内容是ChannelConfig的json数组,定时检查文件内容是否变化
+type FileSource struct {
+	path     string
+	interval time.Duration
+}
+
+/*NewFileSource 新建文件配置来源
+参数:
+*	path    	string       	文件路径
+*	interval	time.Duration	检查间隔
+返回值:
+*	*FileSource	*FileSource	配置来源
+*/
+func NewFileSource(path string, interval time.Duration) *FileSource {
+	return &FileSource{path: path, interval: interval}
+}
+
+func (f FileSource) Load() (configs []ChannelConfig, err error) {
+	var data []byte
+
+	if data, err = os.ReadFile(f.path); err != nil {
+		return nil, errors.Wrap(err, `读取配置文件`)
+	}
+
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return nil, errors.Wrap(err, `解析配置文件`)
+	}
+
+	return configs, nil
+}
+
+func (f FileSource) Watch(ctx context.Context) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	last, _ := os.ReadFile(f.path) // 在返回之前读取,之后的修改都能被发现
+
+	go func() {
+		defer close(changed)
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// 读取失败(例如编辑器替换文件的瞬间)时不通知,下次再检查
+			current, err := os.ReadFile(f.path)
+			if err != nil || bytes.Equal(current, last) {
+				continue
+			}
+
+			last = current
+
+			select {
+			case changed <- struct{}{}:
+			default: // 上一次通知还没有处理,合并
+			}
+		}
+	}()
+
+	return changed
+}
+
+// Reloader 渠道热更新,配置变化时重新构建渠道并且原子的替换,不需要重启进程
+type Reloader struct {
+	manager  Manager
+	source   ConfigSource
+	builders map[string]ChannelBuilder
+	logger   log.Logger
+	lock     *sync.Mutex
+	applied  map[ChannelKey]ChannelConfig // 已经生效的配置,没有变化的渠道不重新构建
+}
+
+/*NewReloader 新建渠道热更新
+参数:
+*	manager 	Manager                  	渠道管理器
+*	source  	ConfigSource             	配置来源
+*	builders	map[string]ChannelBuilder	渠道实现->构建函数
+*	logger  	log.Logger               	日志器
+返回值:
+*	*Reloader	*Reloader	热更新
+*	error    	error    	错误
+*/
+func NewReloader(manager Manager, source ConfigSource, builders map[string]ChannelBuilder, logger log.Logger) (*Reloader, error) {
+	if manager == nil {
+		return nil, errors.New(`渠道管理器不能为空`)
+	}
+
+	if source == nil {
+		return nil, errors.New(`配置来源不能为空`)
+	}
+
+	return &Reloader{
+		manager:  manager,
+		source:   source,
+		builders: builders,
+		logger:   logger,
+		lock:     &sync.Mutex{},
+		applied:  make(map[ChannelKey]ChannelConfig, initCapacity),
+	}, nil
+}
+
+/*Reload 加载配置并且生效,先构建所有变化的渠道,全部成功后才替换,任何一个失败时不做修改
+配置中删除的渠道(之前由Reloader注册的)会被注销
+参数:
+返回值:
+*	error	error	错误
+*/
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	configs, err := r.source.Load()
+	if err != nil {
+		return errors.Wrap(err, `加载配置`)
+	}
+
+	current := make(map[ChannelKey]ChannelConfig, len(configs))
+	changed := make([]ChannelUpdate, 0, len(configs))
+
+	for _, config := range configs {
+		if config.Key == 0 {
+			return errors.New(`key不能为空`)
+		}
+
+		if _, exist := current[config.Key]; exist {
+			return errors.Errorf(`渠道[%d]重复配置`, config.Key)
+		}
+
+		current[config.Key] = config
+
+		if reflect.DeepEqual(r.applied[config.Key], config) {
+			continue
+		}
+
+		if err = config.Limit.Validate(); err != nil {
+			return errors.Wrapf(err, `渠道[%d]的金额限制`, config.Key)
+		}
+
+		if _, err = config.Schedule.compile(); err != nil {
+			return errors.Wrapf(err, `渠道[%d]的可用时间`, config.Key)
+		}
+
+		channel, err := r.build(config)
+		if err != nil {
+			return err
+		}
+
+		changed = append(changed, ChannelUpdate{Channel: channel, Limit: config.Limit, Schedule: config.Schedule})
+	}
+
+	removed := make([]ChannelKey, 0, len(r.applied))
+
+	for key := range r.applied {
+		if _, exist := current[key]; !exist {
+			removed = append(removed, key)
+		}
+	}
+
+	// 所有变化的渠道和删除的渠道一起生效,任何一个不能生效时(例如已经注册了代付的渠道换成了不支持代付的实现)都不修改
+	// 不修改时applied也不变,下次加载时重试
+	if err = r.manager.ApplyAll(changed, removed...); err != nil {
+		return errors.Wrap(err, `更新渠道`)
+	}
+
+	for _, update := range changed {
+		r.logger.Info(`渠道已更新`, zap.String(`渠道`, update.Channel.Key().Text()))
+	}
+
+	for _, key := range removed {
+		r.logger.Info(`渠道已注销`, zap.String(`渠道`, key.Text()))
+	}
+
+	r.applied = current
+
+	return nil
+}
+
+// ChannelUpdate 一个渠道的热更新内容
+type ChannelUpdate struct {
+	Channel  Channel     // 新渠道
+	Limit    AmountLimit // 金额限制
+	Schedule Schedule    // 可用时间
+}
+
+/*Apply 在同一个锁内替换渠道并且设置金额限制和可用时间,读取方不会看到新渠道和旧限制的组合
+已经通过RegisterPayout注册了代付的key,新渠道必须也实现PayoutChannel,代付渠道和回调模板一起替换(例如MGP更换密钥)
+参数:
+*	channel 	Channel    	新渠道
+*	limit   	AmountLimit	金额限制
+*	schedule	Schedule   	可用时间
+返回值:
+*	error   	error      	错误,出错时不做任何修改
+*/
+func (m manager) Apply(channel Channel, limit AmountLimit, schedule Schedule) error {
+	return m.ApplyAll([]ChannelUpdate{{Channel: channel, Limit: limit, Schedule: schedule}})
+}
+
+// applying 校验通过,等待在锁内生效的渠道
+type applying struct {
+	channel      Channel
+	template     AsyncCallBackTemplate
+	capabilities Capabilities
+	limit        AmountLimit
+	schedule     *schedule
+	payout       PayoutChannel // 没有实现代付时为nil
+}
+
+/*ApplyAll 在同一个锁内替换多个渠道并且注销removed,全部校验通过之后才修改,任何一个失败时不做任何修改,规则同Apply
+removed中已经不存在的key忽略,不能同时出现在updates中
+参数:
+*	updates	[]ChannelUpdate	渠道更新
+*	removed	[]ChannelKey   	注销的渠道,同一个key的代付渠道一起注销
+返回值:
+*	error  	error          	错误,出错时不做任何修改
+*/
+func (m manager) ApplyAll(updates []ChannelUpdate, removed ...ChannelKey) error {
+	pending := make([]applying, 0, len(updates))
+	updated := make(map[ChannelKey]bool, len(updates))
+
+	for _, update := range updates {
+		if update.Channel == nil {
+			return errors.New(`充值渠道不能为空`)
+		}
+
+		key := update.Channel.Key()
+
+		if key == 0 {
+			return errors.New(`key不能为空`)
+		}
+
+		if err := update.Limit.Validate(); err != nil {
+			return errors.Wrapf(err, `渠道[%d]金额限制配置错误`, key)
+		}
+
+		compiled, err := update.Schedule.compile()
+		if err != nil {
+			return errors.Wrapf(err, `渠道[%d]可用时间配置错误`, key)
+		}
+
+		updated[key] = true
+
+		template, _ := update.Channel.NeedCheck()
+		payout, _ := update.Channel.(PayoutChannel)
+
+		pending = append(pending, applying{
+			channel:      update.Channel,
+			template:     template,
+			capabilities: CapabilitiesOf(update.Channel),
+			limit:        update.Limit,
+			schedule:     compiled,
+			payout:       payout,
+		})
+	}
+
+	for _, key := range removed {
+		if updated[key] {
+			return errors.Errorf(`渠道[%d]不能同时更新和注销`, key)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// 先检查全部渠道的代付,再修改
+	for _, item := range pending {
+		key := item.channel.Key()
+
+		if _, hasPayout := m.payouts[key]; hasPayout && item.payout == nil {
+			return errors.Errorf(`渠道[%d]已经注册了代付,新渠道没有实现代付`, key)
+		}
+	}
+
+	for _, item := range pending {
+		key := item.channel.Key()
+
+		m.replace(item.channel, item.template, item.capabilities)
+		m.limits[key] = item.limit
+		m.schedules[key] = item.schedule
+
+		if _, hasPayout := m.payouts[key]; !hasPayout {
+			continue
+		}
+
+		m.payouts[key] = item.payout
+
+		if payoutTemplate, _ := item.payout.NeedCheckPayout(); payoutTemplate != nil {
+			m.payoutTemplates[key] = payoutTemplate
+		} else {
+			delete(m.payoutTemplates, key)
+		}
+	}
+
+	for _, key := range removed {
+		m.unregister(key)
+	}
+
+	return nil
+}
+
+func (r *Reloader) build(config ChannelConfig) (Channel, error) {
+	builder, exist := r.builders[config.Provider]
+	if !exist {
+		return nil, errors.Errorf(`渠道[%d]的实现[%s]不存在`, config.Key, config.Provider)
+	}
+
+	channel, err := builder(config)
+	if err != nil {
+		return nil, errors.Wrapf(err, `构建渠道[%d]`, config.Key)
+	}
+
+	if channel.Key() != config.Key {
+		return nil, errors.Errorf(`渠道[%d]构建出的key是[%d]`, config.Key, channel.Key())
+	}
+
+	return channel, nil
+}
+
+/*Start 立即加载一次配置,然后在配置变化时重新加载,ctx结束时停止
+先开始监听再加载,首次加载期间的修改也会触发重新加载
+参数:
+*	ctx	context.Context	上下文
+返回值:
+*	error	error	首次加载的错误,之后的错误只记录日志,保留上一次生效的配置
+*/
+func (r *Reloader) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	changed := r.source.Watch(ctx)
+
+	if err := r.Reload(); err != nil {
+		cancel()
+		return err
+	}
+
+	go func() {
+		defer cancel()
+
+		for range changed {
+			if err := r.Reload(); err != nil {
+				r.logger.Error(`渠道热更新失败`, helpers.ZapError(err))
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package chargechannel
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+)
+
+// RouteGroup 路由分组,同一种支付方式(例如卢布银行卡)的多个渠道
+type RouteGroup string
+
+// RouteWeight 分组中的渠道和权重
+type RouteWeight struct {
+	Key    ChannelKey `json:"key"`    // 渠道
+	Weight int        `json:"weight"` // 权重,必须大于0
+}
+
+// HealthChecker 渠道健康检查,不健康的渠道不参与路由
+type HealthChecker interface {
+	// Healthy 渠道是否健康
+	Healthy(key ChannelKey) bool
+}
+
+// Router 路由,按照权重在分组中可用(已注册、没有停用、满足金额限制、在可用时间内、健康)的渠道里选择一个
+type Router struct {
+	manager Manager
+	groups  map[RouteGroup][]RouteWeight
+	health  HealthChecker
+	lock    *sync.Mutex
+	random  *rand.Rand // rand.Rand 不是并发安全的,使用时加锁
+}
+
+/*NewRouter 新建路由
+参数:
+*	manager	Manager                     	渠道管理器
+*	groups 	map[RouteGroup][]RouteWeight	路由分组
+*	health 	HealthChecker               	健康检查,为nil时使用manager的熔断状态
+返回值:
+*	*Router	*Router	路由
+*	error  	error  	错误
+*/
+func NewRouter(manager Manager, groups map[RouteGroup][]RouteWeight, health HealthChecker) (*Router, error) {
+	if manager == nil {
+		return nil, errors.New(`渠道管理器不能为空`)
+	}
+
+	for group, weights := range groups {
+		if len(weights) == 0 {
+			return nil, errors.Errorf(`分组[%s]没有渠道`, group)
+		}
+
+		for _, weight := range weights {
+			if weight.Key == ChannelKeyAll {
+				return nil, errors.Errorf(`分组[%s]的渠道key不能为空`, group)
+			}
+
+			if weight.Weight <= 0 {
+				return nil, errors.Errorf(`分组[%s]渠道[%d]的权重必须大于0`, group, weight.Key)
+			}
+		}
+	}
+
+	if health == nil {
+		health = manager
+	}
+
+	return &Router{
+		manager: manager,
+		groups:  groups,
+		health:  health,
+		lock:    &sync.Mutex{},
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())), //nolint:gosec
+	}, nil
+}
+
+/*Pick 按照权重选择一个可用的渠道
+参数:
+*	group 	RouteGroup     	路由分组
+*	amount	decimal.Decimal	金额,不满足金额限制的渠道不参与路由
+返回值:
+*	key  	ChannelKey	渠道
+*	err  	error     	错误,没有可用渠道时返回ErrNoAvailableChannel
+*/
+func (r *Router) Pick(group RouteGroup, amount decimal.Decimal) (key ChannelKey, err error) {
+	candidates, err := r.available(group, amount)
+	if err != nil {
+		return ChannelKeyAll, err
+	}
+
+	total := 0
+	for _, candidate := range candidates {
+		total += candidate.Weight
+	}
+
+	r.lock.Lock()
+	point := r.random.Intn(total)
+	r.lock.Unlock()
+
+	for _, candidate := range candidates {
+		if point < candidate.Weight {
+			return candidate.Key, nil
+		}
+
+		point -= candidate.Weight
+	}
+
+	return candidates[len(candidates)-1].Key, nil
+}
+
+// available 分组中可用的渠道,保持配置的顺序
+func (r *Router) available(group RouteGroup, amount decimal.Decimal) ([]RouteWeight, error) {
+	weights, exist := r.groups[group]
+	if !exist {
+		return nil, errors.Errorf(`分组[%s]不存在`, group)
+	}
+
+	result := make([]RouteWeight, 0, len(weights))
+
+	for _, weight := range weights {
+		if _, err := r.manager.LoadByKey(weight.Key); err != nil {
+			continue
+		}
+
+		if r.manager.CheckEnabled(weight.Key) != nil || r.manager.CheckAmount(weight.Key, amount) != nil {
+			continue
+		}
+
+		if r.manager.CheckAvailable(weight.Key, time.Now()) != nil {
+			continue
+		}
+
+		if !r.health.Healthy(weight.Key) {
+			continue
+		}
+
+		result = append(result, weight)
+	}
+
+	if len(result) == 0 {
+		return nil, errors.Wrapf(ErrNoAvailableChannel, `分组[%s]`, group)
+	}
+
+	return result, nil
+}
+
+/*ChargeByGroup 通过路由选择渠道后充值,选中的渠道通过Accessor.SetRecordStarted保存
+参数:
+*	ctx    	context.Context        	上下文
+*	id     	int64                  	充值记录ID
+*	amount 	decimal.Decimal        	金额
+*	group  	RouteGroup             	路由分组
+*	extend 	*CreateOrderExtendParam	额外参数
+返回值:
+*	key    	ChannelKey             	选中的渠道
+*	result 	*CreateOrderResult     	创建订单结果
+*	err    	error                  	错误,没有配置路由时返回ErrNotSupported
+*/
+func (s Service) ChargeByGroup(ctx context.Context, id int64, amount decimal.Decimal, group RouteGroup, extend *CreateOrderExtendParam) (key ChannelKey, result *CreateOrderResult, err error) { //nolint:lll
+	if s.router == nil {
+		return ChannelKeyAll, nil, errors.Wrap(ErrNotSupported, `没有配置路由`)
+	}
+
+	if key, err = s.router.Pick(group, amount); err != nil {
+		return ChannelKeyAll, nil, errors.Wrap(err, `选择渠道`)
+	}
+
+	if result, err = s.Charge(ctx, id, amount, key, extend); result != nil {
+		key = result.ChannelKey // 可能切换到了备用渠道
+	}
+
+	return key, result, err
+}
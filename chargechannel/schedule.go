@@ -0,0 +1,286 @@
+package chargechannel
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	// maxScheduleSteps 计算下次可用时间时最多跳过的窗口数,超过时认为不知道什么时候可用
+	maxScheduleSteps = 100
+)
+
+// Schedule 渠道的可用时间,零值表示一直可用
+type Schedule struct {
+	Location    string              `json:"location"`              // 时区,例如Asia/Shanghai,为空时是UTC
+	Daily       []DailyWindow       `json:"daily,omitempty"`       // 每天的可用时段,为空时全天可用
+	Maintenance []MaintenanceWindow `json:"maintenance,omitempty"` // 维护窗口,期间不可用
+}
+
+// DailyWindow 每天的可用时段,End小于Start时表示跨过零点,相等时表示全天
+type DailyWindow struct {
+	Start string `json:"start"` // 开始时间,格式15:04
+	End   string `json:"end"`   // 结束时间,格式15:04,不包括
+}
+
+// MaintenanceWindow 维护窗口
+type MaintenanceWindow struct {
+	Start  time.Time `json:"start"`  // 开始时间
+	End    time.Time `json:"end"`    // 结束时间
+	Reason string    `json:"reason"` // 维护原因
+}
+
+// schedule 解析后的Schedule
+type schedule struct {
+	location    *time.Location
+	daily       [][2]int // 每天的可用时段,零点开始的分钟数
+	maintenance []MaintenanceWindow
+}
+
+// compile 解析时区和时段
+func (s Schedule) compile() (*schedule, error) {
+	location, err := time.LoadLocation(s.Location)
+	if err != nil {
+		return nil, errors.Wrapf(err, `时区[%s]`, s.Location)
+	}
+
+	result := &schedule{location: location, maintenance: s.Maintenance}
+
+	for _, window := range s.Daily {
+		start, err := parseClock(window.Start)
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseClock(window.End)
+		if err != nil {
+			return nil, err
+		}
+
+		result.daily = append(result.daily, [2]int{start, end})
+	}
+
+	for _, window := range s.Maintenance {
+		if !window.End.After(window.Start) {
+			return nil, fmt.Errorf(`维护窗口[%s]的结束时间必须晚于开始时间`, window.Reason)
+		}
+	}
+
+	return result, nil
+}
+
+// parseClock 解析15:04格式的时间,返回零点开始的分钟数
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, `:`)
+	if len(parts) != 2 { //nolint:gomnd
+		return 0, fmt.Errorf(`时间[%s]格式错误,应该是15:04`, clock)
+	}
+
+	hour, hourErr := strconv.Atoi(parts[0])
+	minute, minuteErr := strconv.Atoi(parts[1])
+
+	if hourErr != nil || minuteErr != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf(`时间[%s]格式错误,应该是15:04`, clock)
+	}
+
+	return hour*60 + minute, nil
+}
+
+/*check 检查某个时间是否可用
+参数:
+*	now          	time.Time	时间
+返回值:
+*	reason       	string   	不可用的原因,可用时为空
+*	nextAvailable	time.Time	下次可用的时间,可用时是now,不知道时是零值
+*/
+func (s *schedule) check(now time.Time) (reason string, nextAvailable time.Time) {
+	at := now
+
+	for i := 0; i < maxScheduleSteps; i++ {
+		if window, in := s.inMaintenance(at); in {
+			if reason == `` {
+				reason = `维护中:` + window.Reason
+			}
+
+			at = window.End
+
+			continue
+		}
+
+		if !s.inDaily(at) {
+			if reason == `` {
+				reason = `不在可用时段`
+			}
+
+			at = s.nextDailyStart(at)
+
+			continue
+		}
+
+		return reason, at
+	}
+
+	return reason, time.Time{}
+}
+
+// inMaintenance 是否在维护窗口中,重叠时返回结束最晚的窗口
+func (s *schedule) inMaintenance(at time.Time) (window MaintenanceWindow, in bool) {
+	for _, maintenance := range s.maintenance {
+		if at.Before(maintenance.Start) || !at.Before(maintenance.End) {
+			continue
+		}
+
+		if !in || maintenance.End.After(window.End) {
+			window, in = maintenance, true
+		}
+	}
+
+	return window, in
+}
+
+func (s *schedule) inDaily(at time.Time) bool {
+	if len(s.daily) == 0 {
+		return true
+	}
+
+	local := at.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	for _, window := range s.daily {
+		start, end := window[0], window[1]
+
+		switch {
+		case start == end:
+			return true
+		case start < end && minute >= start && minute < end:
+			return true
+		case start > end && (minute >= start || minute < end):
+			return true
+		}
+	}
+
+	return false
+}
+
+// nextDailyStart at之后最近的可用时段开始时间
+func (s *schedule) nextDailyStart(at time.Time) time.Time {
+	local := at.In(s.location)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, s.location)
+
+	candidates := make([]time.Time, 0, len(s.daily)*2) //nolint:gomnd
+
+	for day := 0; day <= 1; day++ {
+		for _, window := range s.daily {
+			start := midnight.AddDate(0, 0, day).Add(time.Duration(window[0]) * time.Minute)
+			if start.After(local) {
+				candidates = append(candidates, start)
+			}
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+
+	return candidates[0]
+}
+
+// UnavailableError 渠道不在可用时间内,errors.Is(err, ErrUnavailable)为true
+type UnavailableError struct {
+	Key           ChannelKey // 渠道
+	Reason        string     // 不可用原因
+	NextAvailable time.Time  // 下次可用时间,零值表示不知道
+}
+
+func (u *UnavailableError) Error() string {
+	if u.NextAvailable.IsZero() {
+		return fmt.Sprintf(`渠道[%s]不可用:%s`, u.Key.Text(), u.Reason)
+	}
+
+	return fmt.Sprintf(`渠道[%s]不可用:%s,%s之后可用`, u.Key.Text(), u.Reason, u.NextAvailable.Format(time.RFC3339))
+}
+
+func (u *UnavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// ChannelAvailability 渠道的可用情况
+type ChannelAvailability struct {
+	Key           ChannelKey `json:"key"`              // 渠道
+	Available     bool       `json:"available"`        // 现在是否可用(停用、不在可用时间内都是不可用)
+	Reason        string     `json:"reason,omitempty"` // 不可用原因
+	NextAvailable time.Time  `json:"nextAvailable"`    // 下次可用时间,可用时是查询时间,停用或者不知道时是零值
+}
+
+func (m manager) SetSchedule(key ChannelKey, value Schedule) error {
+	compiled, err := value.compile()
+	if err != nil {
+		return errors.Wrap(err, `可用时间配置错误`)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, exist := m.channels[key]; !exist {
+		return fmt.Errorf(`key[%d]的渠道不存在`, key)
+	}
+
+	m.schedules[key] = compiled
+
+	return nil
+}
+
+func (m manager) CheckAvailable(key ChannelKey, now time.Time) error {
+	m.lock.RLock()
+	compiled, exist := m.schedules[key]
+	m.lock.RUnlock()
+
+	if !exist {
+		return nil
+	}
+
+	if reason, next := compiled.check(now); reason != `` {
+		return &UnavailableError{Key: key, Reason: reason, NextAvailable: next}
+	}
+
+	return nil
+}
+
+func (m manager) Availabilities(now time.Time) []ChannelAvailability {
+	m.lock.RLock()
+
+	keys := make([]ChannelKey, 0, len(m.channels))
+	for key := range m.channels {
+		keys = append(keys, key)
+	}
+
+	m.lock.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+
+	result := make([]ChannelAvailability, 0, len(keys))
+
+	for _, key := range keys {
+		availability := ChannelAvailability{Key: key, Available: true, NextAvailable: now}
+
+		var unavailable *UnavailableError
+
+		if err := m.CheckEnabled(key); err != nil {
+			availability = ChannelAvailability{Key: key, Reason: err.Error()}
+		} else if err = m.CheckAvailable(key, now); errors.As(err, &unavailable) {
+			availability = ChannelAvailability{Key: key, Reason: unavailable.Reason, NextAvailable: unavailable.NextAvailable}
+		}
+
+		result = append(result, availability)
+	}
+
+	return result
+}
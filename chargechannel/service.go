@@ -1,42 +1,110 @@
 package chargechannel
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/babybabylong/common/helpers"
 	"github.com/fighterlyt/log"
 	"github.com/gin-gonic/gin"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
 )
 
 type Service struct {
-	manager  Manager
-	logger   log.Logger
-	engine   *gin.Engine
-	accessor Accessor
-	baseURL  string // http基础路径，baseURL+/1/1 就可以调用到httpOnCallBack
+	manager        Manager
+	logger         log.Logger
+	engine         *gin.Engine
+	accessor       Accessor
+	payoutAccessor PayoutAccessor  // 代付记录存储
+	router         *Router         // 路由,为nil时不能通过分组充值
+	failover       *FailoverPolicy // 下单失败时的切换策略,为nil时不切换
+	callbacks      CallBackStore   // 回调幂等存储
+	baseURL        string          // http基础路径，baseURL+/1/1 就可以调用到httpOnCallBack
 }
 
-func NewService(manager Manager, logger log.Logger, engine *gin.Engine, accessor Accessor, baseURL string) *Service {
-	return &Service{manager: manager, logger: logger, engine: engine, accessor: accessor, baseURL: baseURL}
+// ServiceOption 服务的可选配置,没有指定的配置使用NewService中的默认值
+type ServiceOption func(service *Service)
+
+// WithPayoutAccessor 代付记录存储,没有指定时不能代付
+func WithPayoutAccessor(payoutAccessor PayoutAccessor) ServiceOption {
+	return func(service *Service) {
+		service.payoutAccessor = payoutAccessor
+	}
+}
+
+// WithRouter 路由,没有指定时不能通过分组充值
+func WithRouter(router *Router) ServiceOption {
+	return func(service *Service) {
+		service.router = router
+	}
+}
+
+// WithFailover 下单失败时的切换策略,没有指定时不切换
+func WithFailover(failover *FailoverPolicy) ServiceOption {
+	return func(service *Service) {
+		service.failover = failover
+	}
+}
+
+// WithCallBackStore 回调幂等存储,没有指定时使用内存存储,多实例部署时应该使用NewMongoCallBackStore
+func WithCallBackStore(callbacks CallBackStore) ServiceOption {
+	return func(service *Service) {
+		if callbacks != nil {
+			service.callbacks = callbacks
+		}
+	}
+}
+
+/*NewService 新建服务
+参数:
+*	manager 	Manager         	渠道管理
+*	logger  	log.Logger      	日志
+*	engine  	*gin.Engine     	http服务
+*	accessor	Accessor        	充值记录存储
+*	baseURL 	string          	http基础路径
+*	options 	...ServiceOption	可选配置,代付,路由,切换策略和回调幂等存储
+返回值:
+*	*Service	*Service	服务
+*/
+func NewService(manager Manager, logger log.Logger, engine *gin.Engine, accessor Accessor, baseURL string, options ...ServiceOption) *Service {
+	// 默认值:没有代付,路由和切换策略,回调幂等使用内存存储
+	service := &Service{
+		manager:   manager,
+		logger:    logger,
+		engine:    engine,
+		accessor:  accessor,
+		callbacks: NewMemoryCallBackStore(DefaultCallBackTTL),
+		baseURL:   baseURL,
+	}
+
+	for _, option := range options {
+		option(service)
+	}
+
+	return service
 }
 
-// StartEPayCallback shop-club的http链接
+// StartEPayCallback shop-club(EPay)的http链接
 func (s Service) StartEPayCallback(prefix string) {
 	s.engine.POST(fmt.Sprintf(`/%s/:key/:orderNo`, prefix), s.httpOnCallBack)
 }
 
 func (s Service) Start() {
 	s.engine.POST(`/:key/:orderNo`, s.httpOnCallBack)
-	s.engine.GET(`/callback/:key/:orderNo`, s.httpOnCallBack) // kab渠道的回调
+	s.engine.Any(`/callback/:key/:orderNo`, s.httpOnCallBack) // 任意方法的回调,例如kab的GET回调
+	s.engine.GET(`/channels`, s.httpListChannels)             // 渠道列表
+
+	// 没有代付记录存储时不能代付,也不接收代付回调
+	if s.payoutAccessor != nil {
+		s.engine.POST(`/payout/:key/:payoutNo`, s.httpOnPayoutCallBack)
+	}
 }
 
 func (s Service) httpOnCallBack(ctx *gin.Context) {
@@ -49,18 +117,14 @@ func (s Service) httpOnCallBack(ctx *gin.Context) {
 		return
 	}
 
-	var result io.Reader
+	// 解码方式由回调模板决定,没有注册回调模板的渠道会在加载模板时失败
+	result, err := s.OnCallBack(ChannelKey(channelKey), orderNo, ctx.Request)
 
-	switch ChannelKey(channelKey) {
-	case ChannelKeyEPay, ChannelKeyEPayRuble, ChannelKeyEPayU:
-		result, err = s.OnCallBack(ChannelKey(channelKey), orderNo, ctx.Request.Body)
-	case ChannelKeyKab:
-		result, err = s.OnCallBackKab(ctx, ChannelKey(channelKey), orderNo)
-	default:
-		ctx.String(http.StatusOK, fmt.Sprintf("不支持的充值渠道%s", ChannelKey(channelKey).Text()))
-		return
-	}
+	reply(ctx, result, err)
+}
 
+// reply 回调应答,出错时返回错误信息,否则返回模板生成的body
+func reply(ctx *gin.Context, result io.Reader, err error) {
 	if err != nil {
 		ctx.String(http.StatusOK, err.Error())
 		return
@@ -77,80 +141,258 @@ func (s Service) httpOnCallBack(ctx *gin.Context) {
 	ctx.String(http.StatusOK, string(resp))
 }
 
-func (s Service) OnCallBackKab(ctx *gin.Context, channelKey ChannelKey, orderNo string) (result io.Reader, err error) {
-	data := fmt.Sprintf(`{"orderid":"%s","amount":"%s","payno":"%s","sign":"%s"}`, ctx.Query("orderid"), ctx.Query("amount"), ctx.Query("payno"), ctx.Query("sign"))
-	body := ioutil.NopCloser(strings.NewReader(data))
-
-	return s.OnCallBack(channelKey, orderNo, body)
-}
-
-func (s Service) OnCallBack(channelKey ChannelKey, orderNo string, body io.ReadCloser) (result io.Reader, err error) {
-	if body != nil {
+/*OnCallBack 充值异步回调,按照回调模板声明的编码方式解码
+参数:
+*	channelKey	ChannelKey   	充值渠道
+*	orderNo   	string       	商户订单号
+*	request   	*http.Request	回调请求
+返回值:
+*	result    	io.Reader    	返回给渠道的应答
+*	err       	error        	错误
+*/
+func (s Service) OnCallBack(channelKey ChannelKey, orderNo string, request *http.Request) (result io.Reader, err error) {
+	if request.Body != nil {
 		defer func() {
-			_ = body.Close()
+			_ = request.Body.Close()
 		}()
 	}
 
 	var (
-		template AsyncCallBackTemplate
+		resp AsyncCallBackTemplate
 	)
 
-	if template, err = s.manager.LoadTemplateBy(channelKey); err != nil {
-		return nil, errors.Wrap(err, `加载模板`)
+	// 渠道和模板一起加载,热更新替换渠道时不会出现新模板配旧私钥
+	channel, template, err := s.manager.LoadWithTemplate(channelKey)
+	if err != nil {
+		return nil, errors.Wrap(err, `加载渠道和模板`)
+	}
+
+	if resp, err = decodeCallBack(template, channel.PrivateKey(), request); err != nil {
+		return resp.Result(), err
 	}
 
-	resp := template.New()
+	return s.finishCallBack(CallBackKindCharge, s.accessor.SetRecordFinish, channel, channelKey, orderNo, resp, `回调通知支付失败`)
+}
+
+/*finishCallBack 保存充值或者代付的回调结果,同一笔渠道交易的重复回调直接返回第一次的应答,不再保存
+参数:
+*	kind      	CallBackKind         	回调的业务类型
+*	save      	finishFunc           	保存结果,Accessor.SetRecordFinish 或者 PayoutAccessor.SetPayoutFinish
+*	channel   	interface{}          	充值或者代付渠道,实现了Releaser时保存成功之后释放
+*	channelKey	ChannelKey           	渠道
+*	orderNo   	string               	商户订单号或者代付订单号
+*	resp      	AsyncCallBackTemplate	解码并且验证过的回调
+*	failReason	string               	失败时保存的原因
+返回值:
+*	result    	io.Reader            	返回给渠道的应答
+*	err       	error                	错误,保存失败时返回,让渠道重试
+*/
+func (s Service) finishCallBack(kind CallBackKind, save finishFunc, channel interface{}, channelKey ChannelKey, orderNo string, resp AsyncCallBackTemplate, failReason string) (result io.Reader, err error) { //nolint:lll
+	if status := resp.Status(); status != Paid && status != PaidFail {
+		return resp.Result(), nil // 中间状态不保存,不能挡住之后的最终结果
+	}
+
+	key := CallBackKey{Kind: kind, Key: channelKey, OrderNo: orderNo, TradeNo: resp.TradeNo()}
+
+	claimed, stored, err := s.callbacks.Claim(key, resp.Status())
+	if err != nil {
+		return nil, errors.Wrap(err, `回调幂等`)
+	}
+
+	if !claimed {
+		if stored == nil {
+			return nil, errors.New(`回调正在处理`) // 渠道会重试
+		}
+
+		s.logger.Info(`重复回调`, zap.String(`渠道`, channelKey.Text()), zap.String(`订单号`, orderNo), zap.String(`渠道交易号`, key.TradeNo))
+
+		return bytes.NewReader(stored), nil
+	}
+
+	if err = s.finish(save, channelKey, orderNo, key.TradeNo, resp.Status(), resp.RealPayAmount(), failReason); err != nil {
+		if releaseErr := s.callbacks.Release(key); releaseErr != nil {
+			s.logger.Error(`释放回调失败`, helpers.ZapError(releaseErr))
+		}
+
+		return nil, errors.Wrap(err, `保存结果`) // 返回错误,让渠道重试
+	}
+
+	s.release(channel, channelKey, orderNo)
+
+	var data []byte
+
+	if reader := resp.Result(); reader != nil {
+		if data, err = io.ReadAll(reader); err != nil {
+			s.logger.Error(`读取回调应答失败`, helpers.ZapError(err))
+		}
+	}
 
-	if err = json.NewDecoder(body).Decode(resp); err != nil {
-		return resp.Result(), errors.Wrap(err, `解码失败`)
+	if err = s.callbacks.Complete(key, data); err != nil {
+		s.logger.Error(`保存回调应答失败`, helpers.ZapError(err))
 	}
 
+	return bytes.NewReader(data), nil
+}
+
+/*CheckOrder 主动查单，用于需要主动查单的渠道(NeedCheck()返回need==true)，支付成功或者失败时保存结果
+参数:
+*	channelKey	ChannelKey	充值渠道
+*	orderNo   	string    	商户订单号
+返回值:
+*	paid      	PaidStatus	支付状态,保存失败时是PaidUnknown
+*	err       	error     	错误,包括保存结果失败
+*/
+func (s Service) CheckOrder(channelKey ChannelKey, orderNo string) (paid PaidStatus, err error) {
 	channel, err := s.manager.LoadByKey(channelKey)
 	if err != nil {
-		return nil, errors.Wrap(err, "加载渠道失败")
+		return PaidUnknown, errors.Wrap(err, `加载渠道`)
 	}
 
-	if err = resp.Validate(channel.PrivateKey()); err != nil {
-		return resp.Result(), errors.Wrap(err, `验证失败`)
+	capabilities, err := s.manager.Capabilities(channelKey)
+	if err != nil {
+		return PaidUnknown, errors.Wrap(err, `加载渠道能力`)
 	}
 
-	switch resp.Status() {
+	if !capabilities.ActiveQuery {
+		return PaidUnknown, errors.Wrapf(ErrNotSupported, `渠道[%s]查单`, channelKey.Text())
+	}
+
+	paid, realAmount, tradeNo, err := channel.Check(orderNo)
+	if err != nil {
+		return PaidUnknown, errors.Wrap(err, `查单`)
+	}
+
+	// 保存失败时返回错误,调用方重试查单
+	if err = s.finish(s.accessor.SetRecordFinish, channelKey, orderNo, tradeNo, paid, realAmount, `查单结果支付失败`); err != nil {
+		return PaidUnknown, errors.Wrap(err, `保存支付结果`)
+	}
+
+	if paid == Paid || paid == PaidFail {
+		s.release(channel, channelKey, orderNo)
+	}
+
+	return paid, nil
+}
+
+// finishFunc 保存最终结果,Accessor.SetRecordFinish 和 PayoutAccessor.SetPayoutFinish
+type finishFunc func(key ChannelKey, orderNo, tradeNo string, realAmount decimal.Decimal, err error) error
+
+// finish 支付(代付)成功或者失败时保存结果,其他状态忽略,保存失败时记录日志并返回错误
+func (s Service) finish(save finishFunc, channelKey ChannelKey, orderNo, tradeNo string, paid PaidStatus, realAmount decimal.Decimal, failReason string) error { //nolint:lll
+	var setErr error
+
+	switch paid {
 	case Paid:
-		if setErr := s.accessor.SetRecordFinish(channelKey, orderNo, resp.RealPayAmount(), nil); setErr != nil {
-			s.logger.Error(`设置支付状态失败`, helpers.ZapError(setErr))
-		}
+		setErr = save(channelKey, orderNo, tradeNo, realAmount, nil)
 	case PaidFail:
-		if setErr := s.accessor.SetRecordFinish(channelKey, orderNo, decimal.Zero, errors.New(`回调通知支付失败`)); setErr != nil {
-			s.logger.Error(`设置支付状态失败`, helpers.ZapError(setErr))
+		setErr = save(channelKey, orderNo, tradeNo, decimal.Zero, errors.New(failReason))
+	default:
+		return nil
+	}
+
+	if setErr != nil {
+		s.logger.Error(`设置支付状态失败`, helpers.ZapError(setErr))
+	}
+
+	return setErr
+}
+
+// release 结果保存之后释放渠道为订单占用的资源,失败时只记录日志,占用在订单过期之后失效
+func (s Service) release(channel interface{}, channelKey ChannelKey, orderNo string) {
+	releaser, ok := channel.(Releaser)
+	if !ok {
+		return
+	}
+
+	if err := releaser.Release(orderNo); err != nil {
+		s.logger.Warn(`释放订单占用失败`, zap.String(`渠道`, channelKey.Text()), zap.String(`订单号`, orderNo), helpers.ZapError(err))
+	}
+}
+
+/*Charge 充值,创建渠道订单并保存发起状态
+参数:
+*	ctx       	context.Context        	上下文
+*	id        	int64                  	充值记录ID
+*	amount    	decimal.Decimal        	金额
+*	channelKey	ChannelKey             	充值渠道
+*	extend    	*CreateOrderExtendParam	额外参数
+返回值:
+*	result    	*CreateOrderResult     	创建订单结果,ChannelKey是实际下单的渠道(切换之后和channelKey不同)
+*	err       	error                  	错误,渠道停用时返回*DisabledError,金额不满足限制时返回ErrAmountLimit,不在可用时间内时返回*UnavailableError,熔断时返回*CircuitOpenError,切换时是最后一个渠道的错误
+*/
+func (s Service) Charge(ctx context.Context, id int64, amount decimal.Decimal, channelKey ChannelKey, extend *CreateOrderExtendParam) (result *CreateOrderResult, err error) { //nolint:lll
+	keys := s.failover.chain(channelKey)
+
+	for i, key := range keys {
+		if result, err = s.charge(ctx, id, amount, key, extend); err == nil {
+			return result, nil
+		}
+
+		if i == len(keys)-1 || !s.failover.retryable(ctx, err) {
+			break
 		}
+
+		// 下单前检查没有通过而被跳过的渠道没有请求渠道,没有订单号,也要保存,否则看不到为什么没有使用这个渠道
+		if rejected(err) {
+			if setErr := s.accessor.SetRecordStarted(id, key, ``, ``, err); setErr != nil {
+				s.logger.Error(`保存跳过的渠道失败`, helpers.ZapError(setErr))
+			}
+		}
+
+		s.logger.Warn(`下单失败,切换渠道`, zap.String(`渠道`, key.Text()), zap.String(`备用渠道`, keys[i+1].Text()), helpers.ZapError(err))
 	}
 
-	return resp.Result(), nil
+	return result, err
 }
 
-func (s Service) Charge(ctx context.Context, id int64, amount decimal.Decimal, channelKey ChannelKey, extend *CreateOrderExtendParam) (payUrl, payHtml string, err error) {
-	channel, err := s.manager.LoadByKey(channelKey)
+// charge 在一个渠道下单,每次都生成新的订单号,发起之后通过Accessor保存,下单前检查没有通过时不请求渠道,由Charge决定是否保存
+func (s Service) charge(ctx context.Context, id int64, amount decimal.Decimal, channelKey ChannelKey, extend *CreateOrderExtendParam) (result *CreateOrderResult, err error) { //nolint:lll
+	// 渠道和它的配置来自同一次读取,热更新时不会用旧的限制检查新渠道
+	channel, capabilities, err := s.manager.Prepare(channelKey, amount, time.Now())
 	if err != nil {
-		return payUrl, payHtml, errors.Wrap(err, `加载渠道`)
+		return nil, err
+	}
+
+	// 缺少参数时不请求渠道,也不计入健康统计
+	if err = capabilities.CheckExtend(extend); err != nil {
+		return nil, errors.Wrapf(err, `渠道[%s]`, channelKey.Text())
+	}
+
+	// 熔断检查放在最后,半开时会占用探测名额
+	if err = s.manager.Allow(channelKey); err != nil {
+		return nil, err
 	}
 
 	channelOrderNo := channel.CreateOrderNo(id, amount)
 
-	callbackURL := s.generateCallBackURL(channelKey, channelOrderNo)
+	callbackURL := s.generateCallBackURL(channel, channelKey, channelOrderNo)
 
-	payUrl, payHtml, err = channel.CreateOrder(ctx, channelOrderNo, amount, callbackURL, extend)
+	start := time.Now()
+	result, err = channel.CreateOrder(ctx, channelOrderNo, amount, callbackURL, extend)
 
-	if setErr := s.accessor.SetRecordStarted(id, channelOrderNo, err); setErr != nil {
-		s.logger.Error(`保存订单发起状态失败`, helpers.ZapError(setErr))
+	recorded := err
+
+	// 调用方取消或者超时时不知道渠道是否正常
+	if err != nil && ctx.Err() != nil {
+		recorded = errors.Wrap(ErrCanceled, ctx.Err().Error())
 	}
 
-	return payUrl, payHtml, err
-}
+	s.manager.Record(channelKey, time.Since(start), recorded)
+
+	var tradeNo string
 
-func (s Service) generateCallBackURL(channelKey ChannelKey, orderNo string) string {
-	if channelKey == ChannelKeyKab {
-		return s.baseURL + `/callback/` + fmt.Sprintf("%d", channelKey) + `/` + orderNo
+	if result != nil {
+		result.ChannelKey = channelKey
+		tradeNo = result.TradeNo
+	}
+
+	if setErr := s.accessor.SetRecordStarted(id, channelKey, channelOrderNo, tradeNo, err); setErr != nil {
+		s.logger.Error(`保存订单发起状态失败`, helpers.ZapError(setErr))
 	}
 
-	return s.baseURL + `/` + fmt.Sprintf("%d", channelKey) + `/` + orderNo
+	return result, err
+}
+
+func (s Service) generateCallBackURL(channel Channel, channelKey ChannelKey, orderNo string) string {
+	return s.baseURL + callBackPrefix(channel) + fmt.Sprintf("%d", channelKey) + `/` + orderNo
 }
@@ -0,0 +1,1548 @@
+package chargechannel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fighterlyt/log"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	logger log.Logger
+	err    error
+)
+
+func TestMain(m *testing.M) {
+	if logger, err = log.NewEasyLogger(true, false, ``, `test`); err != nil {
+		panic(err.Error())
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeChannel 测试用的充值渠道,同时支持退款
+type fakeChannel struct {
+	key        ChannelKey
+	privateKey string
+	refunds    map[string]PaidStatus // 退款单号->退款状态
+	createErr  error                 // 下单返回的错误
+	checked    PaidStatus            // 查单返回的状态,零值时是PaidProcessing
+	released   []string              // Release的订单号
+}
+
+func newFakeChannel(key ChannelKey) *fakeChannel {
+	return &fakeChannel{key: key, refunds: map[string]PaidStatus{}}
+}
+
+func (f *fakeChannel) Key() ChannelKey {
+	return f.key
+}
+
+func (f *fakeChannel) PrivateKey() string {
+	return f.privateKey
+}
+
+func (f *fakeChannel) NeedCheck() (template AsyncCallBackTemplate, need bool) {
+	return nil, true
+}
+
+func (f *fakeChannel) CreateOrderNo(_ int64, _ decimal.Decimal) string {
+	return primitive.NewObjectID().Hex()
+}
+
+func (f *fakeChannel) CreateOrder(_ context.Context, orderNo string, _ decimal.Decimal, _ string, _ *CreateOrderExtendParam) (result *CreateOrderResult, err error) { //nolint:lll
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+
+	return &CreateOrderResult{PayURL: `https://pay.example.com/` + orderNo}, nil
+}
+
+func (f *fakeChannel) Check(orderNo string) (paid PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	if f.checked == 0 {
+		return PaidProcessing, decimal.Zero, ``, nil
+	}
+
+	return f.checked, decimal.New(10, 0), `T` + orderNo, nil
+}
+
+func (f *fakeChannel) Release(orderNo string) error {
+	f.released = append(f.released, orderNo)
+
+	return nil
+}
+
+func (f *fakeChannel) Refund(_ context.Context, orderNo string, amount decimal.Decimal, _ string) (result *RefundResult, err error) {
+	refundNo := orderNo + `-` + amount.String()
+	f.refunds[refundNo] = PaidProcessing
+
+	return &RefundResult{RefundNo: refundNo, Status: PaidProcessing}, nil
+}
+
+func (f *fakeChannel) CheckRefund(refundNo string) (status PaidStatus, err error) {
+	if status, exist := f.refunds[refundNo]; exist {
+		return status, nil
+	}
+
+	return PaidUnknown, errors.New(`退款不存在`)
+}
+
+// fakeAccessor 测试用的记录存储
+type fakeAccessor struct {
+	lock     sync.Mutex
+	paid     map[string]decimal.Decimal // 订单号->实际支付金额
+	tradeNos map[string]string          // 订单号->渠道交易号
+	refunds  map[string]refund          // 预留ID或者退款单号->退款,失败的退款会被删除
+	finished map[string]error           // 退款单号->退款结果
+	started  []started                  // 下单记录
+	finishes int                        // SetRecordFinish调用次数
+	setErr   error                      // 不为nil时SetRecordFinish返回这个错误
+}
+
+type started struct {
+	key     ChannelKey
+	orderNo string
+	err     error
+}
+
+type refund struct {
+	orderNo string
+	amount  decimal.Decimal
+}
+
+func newFakeAccessor() *fakeAccessor {
+	return &fakeAccessor{paid: map[string]decimal.Decimal{}, tradeNos: map[string]string{}, refunds: map[string]refund{}, finished: map[string]error{}}
+}
+
+func (f *fakeAccessor) SetRecordStarted(_ int64, key ChannelKey, orderNo, _ string, err error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.started = append(f.started, started{key: key, orderNo: orderNo, err: err})
+
+	return nil
+}
+
+func (f *fakeAccessor) SetRecordFinish(_ ChannelKey, orderNo, tradeNo string, realAmount decimal.Decimal, err error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.finishes++
+
+	if f.setErr != nil {
+		return f.setErr
+	}
+
+	if tradeNo != `` {
+		f.tradeNos[orderNo] = tradeNo
+	}
+
+	if err == nil {
+		f.paid[orderNo] = realAmount
+	}
+
+	return nil
+}
+
+func (f *fakeAccessor) ReserveRefund(_ ChannelKey, orderNo string, amount decimal.Decimal) (reservationID string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	refunded := amount
+
+	for _, item := range f.refunds {
+		if item.orderNo == orderNo {
+			refunded = refunded.Add(item.amount)
+		}
+	}
+
+	if refunded.GreaterThan(f.paid[orderNo]) {
+		return ``, ErrRefundExceeded
+	}
+
+	reservationID = primitive.NewObjectID().Hex()
+	f.refunds[reservationID] = refund{orderNo: orderNo, amount: amount}
+
+	return reservationID, nil
+}
+
+func (f *fakeAccessor) SetRefundStarted(_ ChannelKey, reservationID string, result *RefundResult, err error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err == nil {
+		f.refunds[result.RefundNo] = f.refunds[reservationID]
+	}
+
+	delete(f.refunds, reservationID)
+
+	return nil
+}
+
+func (f *fakeAccessor) SetRefundFinish(_ ChannelKey, refundNo string, err error) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.finished[refundNo] = err
+
+	if err != nil {
+		delete(f.refunds, refundNo)
+	}
+
+	return nil
+}
+
+func TestService_Refund(t *testing.T) {
+	manager := NewManager()
+	channel := newFakeChannel(ChannelKeyEPay)
+	require.NoError(t, manager.Register(channel))
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, ``)
+
+	_, err = service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(10, 0), `测试`)
+	require.True(t, IsRefundExceeded(err), `未支付的订单不能退款`)
+
+	require.NoError(t, accessor.SetRecordFinish(ChannelKeyEPay, `order`, ``, decimal.New(100, 0), nil))
+
+	result, err := service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(60, 0), `测试`)
+	require.NoError(t, err)
+	require.Equal(t, PaidProcessing, result.Status)
+
+	_, err = service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(50, 0), `测试`)
+	require.True(t, IsRefundExceeded(err), `处理中的退款也要计入已退款金额`)
+
+	channel.refunds[result.RefundNo] = PaidFail
+
+	status, err := service.CheckRefund(ChannelKeyEPay, result.RefundNo)
+	require.NoError(t, err)
+	require.Equal(t, PaidFail, status)
+	require.Error(t, accessor.finished[result.RefundNo])
+
+	result, err = service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(100, 0), `测试`)
+	require.NoError(t, err, `失败的退款不计入已退款金额`)
+
+	channel.refunds[result.RefundNo] = Paid
+
+	status, err = service.CheckRefund(ChannelKeyEPay, result.RefundNo)
+	require.NoError(t, err)
+	require.Equal(t, Paid, status)
+	require.NoError(t, accessor.finished[result.RefundNo])
+}
+
+// nilRefundChannel 退款时既不返回结果也不返回错误的渠道
+type nilRefundChannel struct {
+	*fakeChannel
+}
+
+func (n nilRefundChannel) Refund(_ context.Context, _ string, _ decimal.Decimal, _ string) (result *RefundResult, err error) {
+	return nil, nil
+}
+
+func TestService_RefundNilResult(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(nilRefundChannel{fakeChannel: newFakeChannel(ChannelKeyEPay)}))
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, ``)
+
+	require.NoError(t, accessor.SetRecordFinish(ChannelKeyEPay, `order`, ``, decimal.New(100, 0), nil))
+
+	_, err = service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(100, 0), `测试`)
+	require.Error(t, err, `渠道没有返回结果时不能panic`)
+	require.Empty(t, accessor.refunds, `发起失败时释放预留的金额`)
+}
+
+func TestService_RefundNotSupported(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyEPay)))
+
+	service := NewService(manager, logger, nil, struct{ Accessor }{newFakeAccessor()}, ``)
+
+	_, err = service.Refund(context.Background(), ChannelKeyEPay, `order`, decimal.New(10, 0), `测试`)
+	require.True(t, IsNotSupported(err), `存储不支持退款`)
+}
+
+// balanceChannel 测试用的支持余额查询的充值渠道
+type balanceChannel struct {
+	*fakeChannel
+	available decimal.Decimal
+}
+
+func (b *balanceChannel) Balance(_ context.Context) (balance Balance, err error) {
+	return Balance{Available: b.available}, nil
+}
+
+func TestBalanceMonitor_Check(t *testing.T) {
+	manager := NewManager()
+	channel := &balanceChannel{fakeChannel: newFakeChannel(ChannelKeyEPay), available: decimal.New(50, 0)}
+
+	require.NoError(t, manager.Register(channel))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+
+	alerts := make([]ChannelKey, 0, 2)
+
+	monitor, err := NewBalanceMonitor(manager, map[ChannelKey]decimal.Decimal{ChannelKeyEPay: decimal.New(100, 0)}, time.Minute, time.Second,
+		func(key ChannelKey, _ Balance, _ decimal.Decimal) {
+			alerts = append(alerts, key)
+		}, logger)
+	require.NoError(t, err)
+
+	require.Len(t, manager.Balances(context.Background(), time.Second), 1, `不支持余额查询的渠道不返回`)
+	require.Empty(t, manager.Balances(context.Background(), time.Second, ChannelKeyBank), `只查询指定的渠道`)
+
+	monitor.Check(context.Background())
+	monitor.Check(context.Background())
+	require.Equal(t, []ChannelKey{ChannelKeyEPay}, alerts, `余额恢复前只告警一次`)
+
+	channel.available = decimal.New(200, 0)
+	monitor.Check(context.Background())
+	require.Len(t, alerts, 1)
+
+	channel.available = decimal.New(10, 0)
+	monitor.Check(context.Background())
+	require.Len(t, alerts, 2, `余额恢复后再次不足需要告警`)
+}
+
+func TestService_ChargeDisabled(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyEPay)))
+	require.NoError(t, manager.RegisterPayout(fakePayoutChannel{key: ChannelKeyEPay}))
+
+	service := NewService(manager, logger, nil, newFakeAccessor(), `http://example.com`)
+
+	require.Error(t, manager.Disable(ChannelKeyBank, `维护`), `未注册的渠道不能停用`)
+	require.NoError(t, manager.Disable(ChannelKeyEPay, `维护`))
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.True(t, IsDisabled(err))
+
+	var disabled *DisabledError
+
+	require.True(t, errors.As(err, &disabled))
+	require.Equal(t, `维护`, disabled.Reason)
+
+	_, err = service.CheckOrder(ChannelKeyEPay, `order`)
+	require.NoError(t, err, `停用后在途订单仍然可以查单`)
+
+	require.NoError(t, manager.Enable(ChannelKeyEPay))
+
+	result, err := service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, result.PayURL)
+
+	require.NoError(t, manager.Unregister(ChannelKeyEPay))
+
+	_, err = manager.LoadByKey(ChannelKeyEPay)
+	require.Error(t, err)
+	_, err = manager.LoadPayoutByKey(ChannelKeyEPay)
+	require.Error(t, err, `代付渠道一起注销`)
+	_, err = manager.LoadPayoutTemplateBy(ChannelKeyEPay)
+	require.Error(t, err)
+	require.Error(t, manager.Unregister(ChannelKeyEPay))
+	require.NoError(t, manager.RegisterPayout(fakePayoutChannel{key: ChannelKeyEPay}), `注销之后可以重新注册代付`)
+}
+
+func TestReloader_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `channels.json`)
+
+	// ChannelKey序列化成对象,配置文件中是数字
+	write := func(configs ...ChannelConfig) {
+		raw := make([]map[string]interface{}, 0, len(configs))
+		for _, config := range configs {
+			raw = append(raw, map[string]interface{}{`key`: config.Key.Value(), `provider`: config.Provider, `params`: config.Params})
+		}
+
+		data, err := json.Marshal(raw)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+
+	builders := map[string]ChannelBuilder{
+		`fake`: func(config ChannelConfig) (Channel, error) {
+			channel := newFakeChannel(config.Key)
+			channel.privateKey = config.Params[`privateKey`]
+
+			return reloadPayoutChannel{fakeChannel: channel, fakePayoutChannel: fakePayoutChannel{key: config.Key}}, nil
+		},
+	}
+
+	manager := NewManager()
+	require.NoError(t, manager.RegisterPayout(fakePayoutChannel{key: ChannelKeyEPay}))
+	reloader, err := NewReloader(manager, NewFileSource(path, time.Millisecond*10), builders, logger)
+	require.NoError(t, err)
+
+	privateKey := func(key ChannelKey) string {
+		channel, err := manager.LoadByKey(key)
+		require.NoError(t, err)
+
+		return channel.PrivateKey()
+	}
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `old`}},
+		ChannelConfig{Key: ChannelKeyBank, Provider: `fake`})
+	require.NoError(t, reloader.Reload())
+	require.Equal(t, `old`, privateKey(ChannelKeyEPay))
+	require.NoError(t, manager.Disable(ChannelKeyEPay, `维护`))
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `new`}})
+	require.NoError(t, reloader.Reload())
+	require.Equal(t, `new`, privateKey(ChannelKeyEPay))
+	require.True(t, IsDisabled(manager.CheckEnabled(ChannelKeyEPay)), `替换不改变停用状态`)
+
+	payout, err := manager.LoadPayoutByKey(ChannelKeyEPay)
+	require.NoError(t, err)
+	require.Equal(t, `new`, payout.PrivateKey(), `已经注册的代付渠道一起替换`)
+
+	_, err = manager.LoadByKey(ChannelKeyBank)
+	require.Error(t, err, `配置中删除的渠道被注销`)
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `newer`}},
+		ChannelConfig{Key: ChannelKeyBank, Provider: `unknown`})
+	require.Error(t, reloader.Reload())
+	require.Equal(t, `new`, privateKey(ChannelKeyEPay), `任何一个渠道构建失败时不做修改`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `new`}})
+	require.NoError(t, reloader.Start(ctx))
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `watched`}})
+	require.Eventually(t, func() bool {
+		return privateKey(ChannelKeyEPay) == `watched`
+	}, time.Second, time.Millisecond*10, `文件变化后自动更新`)
+}
+
+func TestReloader_ReloadPayoutRequired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), `channels.json`)
+
+	write := func(configs ...ChannelConfig) {
+		raw := make([]map[string]interface{}, 0, len(configs))
+		for _, config := range configs {
+			raw = append(raw, map[string]interface{}{`key`: config.Key.Value(), `provider`: config.Provider, `params`: config.Params})
+		}
+
+		data, err := json.Marshal(raw)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+
+	builders := map[string]ChannelBuilder{
+		`fake`: func(config ChannelConfig) (Channel, error) {
+			channel := newFakeChannel(config.Key)
+			channel.privateKey = config.Params[`privateKey`]
+
+			return reloadPayoutChannel{fakeChannel: channel, fakePayoutChannel: fakePayoutChannel{key: config.Key}}, nil
+		},
+		`plain`: func(config ChannelConfig) (Channel, error) {
+			channel := newFakeChannel(config.Key)
+			channel.privateKey = config.Params[`privateKey`]
+
+			return channel, nil
+		},
+	}
+
+	manager := NewManager()
+	require.NoError(t, manager.RegisterPayout(fakePayoutChannel{key: ChannelKeyEPay}))
+	reloader, err := NewReloader(manager, NewFileSource(path, time.Minute), builders, logger)
+	require.NoError(t, err)
+
+	privateKey := func(key ChannelKey) string {
+		channel, err := manager.LoadByKey(key)
+		require.NoError(t, err)
+
+		return channel.PrivateKey()
+	}
+
+	write(ChannelConfig{Key: ChannelKeyBank, Provider: `plain`, Params: map[string]string{`privateKey`: `old`}},
+		ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `old`}})
+	require.NoError(t, reloader.Reload())
+
+	// 排在前面的Bank可以生效,EPay已经注册了代付,不能换成不支持代付的实现
+	write(ChannelConfig{Key: ChannelKeyBank, Provider: `plain`, Params: map[string]string{`privateKey`: `new`}},
+		ChannelConfig{Key: ChannelKeyEPay, Provider: `plain`, Params: map[string]string{`privateKey`: `new`}})
+	require.Error(t, reloader.Reload())
+	require.Equal(t, `old`, privateKey(ChannelKeyBank), `任何一个渠道不能生效时都不修改`)
+	require.Equal(t, `old`, privateKey(ChannelKeyEPay))
+
+	payout, err := manager.LoadPayoutByKey(ChannelKeyEPay)
+	require.NoError(t, err)
+	require.Equal(t, `old`, payout.PrivateKey())
+
+	write(ChannelConfig{Key: ChannelKeyBank, Provider: `plain`, Params: map[string]string{`privateKey`: `new`}},
+		ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `old`}})
+	require.NoError(t, reloader.Reload())
+	require.Equal(t, `new`, privateKey(ChannelKeyBank), `失败的那次没有记录为已生效,修正之后重新构建`)
+
+	// 删除Bank和不能生效的EPay一起提交,都不生效
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `plain`, Params: map[string]string{`privateKey`: `new`}})
+	require.Error(t, reloader.Reload())
+	require.Equal(t, `new`, privateKey(ChannelKeyBank), `任何一个渠道不能生效时也不注销`)
+
+	write(ChannelConfig{Key: ChannelKeyEPay, Provider: `fake`, Params: map[string]string{`privateKey`: `old`}})
+	require.NoError(t, reloader.Reload())
+
+	_, err = manager.LoadByKey(ChannelKeyBank)
+	require.Error(t, err, `之前没有注销的渠道下次加载时注销`)
+
+	require.Error(t, manager.ApplyAll([]ChannelUpdate{{Channel: newFakeChannel(ChannelKeyEPay)}}, ChannelKeyEPay))
+	require.Equal(t, `old`, privateKey(ChannelKeyEPay))
+}
+
+// orderedSource 记录Watch和Load的调用顺序
+type orderedSource struct {
+	calls    []string
+	watching context.Context
+	err      error
+}
+
+func (o *orderedSource) Load() (configs []ChannelConfig, err error) {
+	o.calls = append(o.calls, `load`)
+
+	return nil, o.err
+}
+
+func (o *orderedSource) Watch(ctx context.Context) <-chan struct{} {
+	o.calls = append(o.calls, `watch`)
+	o.watching = ctx
+
+	changed := make(chan struct{})
+
+	go func() {
+		<-ctx.Done()
+		close(changed)
+	}()
+
+	return changed
+}
+
+func TestReloader_Start(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := &orderedSource{}
+	reloader, err := NewReloader(NewManager(), source, nil, logger)
+	require.NoError(t, err)
+
+	require.NoError(t, reloader.Start(ctx))
+	require.Equal(t, []string{`watch`, `load`}, source.calls, `先开始监听再加载,加载期间的修改不会丢失`)
+
+	source = &orderedSource{err: errors.New(`读取失败`)}
+	reloader, err = NewReloader(NewManager(), source, nil, logger)
+	require.NoError(t, err)
+
+	require.Error(t, reloader.Start(ctx))
+	require.Error(t, source.watching.Err(), `首次加载失败时停止监听`)
+}
+
+// reloadPayoutChannel 测试用的同时支持充值和代付的渠道
+type reloadPayoutChannel struct {
+	*fakeChannel
+	fakePayoutChannel
+}
+
+func (r reloadPayoutChannel) Key() ChannelKey {
+	return r.fakeChannel.Key()
+}
+
+func (r reloadPayoutChannel) PrivateKey() string {
+	return r.fakeChannel.PrivateKey()
+}
+
+// unhealthy 测试用的健康检查
+type unhealthy map[ChannelKey]bool
+
+func (u unhealthy) Healthy(key ChannelKey) bool {
+	return !u[key]
+}
+
+func TestService_ChargeByGroup(t *testing.T) {
+	const group RouteGroup = `卢布银行卡`
+
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyEPay)))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+
+	health := unhealthy{}
+
+	router, err := NewRouter(manager, map[RouteGroup][]RouteWeight{
+		group: {{Key: ChannelKeyEPay, Weight: 1}, {Key: ChannelKeyBank, Weight: 3}, {Key: ChannelKeyKab, Weight: 100}},
+	}, health)
+	require.NoError(t, err)
+
+	router.random = rand.New(rand.NewSource(1)) //nolint:gosec
+
+	picked := map[ChannelKey]int{}
+
+	for i := 0; i < 400; i++ {
+		key, err := router.Pick(group, decimal.New(10, 0))
+		require.NoError(t, err)
+
+		picked[key]++
+	}
+
+	require.Zero(t, picked[ChannelKeyKab], `没有注册的渠道不参与路由`)
+	require.Greater(t, picked[ChannelKeyBank], picked[ChannelKeyEPay]*2, `按照权重选择`)
+	require.Positive(t, picked[ChannelKeyEPay])
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, `http://example.com`, WithRouter(router))
+
+	require.NoError(t, manager.Disable(ChannelKeyBank, `维护`))
+
+	key, result, err := service.ChargeByGroup(context.Background(), 1, decimal.New(10, 0), group, nil)
+	require.NoError(t, err)
+	require.Equal(t, ChannelKeyEPay, key, `停用的渠道不参与路由`)
+	require.NotEmpty(t, result.PayURL)
+	require.Equal(t, ChannelKeyEPay, accessor.started[0].key, `选中的渠道保存在订单上`)
+
+	health[ChannelKeyEPay] = true
+
+	_, _, err = service.ChargeByGroup(context.Background(), 2, decimal.New(10, 0), group, nil)
+	require.True(t, errors.Is(err, ErrNoAvailableChannel))
+
+	_, err = NewRouter(manager, map[RouteGroup][]RouteWeight{group: {{Key: ChannelKeyEPay}}}, nil)
+	require.Error(t, err, `权重必须大于0`)
+}
+
+func TestService_ChargeFailover(t *testing.T) {
+	manager := NewManager()
+	broken := newFakeChannel(ChannelKeyEPay)
+	broken.createErr = errors.New(`渠道维护中`)
+
+	require.NoError(t, manager.Register(broken))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyKab)))
+	require.NoError(t, manager.Disable(ChannelKeyBank, `维护`))
+
+	failover := &FailoverPolicy{Fallbacks: map[ChannelKey][]ChannelKey{ChannelKeyEPay: {ChannelKeyBank, ChannelKeyKab}}}
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, `http://example.com`, WithFailover(failover))
+
+	_, err := service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.True(t, IsDisabled(err), `默认不跳过下单前检查没有通过的渠道`)
+	require.Len(t, accessor.started, 1, `停用的渠道没有请求渠道,不保存`)
+
+	accessor.started = nil
+	failover.SkipRejected = true
+
+	result, err := service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.NoError(t, err)
+	require.Equal(t, ChannelKeyKab, result.ChannelKey, `停用的备用渠道被跳过`)
+
+	require.Len(t, accessor.started, 3, `每次尝试都要保存,包括跳过的渠道`)
+	require.Equal(t, ChannelKeyEPay, accessor.started[0].key)
+	require.Error(t, accessor.started[0].err)
+	require.Equal(t, ChannelKeyBank, accessor.started[1].key)
+	require.True(t, IsDisabled(accessor.started[1].err), `保存跳过的原因`)
+	require.Empty(t, accessor.started[1].orderNo, `跳过的渠道没有订单号`)
+	require.Equal(t, ChannelKeyKab, accessor.started[2].key)
+	require.NoError(t, accessor.started[2].err)
+	require.NotEqual(t, accessor.started[0].orderNo, accessor.started[2].orderNo, `每次下单都是新的订单号`)
+
+	failover.Retryable = func(err error) bool {
+		return false
+	}
+
+	_, err = service.Charge(context.Background(), 2, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.Error(t, err, `不需要切换的错误直接返回`)
+	require.Len(t, accessor.started, 4)
+
+	failover.Retryable = nil
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = service.Charge(ctx, 3, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.Error(t, err, `请求取消后不再切换`)
+	require.Len(t, accessor.started, 5)
+
+	failover.SkipRejected = false
+
+	for _, err := range []error{&DisabledError{Key: ChannelKeyBank}, ErrAmountLimit, &UnavailableError{Key: ChannelKeyBank}, &CircuitOpenError{Key: ChannelKeyBank}} { //nolint:lll
+		require.False(t, failover.retryable(context.Background(), errors.Wrap(err, `下单`)), err.Error())
+	}
+
+	require.True(t, failover.retryable(context.Background(), errors.New(`渠道拒绝`)))
+}
+
+func TestAmountLimit_Check(t *testing.T) {
+	limit := AmountLimit{Min: decimal.New(100, 0), Max: decimal.New(5000, 0), Step: decimal.New(100, 0)}
+
+	tests := []struct {
+		amount string
+		ok     bool
+	}{
+		{amount: `100`, ok: true},
+		{amount: `5000`, ok: true},
+		{amount: `99`, ok: false},
+		{amount: `5100`, ok: false},
+		{amount: `150`, ok: false},
+		{amount: `0`, ok: false},
+	}
+
+	for _, tt := range tests {
+		err := limit.Check(decimal.RequireFromString(tt.amount))
+		require.Equal(t, tt.ok, err == nil, tt.amount)
+		require.Equal(t, !tt.ok, errors.Is(err, ErrAmountLimit), tt.amount)
+	}
+
+	menu := AmountLimit{Min: decimal.New(1000, 0), Allowed: []decimal.Decimal{decimal.New(50, 0), decimal.New(200, 0)}}
+	require.NoError(t, menu.Check(decimal.New(50, 0)), `固定金额时忽略其他限制`)
+	require.Error(t, menu.Check(decimal.New(100, 0)))
+
+	require.Error(t, AmountLimit{Min: decimal.New(10, 0), Max: decimal.New(1, 0)}.Validate())
+}
+
+func TestService_ChargeLimit(t *testing.T) {
+	const group RouteGroup = `卢布银行卡`
+
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyEPay), WithAmountLimit(AmountLimit{Max: decimal.New(1000, 0)})))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+	require.Error(t, manager.SetLimit(ChannelKeyKab, AmountLimit{Max: decimal.New(10, 0)}), `未注册的渠道不能设置限制`)
+	require.Error(t, manager.Register(newFakeChannel(ChannelKeyKab),
+		WithAmountLimit(AmountLimit{Min: decimal.New(10, 0), Max: decimal.New(1, 0)})))
+	require.Len(t, manager.Limits(), 1, `没有指定限制的渠道不限制`)
+	require.True(t, manager.Limits()[ChannelKeyEPay].Max.Equal(decimal.New(1000, 0)), `注册时设置限制`)
+
+	_, err := manager.LoadByKey(ChannelKeyKab)
+	require.Error(t, err, `限制不合法时不注册`)
+
+	router, err := NewRouter(manager, map[RouteGroup][]RouteWeight{
+		group: {{Key: ChannelKeyEPay, Weight: 100}, {Key: ChannelKeyBank, Weight: 1}},
+	}, nil)
+	require.NoError(t, err)
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, `http://example.com`, WithRouter(router))
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(2000, 0), ChannelKeyEPay, nil)
+	require.True(t, errors.Is(err, ErrAmountLimit))
+	require.Empty(t, accessor.started, `不满足限制时不下单`)
+
+	for i := 0; i < 10; i++ {
+		key, _, err := service.ChargeByGroup(context.Background(), 2, decimal.New(2000, 0), group, nil)
+		require.NoError(t, err)
+		require.Equal(t, ChannelKeyBank, key, `不满足限制的渠道不参与路由`)
+	}
+}
+
+func TestSchedule_Check(t *testing.T) {
+	location, err := time.LoadLocation(`Asia/Shanghai`)
+	require.NoError(t, err)
+
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2022, 6, day, hour, minute, 0, 0, location)
+	}
+
+	compiled, err := Schedule{
+		Location: `Asia/Shanghai`,
+		Daily:    []DailyWindow{{Start: `09:00`, End: `12:00`}, {Start: `22:00`, End: `02:00`}},
+		Maintenance: []MaintenanceWindow{
+			{Start: at(2, 9, 0), End: at(2, 10, 30), Reason: `升级`},
+			{Start: at(2, 10, 0), End: at(2, 11, 0), Reason: `延长`},
+		},
+	}.compile()
+	require.NoError(t, err)
+
+	tests := []struct {
+		now    time.Time
+		reason string
+		next   time.Time
+	}{
+		{now: at(1, 10, 0), next: at(1, 10, 0)},
+		{now: at(1, 23, 0), next: at(1, 23, 0)},
+		{now: at(2, 1, 59), next: at(2, 1, 59)},
+		{now: at(2, 2, 0), reason: `不在可用时段`, next: at(2, 11, 0)},
+		{now: at(1, 13, 0), reason: `不在可用时段`, next: at(1, 22, 0)},
+		{now: at(2, 9, 30), reason: `维护中:升级`, next: at(2, 11, 0)},
+		{now: at(2, 12, 30), reason: `不在可用时段`, next: at(2, 22, 0)},
+	}
+
+	for _, tt := range tests {
+		reason, next := compiled.check(tt.now)
+		require.Equal(t, tt.reason, reason, tt.now.String())
+		require.True(t, tt.next.Equal(next), `%s: %s`, tt.now, next)
+	}
+
+	_, err = Schedule{Daily: []DailyWindow{{Start: `9`, End: `12:00`}}}.compile()
+	require.Error(t, err)
+
+	_, err = Schedule{Location: `Mars/Base`}.compile()
+	require.Error(t, err)
+}
+
+func TestManager_Prepare(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyEPay)))
+
+	now := time.Now()
+
+	channel, capabilities, err := manager.Prepare(ChannelKeyEPay, decimal.New(10, 0), now)
+	require.NoError(t, err)
+	require.Equal(t, ChannelKeyEPay, channel.Key())
+	require.Equal(t, CapabilitiesOf(channel), capabilities)
+
+	require.NoError(t, manager.SetLimit(ChannelKeyEPay, AmountLimit{Min: decimal.New(100, 0)}))
+	_, _, err = manager.Prepare(ChannelKeyEPay, decimal.New(10, 0), now)
+	require.True(t, IsAmountLimit(err))
+
+	require.NoError(t, manager.SetSchedule(ChannelKeyEPay, Schedule{
+		Maintenance: []MaintenanceWindow{{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Reason: `维护`}},
+	}))
+	_, _, err = manager.Prepare(ChannelKeyEPay, decimal.New(100, 0), now)
+	require.True(t, IsUnavailable(err))
+
+	require.NoError(t, manager.Disable(ChannelKeyEPay, `停用`))
+	_, _, err = manager.Prepare(ChannelKeyEPay, decimal.New(100, 0), now)
+	require.True(t, IsDisabled(err))
+
+	_, _, err = manager.Prepare(ChannelKeyBank, decimal.New(100, 0), now)
+	require.Error(t, err)
+}
+
+func TestService_ChargeSchedule(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyKab)))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+
+	now := time.Now()
+	require.NoError(t, manager.SetSchedule(ChannelKeyKab, Schedule{
+		Maintenance: []MaintenanceWindow{{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Reason: `公告维护`}},
+	}))
+
+	service := NewService(manager, logger, nil, newFakeAccessor(), `http://example.com`)
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyKab, nil)
+	require.True(t, errors.Is(err, ErrUnavailable))
+
+	var unavailable *UnavailableError
+
+	require.True(t, errors.As(err, &unavailable))
+	require.True(t, unavailable.NextAvailable.Equal(now.Add(time.Hour)))
+
+	availabilities := manager.Availabilities(now)
+	require.Len(t, availabilities, 2)
+	require.True(t, availabilities[0].Available)
+	require.Equal(t, ChannelKeyKab, availabilities[1].Key)
+	require.False(t, availabilities[1].Available)
+	require.True(t, availabilities[1].NextAvailable.Equal(now.Add(time.Hour)), `渠道列表中显示下次可用时间`)
+}
+
+func TestManager_CircuitBreaker(t *testing.T) {
+	instance := NewManager()
+	require.NoError(t, instance.Register(newFakeChannel(ChannelKeyEPay)))
+	require.NoError(t, instance.SetHealthConfig(HealthConfig{Window: time.Minute, MinRequests: 4, ErrorRate: 0.5, Cooldown: time.Second * 30}))
+
+	now := time.Now()
+	instance.(*manager).health.now = func() time.Time {
+		return now
+	}
+
+	failure := errors.New(`连接超时`)
+
+	for _, err := range []error{nil, failure, nil, failure} {
+		require.NoError(t, instance.Allow(ChannelKeyEPay))
+		instance.Record(ChannelKeyEPay, time.Millisecond*100, err)
+	}
+
+	health := instance.Health(ChannelKeyEPay)
+	require.Equal(t, CircuitOpen, health.State, `错误率达到阈值时熔断`)
+	require.Equal(t, 4, health.Requests)
+	require.Equal(t, 0.5, health.ErrorRate)
+	require.Equal(t, time.Millisecond*100, health.AvgLatency)
+	require.False(t, instance.Healthy(ChannelKeyEPay))
+	require.True(t, errors.Is(instance.Allow(ChannelKeyEPay), ErrCircuitOpen))
+
+	now = now.Add(time.Second * 30)
+	require.True(t, instance.Healthy(ChannelKeyEPay), `冷却结束后可以探测`)
+	require.NoError(t, instance.Allow(ChannelKeyEPay))
+	require.Error(t, instance.Allow(ChannelKeyEPay), `半开时只允许一个探测请求`)
+	require.False(t, instance.Healthy(ChannelKeyEPay), `探测中的渠道不健康`)
+
+	instance.Record(ChannelKeyEPay, time.Millisecond, ErrCanceled)
+	require.Equal(t, CircuitHalfOpen, instance.Health(ChannelKeyEPay).State, `调用方取消时不知道渠道是否正常`)
+	require.NoError(t, instance.Allow(ChannelKeyEPay), `没有结果的探测释放名额`)
+
+	instance.Record(ChannelKeyEPay, time.Millisecond, failure)
+	require.Equal(t, CircuitOpen, instance.Health(ChannelKeyEPay).State, `探测失败继续熔断`)
+
+	now = now.Add(time.Second * 30)
+	require.NoError(t, instance.Allow(ChannelKeyEPay))
+	instance.Record(ChannelKeyEPay, time.Millisecond, nil)
+	require.Equal(t, CircuitClosed, instance.Health(ChannelKeyEPay).State, `探测成功恢复`)
+
+	now = now.Add(time.Minute * 2)
+	require.Zero(t, instance.Health(ChannelKeyEPay).Requests, `滑动窗口之外的请求不统计`)
+	require.Len(t, instance.Healths(), 1)
+}
+
+func TestService_ChargeHealthIgnored(t *testing.T) {
+	manager := NewManager()
+	broken := newFakeChannel(ChannelKeyEPay)
+	broken.createErr = errors.Wrap(ErrInvalidArgument, `非法的回调地址`)
+
+	require.NoError(t, manager.Register(broken))
+	require.NoError(t, manager.SetHealthConfig(HealthConfig{Window: time.Minute, MinRequests: 2, ErrorRate: 0.5, Cooldown: time.Minute}))
+
+	service := NewService(manager, logger, nil, newFakeAccessor(), `http://example.com`)
+
+	for i := 0; i < 3; i++ {
+		_, err := service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+		require.True(t, IsInvalidArgument(err))
+	}
+
+	require.Zero(t, manager.Health(ChannelKeyEPay).Requests, `本地参数校验失败不计入统计`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	broken.createErr = context.Canceled
+
+	for i := 0; i < 3; i++ {
+		_, err := service.Charge(ctx, 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+		require.Error(t, err)
+	}
+
+	require.Zero(t, manager.Health(ChannelKeyEPay).Requests, `调用方取消不计入统计`)
+
+	broken.createErr = errors.Wrap(context.DeadlineExceeded, `请求渠道`)
+
+	_, err := service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.Error(t, err)
+	require.Equal(t, 1, manager.Health(ChannelKeyEPay).Requests, `渠道自己的超时计入统计`)
+}
+
+func TestService_ChargeCircuitOpen(t *testing.T) {
+	manager := NewManager()
+	broken := newFakeChannel(ChannelKeyEPay)
+	broken.createErr = errors.New(`连接超时`)
+
+	require.NoError(t, manager.Register(broken))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+	require.NoError(t, manager.SetHealthConfig(HealthConfig{Window: time.Minute, MinRequests: 2, ErrorRate: 0.5, Cooldown: time.Minute}))
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, `http://example.com`)
+
+	for i := 0; i < 2; i++ {
+		_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+		require.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyEPay, nil)
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+	require.Len(t, accessor.started, 2, `熔断后不再请求渠道`)
+
+	router, err := NewRouter(manager, map[RouteGroup][]RouteWeight{
+		`卢布银行卡`: {{Key: ChannelKeyEPay, Weight: 100}, {Key: ChannelKeyBank, Weight: 1}},
+	}, nil)
+	require.NoError(t, err)
+
+	key, err := router.Pick(`卢布银行卡`, decimal.New(10, 0))
+	require.NoError(t, err)
+	require.Equal(t, ChannelKeyBank, key, `默认使用manager的熔断状态路由`)
+}
+
+// describedChannel 测试用的声明了能力的渠道,不支持主动查单
+type describedChannel struct {
+	*fakeChannel
+}
+
+func (d describedChannel) Capabilities() Capabilities {
+	return Capabilities{Currencies: []string{`RUB`}, ExtendFields: []string{ExtendFieldUserID, ExtendFieldUserIP}}
+}
+
+func TestService_ListChannels(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(describedChannel{fakeChannel: newFakeChannel(ChannelKeyMerchant)}))
+	require.NoError(t, manager.Register(newFakeChannel(ChannelKeyBank)))
+	require.NoError(t, manager.SetLimit(ChannelKeyMerchant, AmountLimit{Min: decimal.New(100, 0)}))
+	require.NoError(t, manager.Disable(ChannelKeyBank, `维护`))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	NewService(manager, logger, engine, newFakeAccessor(), ``).Start()
+
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, `/channels`, nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var channels []struct {
+		Key struct {
+			Value int    `json:"value"`
+			Text  string `json:"text"`
+		} `json:"key"`
+		Limit          AmountLimit  `json:"limit"`
+		Enabled        bool         `json:"enabled"`
+		DisabledReason string       `json:"disabledReason"`
+		Available      bool         `json:"available"`
+		NextAvailable  time.Time    `json:"nextAvailable"`
+		Capabilities   Capabilities `json:"capabilities"`
+	}
+
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &channels))
+	require.Len(t, channels, 2)
+
+	require.Equal(t, ChannelKeyBank.Value(), channels[0].Key.Value)
+	require.Equal(t, ChannelKeyBank.Text(), channels[0].Key.Text, `key通过ChannelKey.MarshalJSON序列化`)
+	require.False(t, channels[0].Enabled)
+	require.Equal(t, `维护`, channels[0].DisabledReason)
+	require.False(t, channels[0].Available, `停用的渠道不可用`)
+	require.True(t, channels[0].NextAvailable.IsZero(), `停用的渠道不知道什么时候可用`)
+	require.Empty(t, channels[0].Capabilities.ExtendFields)
+	require.True(t, channels[0].Capabilities.ActiveQuery, `没有声明时由NeedCheck决定`)
+
+	require.Equal(t, ChannelKeyMerchant.Value(), channels[1].Key.Value)
+	require.True(t, channels[1].Enabled)
+	require.True(t, channels[1].Available)
+	require.Equal(t, []string{`RUB`}, channels[1].Capabilities.Currencies)
+	require.True(t, channels[1].Limit.Min.Equal(decimal.New(100, 0)))
+	require.Equal(t, []string{ExtendFieldUserID, ExtendFieldUserIP}, channels[1].Capabilities.ExtendFields)
+}
+
+func TestService_Capabilities(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(describedChannel{fakeChannel: newFakeChannel(ChannelKeyMerchant)}))
+
+	capabilities, err := manager.Capabilities(ChannelKeyMerchant)
+	require.NoError(t, err)
+	require.False(t, capabilities.ActiveQuery)
+	require.True(t, capabilities.Refund, `退款以实现为准`)
+	require.False(t, capabilities.Callback)
+	require.False(t, capabilities.Balance)
+
+	_, err = manager.Capabilities(ChannelKeyBank)
+	require.Error(t, err)
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, `http://example.com`)
+
+	_, err = service.CheckOrder(ChannelKeyMerchant, `order`)
+	require.True(t, IsNotSupported(err), `不支持查单的渠道不调用Check`)
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyMerchant, &CreateOrderExtendParam{UserID: 1})
+	require.True(t, IsExtendRequired(err))
+	require.Contains(t, err.Error(), ExtendFieldUserIP)
+	require.Empty(t, accessor.started, `缺少参数时不请求渠道`)
+
+	_, err = service.Charge(context.Background(), 1, decimal.New(10, 0), ChannelKeyMerchant, &CreateOrderExtendParam{UserID: 1, UserIP: `127.0.0.1`}) //nolint:lll
+	require.NoError(t, err)
+
+	require.NoError(t, manager.Unregister(ChannelKeyMerchant))
+	_, err = manager.Capabilities(ChannelKeyMerchant)
+	require.Error(t, err, `注销时删除能力`)
+}
+
+func TestErrorHelpers(t *testing.T) {
+	require.True(t, IsAmountLimit(AmountLimit{Max: decimal.New(1, 0)}.Check(decimal.New(2, 0))))
+	require.True(t, IsUnavailable(errors.Wrap(&UnavailableError{Key: ChannelKeyBank}, `下单`)))
+	require.True(t, IsCircuitOpen(errors.Wrap(&CircuitOpenError{Key: ChannelKeyBank}, `下单`)))
+	require.True(t, IsDisabled(&DisabledError{Key: ChannelKeyBank}))
+	require.True(t, IsNoAvailableChannel(errors.Wrap(ErrNoAvailableChannel, `分组`)))
+	require.True(t, IsExtendRequired(Capabilities{ExtendFields: []string{ExtendFieldPayCode}}.CheckExtend(nil)))
+	require.False(t, IsAmountLimit(ErrUnavailable))
+}
+
+// encodedCallBack 测试用的回调模板,签名是私钥+订单号
+type encodedCallBack struct {
+	encoding CallBackEncoding
+	OrderNo  string `json:"orderNo" form:"orderNo"`
+	Failed   bool   `json:"failed" form:"failed"` // 为true时是失败回调,不参与签名
+	Sign     string `json:"sign" form:"sign"`
+}
+
+func (e encodedCallBack) New() AsyncCallBackTemplate {
+	return &encodedCallBack{encoding: e.encoding}
+}
+
+func (e encodedCallBack) Encoding() CallBackEncoding {
+	return e.encoding
+}
+
+func (e encodedCallBack) Validate(privateKey string) error {
+	if e.Sign != privateKey+e.OrderNo {
+		return errors.New(`签名错误`)
+	}
+
+	return nil
+}
+
+func (e encodedCallBack) Status() PaidStatus {
+	if e.Failed {
+		return PaidFail
+	}
+
+	return Paid
+}
+
+func (e encodedCallBack) Result() io.Reader {
+	return strings.NewReader(`ok`)
+}
+
+func (e encodedCallBack) RealPayAmount() decimal.Decimal {
+	return decimal.New(10, 0)
+}
+
+func (e encodedCallBack) TradeNo() string {
+	return `trade-` + e.OrderNo
+}
+
+// callbackChannel 测试用的有回调模板的渠道
+type callbackChannel struct {
+	*fakeChannel
+	template AsyncCallBackTemplate
+}
+
+func (c callbackChannel) NeedCheck() (template AsyncCallBackTemplate, need bool) {
+	return c.template, false
+}
+
+func TestService_OnCallBack(t *testing.T) {
+	manager := NewManager()
+	channels := map[CallBackEncoding]callbackChannel{
+		CallBackJSON:  {fakeChannel: &fakeChannel{key: ChannelKeyEPay, privateKey: `key`}, template: encodedCallBack{encoding: CallBackJSON}},
+		CallBackForm:  {fakeChannel: &fakeChannel{key: ChannelKeyMerchant, privateKey: `key`}, template: encodedCallBack{encoding: CallBackForm}},
+		CallBackQuery: {fakeChannel: &fakeChannel{key: ChannelKeyKab, privateKey: `key`}, template: encodedCallBack{encoding: CallBackQuery}},
+	}
+
+	for _, channel := range channels {
+		require.NoError(t, manager.Register(channel))
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, engine, accessor, `http://example.com`)
+	service.Start()
+
+	orderNo := `a"b&c` // 引号和&不能破坏解码
+	values := url.Values{`orderNo`: {orderNo}, `sign`: {`key` + orderNo}}
+	body, _ := json.Marshal(map[string]string{`orderNo`: orderNo, `sign`: `key` + orderNo})
+
+	requests := map[CallBackEncoding]*http.Request{
+		CallBackJSON:  httptest.NewRequest(http.MethodPost, fmt.Sprintf(`/%d/json`, ChannelKeyEPay), bytes.NewReader(body)),
+		CallBackForm:  httptest.NewRequest(http.MethodPost, fmt.Sprintf(`/%d/form`, ChannelKeyMerchant), strings.NewReader(values.Encode())),
+		CallBackQuery: httptest.NewRequest(http.MethodGet, fmt.Sprintf(`/callback/%d/query?%s`, ChannelKeyKab, values.Encode()), nil),
+	}
+	requests[CallBackForm].Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+
+	for encoding, request := range requests {
+		recorder := httptest.NewRecorder()
+		engine.ServeHTTP(recorder, request)
+		require.Equal(t, `ok`, recorder.Body.String(), encoding.String())
+		require.True(t, decimal.New(10, 0).Equal(accessor.paid[encoding.String()]), encoding.String())
+	}
+
+	values.Set(`sign`, `wrong`)
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, fmt.Sprintf(`/callback/%d/wrong?%s`, ChannelKeyKab, values.Encode()), nil))
+	require.Contains(t, recorder.Body.String(), `验证失败`, `/callback支持任意方法`)
+	require.NotContains(t, accessor.paid, `wrong`)
+
+	require.Equal(t, fmt.Sprintf(`http://example.com/callback/%d/order`, ChannelKeyKab), service.generateCallBackURL(channels[CallBackQuery], ChannelKeyKab, `order`)) //nolint:lll
+	require.Equal(t, fmt.Sprintf(`http://example.com/%d/order`, ChannelKeyEPay), service.generateCallBackURL(channels[CallBackJSON], ChannelKeyEPay, `order`))         //nolint:lll
+}
+
+func TestMemoryCallBackStore(t *testing.T) {
+	store := NewMemoryCallBackStore(time.Hour).(*memoryCallBackStore)
+	now := time.Now()
+	store.now = func() time.Time {
+		return now
+	}
+
+	key := CallBackKey{Kind: CallBackKindCharge, Key: ChannelKeyEPay, OrderNo: `order`, TradeNo: `trade`}
+
+	claimed, result, err := store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	claimed, result, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.False(t, claimed, `处理中不能再次占用`)
+	require.Nil(t, result)
+
+	now = now.Add(callBackClaimTimeout)
+	claimed, _, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed, `处理超时可以重新占用`)
+
+	require.NoError(t, store.Release(key))
+	claimed, _, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed, `释放之后可以重新占用`)
+
+	require.NoError(t, store.Complete(key, []byte(`fail`)))
+	claimed, result, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	require.Equal(t, []byte(`fail`), result)
+
+	require.NoError(t, store.Release(key))
+	_, result, _ = store.Claim(key, PaidFail)
+	require.Equal(t, []byte(`fail`), result, `完成之后不能释放`)
+
+	claimed, _, _ = store.Claim(key, Paid)
+	require.True(t, claimed, `同一笔渠道交易先失败后成功不是重复回调`)
+	require.NoError(t, store.Complete(key, []byte(`ok`)))
+
+	claimed, result, _ = store.Claim(key, PaidFail)
+	require.False(t, claimed, `成功之后的失败回调不再处理`)
+	require.Equal(t, []byte(`ok`), result)
+
+	claimed, _, _ = store.Claim(CallBackKey{Kind: CallBackKindCharge, Key: ChannelKeyEPay, OrderNo: `order`, TradeNo: `other`}, PaidFail)
+	require.False(t, claimed, `订单成功之后其他渠道交易号的失败回调也不再处理`)
+
+	claimed, _, _ = store.Claim(CallBackKey{Kind: CallBackKindCharge, Key: ChannelKeyEPay, OrderNo: `order`, TradeNo: `other`}, Paid)
+	require.True(t, claimed, `不同的渠道交易号分别处理`)
+
+	payout := key
+	payout.Kind = CallBackKindPayout
+
+	claimed, _, _ = store.Claim(payout, PaidFail)
+	require.True(t, claimed, `充值和代付的订单号不在同一个命名空间`)
+
+	now = now.Add(time.Hour)
+	claimed, _, _ = store.Claim(key, PaidFail)
+	require.True(t, claimed, `过期之后删除`)
+}
+
+// newTestCollection 测试用的mongo集合,地址由环境变量MONGO_URI指定,连接不上时跳过
+func newTestCollection(t *testing.T, name string) *mongo.Collection {
+	uri := os.Getenv(`MONGO_URI`)
+	if uri == `` {
+		uri = `mongodb://localhost:27017`
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+
+	if err = client.Ping(ctx, nil); err != nil {
+		t.Skipf(`mongo[%s]不可用:%s`, uri, err.Error())
+	}
+
+	t.Cleanup(func() {
+		_ = client.Disconnect(context.Background())
+	})
+
+	collection := client.Database(`test`).Collection(name)
+	require.NoError(t, collection.Drop(context.Background()))
+
+	return collection
+}
+
+func TestMongoCallBackStore(t *testing.T) {
+	collection := newTestCollection(t, `callback`)
+
+	store, err := NewMongoCallBackStore(collection, time.Hour, time.Second, logger)
+	require.NoError(t, err)
+
+	_, err = NewMongoCallBackStore(collection, time.Hour, time.Second, logger)
+	require.NoError(t, err, `索引已经存在时不重复创建`)
+
+	cursor, err := collection.Indexes().List(context.Background())
+	require.NoError(t, err)
+
+	indexes := make([]bson.M, 0, 3)
+	require.NoError(t, cursor.All(context.Background(), &indexes))
+
+	byName := make(map[string]bson.M, len(indexes))
+	for _, index := range indexes {
+		byName[index[`name`].(string)] = index
+	}
+
+	require.Equal(t, true, byName[`callback-3`][`unique`], `幂等键是唯一索引`)
+	require.Len(t, byName[`callback-3`][`key`], 4, `唯一索引包括业务类型,渠道,订单号和渠道交易号`)
+	require.EqualValues(t, time.Hour.Seconds(), byName[`expire-1`][`expireAfterSeconds`], `处理记录按ttl过期`)
+
+	key := CallBackKey{Kind: CallBackKindCharge, Key: ChannelKeyEPay, OrderNo: primitive.NewObjectID().Hex(), TradeNo: `trade`}
+
+	claimed, _, err := store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	claimed, result, err := store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.False(t, claimed, `唯一索引保证只有一个占用成功`)
+	require.Nil(t, result)
+
+	require.NoError(t, store.Release(key))
+	claimed, _, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed, `释放之后可以重新占用`)
+
+	// 模拟处理的实例已经退出
+	_, err = collection.UpdateOne(context.Background(), bson.M{`orderNo`: key.OrderNo},
+		bson.M{`$set`: bson.M{`claimedAt`: time.Now().Add(-callBackClaimTimeout)}})
+	require.NoError(t, err)
+
+	claimed, _, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed, `处理超时可以重新占用`)
+
+	require.NoError(t, store.Complete(key, []byte(`fail`)))
+	require.NoError(t, store.Release(key))
+
+	claimed, result, err = store.Claim(key, PaidFail)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	require.Equal(t, []byte(`fail`), result, `完成之后不能释放,返回保存的应答`)
+
+	claimed, _, err = store.Claim(key, Paid)
+	require.NoError(t, err)
+	require.True(t, claimed, `同一笔渠道交易先失败后成功不是重复回调`)
+	require.NoError(t, store.Complete(key, []byte(`ok`)))
+
+	other := key
+	other.TradeNo = `other`
+
+	claimed, result, err = store.Claim(other, PaidFail)
+	require.NoError(t, err)
+	require.False(t, claimed, `订单成功之后的失败回调不再处理`)
+	require.Equal(t, []byte(`ok`), result)
+
+	payout := key
+	payout.Kind = CallBackKindPayout
+
+	claimed, _, err = store.Claim(payout, PaidFail)
+	require.NoError(t, err)
+	require.True(t, claimed, `充值和代付的订单号不在同一个命名空间`)
+}
+
+func TestService_OnCallBackIdempotent(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.Register(callbackChannel{fakeChannel: &fakeChannel{key: ChannelKeyEPay, privateKey: `key`}, template: encodedCallBack{}}))
+
+	accessor := newFakeAccessor()
+	service := NewService(manager, logger, nil, accessor, ``)
+
+	newRequest := func(orderNo string) *http.Request {
+		body, _ := json.Marshal(map[string]string{`orderNo`: orderNo, `sign`: `key` + orderNo})
+		return httptest.NewRequest(http.MethodPost, `/`, bytes.NewReader(body))
+	}
+
+	accessor.setErr = errors.New(`数据库错误`)
+	_, err = service.OnCallBack(ChannelKeyEPay, `order`, newRequest(`order`))
+	require.Error(t, err, `保存失败时让渠道重试`)
+
+	accessor.setErr = nil
+
+	for i := 0; i < 3; i++ {
+		var result io.Reader
+
+		result, err = service.OnCallBack(ChannelKeyEPay, `order`, newRequest(`order`))
+		require.NoError(t, err)
+
+		data, _ := io.ReadAll(result)
+		require.Equal(t, `ok`, string(data), `重复回调返回保存的应答`)
+	}
+
+	require.Equal(t, 2, accessor.finishes, `失败之后重新处理一次,重复回调不再调用Accessor`)
+
+	_, err = service.OnCallBack(ChannelKeyEPay, `order`, newRequest(`other`))
+	require.NoError(t, err)
+	require.Equal(t, 3, accessor.finishes, `不同的渠道交易号`)
+
+	body, _ := json.Marshal(map[string]interface{}{`orderNo`: `order`, `sign`: `keyorder`, `failed`: true})
+	_, err = service.OnCallBack(ChannelKeyEPay, `order`, httptest.NewRequest(http.MethodPost, `/`, bytes.NewReader(body)))
+	require.NoError(t, err)
+	require.Equal(t, 3, accessor.finishes, `成功之后的失败回调不再保存`)
+	require.Contains(t, accessor.paid, `order`)
+}
+
+func TestService_CheckOrder(t *testing.T) {
+	channel := newFakeChannel(ChannelKeyEPay)
+	channel.checked = Paid
+
+	manager := NewManager()
+	require.NoError(t, manager.Register(channel))
+
+	accessor := newFakeAccessor()
+	accessor.setErr = errors.New(`数据库错误`)
+	service := NewService(manager, logger, nil, accessor, `http://example.com`)
+
+	paid, err := service.CheckOrder(ChannelKeyEPay, `order`)
+	require.Error(t, err, `保存失败时返回错误`)
+	require.Equal(t, PaidUnknown, paid, `保存失败时不能返回已支付`)
+	require.Empty(t, channel.released, `保存失败时不释放`)
+
+	accessor.setErr = nil
+
+	paid, err = service.CheckOrder(ChannelKeyEPay, `order`)
+	require.NoError(t, err)
+	require.Equal(t, Paid, paid)
+	require.True(t, accessor.paid[`order`].Equal(decimal.New(10, 0)))
+	require.Equal(t, `Torder`, accessor.tradeNos[`order`], `保存查单返回的渠道交易号`)
+	require.Equal(t, []string{`order`}, channel.released, `保存成功之后释放`)
+}
+
+func TestChannelKey_Text(t *testing.T) {
+	require.Equal(t, `未知(200)`, ChannelKey(200).Text(), `没有注册名称时显示key`)
+
+	require.False(t, RegisterText(ChannelKeyEPay, `其他`), `内置key的名称不能覆盖`)
+	require.Equal(t, `E-Pay`, ChannelKeyEPay.Text())
+
+	require.True(t, RegisterText(ChannelKey(201), `自定义渠道`))
+	require.Equal(t, `自定义渠道`, ChannelKey(201).Text())
+}
+
+// fakePayoutChannel 测试用的代付渠道,回调使用encodedCallBack
+type fakePayoutChannel struct {
+	key ChannelKey
+}
+
+func (f fakePayoutChannel) Key() ChannelKey {
+	return f.key
+}
+
+func (f fakePayoutChannel) PrivateKey() string {
+	return `key`
+}
+
+func (f fakePayoutChannel) NeedCheckPayout() (template AsyncCallBackTemplate, need bool) {
+	return encodedCallBack{}, false
+}
+
+func (f fakePayoutChannel) CreatePayoutNo(_ int64, _ decimal.Decimal) string {
+	return primitive.NewObjectID().Hex()
+}
+
+func (f fakePayoutChannel) CreatePayout(_ context.Context, _ string, _ PayoutRequest, _ string) (result *PayoutResult, err error) {
+	return &PayoutResult{Status: PaidProcessing}, nil
+}
+
+func (f fakePayoutChannel) CheckPayout(_ string) (paid PaidStatus, realAmount decimal.Decimal, err error) {
+	return Paid, decimal.New(10, 0), nil
+}
+
+// fakePayoutAccessor 测试用的代付记录存储
+type fakePayoutAccessor struct {
+	finishes int   // SetPayoutFinish调用次数
+	setErr   error // 不为nil时SetPayoutFinish返回这个错误
+}
+
+func (f *fakePayoutAccessor) SetPayoutStarted(_ int64, _, _ string, _ error) error {
+	return nil
+}
+
+func (f *fakePayoutAccessor) SetPayoutFinish(_ ChannelKey, _, _ string, _ decimal.Decimal, _ error) error {
+	f.finishes++
+
+	return f.setErr
+}
+
+func TestService_OnPayoutCallBack(t *testing.T) {
+	manager := NewManager()
+	require.NoError(t, manager.RegisterPayout(fakePayoutChannel{key: ChannelKeyEPay}))
+
+	accessor := &fakePayoutAccessor{setErr: errors.New(`数据库错误`)}
+	service := NewService(manager, logger, nil, nil, `http://example.com`, WithPayoutAccessor(accessor))
+
+	body, _ := json.Marshal(map[string]string{`orderNo`: `payout`, `sign`: `keypayout`})
+	callback := func() (string, error) {
+		result, err := service.OnPayoutCallBack(ChannelKeyEPay, `payout`, httptest.NewRequest(http.MethodPost, `/payout/3/payout`, bytes.NewReader(body)))
+		if err != nil {
+			return ``, err
+		}
+
+		data, _ := io.ReadAll(result)
+
+		return string(data), nil
+	}
+
+	_, err := callback()
+	require.Error(t, err, `保存失败时返回错误,让渠道重试`)
+
+	_, err = service.CheckPayout(ChannelKeyEPay, `payout`)
+	require.Error(t, err, `查单保存失败时返回错误`)
+
+	accessor.setErr = nil
+
+	result, err := callback()
+	require.NoError(t, err)
+	require.Equal(t, `ok`, result)
+	require.Equal(t, 3, accessor.finishes)
+
+	result, err = callback()
+	require.NoError(t, err)
+	require.Equal(t, `ok`, result)
+	require.Equal(t, 3, accessor.finishes, `重复的代付回调不再保存`)
+
+	_, _, err = manager.LoadPayoutWithTemplate(ChannelKeyBank)
+	require.Error(t, err)
+}
+
+// countedPayoutChannel 记录CreatePayout调用次数的代付渠道
+type countedPayoutChannel struct {
+	fakePayoutChannel
+	created *int
+}
+
+func (c countedPayoutChannel) CreatePayout(ctx context.Context, payoutNo string, request PayoutRequest, callbackURL string) (result *PayoutResult, err error) { //nolint:lll
+	*c.created++
+
+	return c.fakePayoutChannel.CreatePayout(ctx, payoutNo, request, callbackURL)
+}
+
+func TestService_PayoutWithoutAccessor(t *testing.T) {
+	var created int
+
+	manager := NewManager()
+	require.NoError(t, manager.RegisterPayout(countedPayoutChannel{fakePayoutChannel: fakePayoutChannel{key: ChannelKeyEPay}, created: &created}))
+
+	gin.SetMode(gin.TestMode)
+
+	engine := gin.New()
+	service := NewService(manager, logger, engine, nil, `http://example.com`)
+	service.Start()
+
+	request := PayoutRequest{Amount: decimal.New(10, 0), AccountName: `张三`, AccountNo: `6222`}
+
+	_, err := service.Payout(context.Background(), 1, ChannelKeyEPay, request)
+	require.True(t, IsNotSupported(err))
+	require.Zero(t, created, `没有代付记录存储时不请求渠道`)
+
+	_, err = service.CheckPayout(ChannelKeyEPay, `payout`)
+	require.True(t, IsNotSupported(err))
+
+	_, err = service.OnPayoutCallBack(ChannelKeyEPay, `payout`, httptest.NewRequest(http.MethodPost, `/payout/3/payout`, strings.NewReader(`{}`)))
+	require.True(t, IsNotSupported(err))
+
+	for _, route := range engine.Routes() {
+		require.NotEqual(t, `/payout/:key/:payoutNo`, route.Path, `没有代付记录存储时不注册代付回调`)
+	}
+
+	accessor := &fakePayoutAccessor{}
+	service = NewService(manager, logger, nil, nil, `http://example.com`, WithPayoutAccessor(accessor))
+
+	result, err := service.Payout(context.Background(), 1, ChannelKeyEPay, request)
+	require.NoError(t, err)
+	require.Equal(t, PaidProcessing, result.Status)
+	require.Equal(t, 1, created)
+}
@@ -1,14 +1,13 @@
 package shopclubepay
 
 import (
-	"crypto/md5"
 	"fmt"
 	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/internal/shopclub"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"io"
 	"net/url"
-	"sort"
 	"strings"
 	"time"
 )
@@ -46,64 +45,12 @@ func (p payArgument) values() url.Values {
 	return result
 }
 
-type parameter struct {
-	key   string
-	value string
-}
-
-func (p parameter) Encode() string {
-	return fmt.Sprintf(`%s=%s`, p.key, p.value)
-}
-
 func (p payArgument) sign(privateKey string) string {
-	value := p.values()
-
-	parameters := make([]parameter, 0, len(value))
-
-	for key := range value {
-		parameters = append(parameters, parameter{
-			key:   key,
-			value: value.Get(key),
-		})
-	}
-
-	sort.Slice(parameters, func(i, j int) bool {
-		return parameters[i].key < parameters[j].key
-	})
-
-	parameters = append(parameters, parameter{
-		key:   "key",
-		value: privateKey,
-	})
-
-	result := make([]string, 0, len(parameters))
-
-	for _, parameter := range parameters {
-		result = append(result, parameter.Encode())
-	}
-
-	combinedStr := strings.ToUpper(strings.Join(result, `&`))
-
-	println(`combinedStr`, combinedStr)
-
-	return fmt.Sprintf("%x", md5.Sum([]byte(combinedStr))) //nolint:gosec
-}
-
-type payResponseCode struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-}
-
-func (p payResponseCode) Validate() error {
-	if p.Code == 0 {
-		return nil
-	}
-
-	return errors.New(p.Msg)
+	return shopclub.Sign(p.values(), privateKey)
 }
 
 type payResponse struct {
-	payResponseCode
+	shopclub.ResponseCode
 	Data payResponseDetail `json:"data"`
 }
 
@@ -151,37 +98,7 @@ func (p payAsyncResponse) values() url.Values {
 }
 
 func (p payAsyncResponse) sign(privateKey string) string {
-	value := p.values()
-
-	parameters := make([]parameter, 0, len(value))
-
-	for key := range value {
-		parameters = append(parameters, parameter{
-			key:   key,
-			value: value.Get(key),
-		})
-	}
-
-	sort.Slice(parameters, func(i, j int) bool {
-		return parameters[i].key < parameters[j].key
-	})
-
-	parameters = append(parameters, parameter{
-		key:   "key",
-		value: privateKey,
-	})
-
-	result := make([]string, 0, len(parameters))
-
-	for _, parameter := range parameters {
-		result = append(result, parameter.Encode())
-	}
-
-	combinedStr := strings.ToUpper(strings.Join(result, `&`))
-
-	println(`combinedStr`, combinedStr)
-
-	return fmt.Sprintf("%x", md5.Sum([]byte(combinedStr))) //nolint:gosec
+	return shopclub.Sign(p.values(), privateKey)
 }
 
 func (p payAsyncResponse) Status() chargechannel.PaidStatus {
@@ -204,3 +121,64 @@ func (p payAsyncResponse) Result() io.Reader {
 func (p payAsyncResponse) RealPayAmount() decimal.Decimal {
 	return decimal.New(p.RealPrice, -2) // 单位为分，需要转为元
 }
+
+// TradeNo 支付平台的单号
+func (p payAsyncResponse) TradeNo() string {
+	return p.DisOrderNo
+}
+
+type queryResponse struct {
+	shopclub.ResponseCode
+	Data queryResponseDetail `json:"data"`
+}
+
+// queryResponseDetail 查单结果
+type queryResponseDetail struct {
+	MchID      int    `json:"mch_id"`       // mch_id
+	OrderNo    string `json:"order_no"`     // 订单号
+	DisOrderNo string `json:"dis_order_no"` // 支付平台的单号
+	RealPrice  int64  `json:"real_price"`   // 实际收到的金额,单位为分,未支付时为0
+	OrderPrice int64  `json:"order_price"`  // 订单原金额
+	Sign       string `json:"sign"`         // 签名
+}
+
+func (q queryResponseDetail) values() url.Values {
+	result := url.Values{}
+	result.Set(`mch_id`, fmt.Sprintf("%d", q.MchID))
+	result.Set(`order_no`, q.OrderNo)
+	result.Set(`dis_order_no`, q.DisOrderNo)
+	result.Set(`real_price`, fmt.Sprintf("%d", q.RealPrice))
+	result.Set(`order_price`, fmt.Sprintf("%d", q.OrderPrice))
+
+	return result
+}
+
+func (q queryResponseDetail) sign(privateKey string) string {
+	return shopclub.Sign(q.values(), privateKey)
+}
+
+func (q queryResponseDetail) Validate(privateKey string) error {
+	if q.sign(privateKey) != q.Sign {
+		return errors.New("签名错误")
+	}
+
+	return nil
+}
+
+// Status 查单只返回实际收到的金额,大于0时已支付;否则订单超过有效期(expired)时支付失败,还在有效期内时等待支付
+// PayApi不返回取消和超时,有效期由Service根据下单时间判断
+func (q queryResponseDetail) Status(expired bool) chargechannel.PaidStatus {
+	if q.RealPrice > 0 {
+		return chargechannel.Paid
+	}
+
+	if expired {
+		return chargechannel.PaidFail
+	}
+
+	return chargechannel.PaidProcessing
+}
+
+func (q queryResponseDetail) RealPayAmount() decimal.Decimal {
+	return decimal.New(q.RealPrice, -2) // 单位为分，需要转为元
+}
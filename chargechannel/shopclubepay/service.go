@@ -3,46 +3,66 @@ package shopclubepay
 // shopClub ePay支付
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/babybabylong/common/helpers"
 	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/internal/shopclub"
 	"github.com/fighterlyt/log"
 	"github.com/pkg/errors"
 	"github.com/shopspring/decimal"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.uber.org/zap"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"time"
 )
 
+const (
+	// defaultOrderExpire 默认的订单有效期,PayApi没有返回订单有效期,超过之后没有支付认为支付失败
+	defaultOrderExpire = time.Hour * 24
+
+	createPath = `/payApi/PayApi/CreateOrder`
+	queryPath  = `/payApi/PayApi/QueryOrder`
+)
+
 // Service 服务
 type Service struct {
-	host       string // 服务地址，包括schema 地址 端口
-	privateKey string // 商户私钥
-	mchID      int    // 商户id
+	gateway    shopclub.Client // shop_club网关
+	privateKey string          // 商户私钥
+	mchID      int             // 商户id
 	appID      int
-	client     *http.Client             // http 客户端
-	logger     log.Logger               // 日志器
 	timeout    time.Duration            // http请求超时
 	channelKey chargechannel.ChannelKey // 充值渠道key
+	expire     time.Duration            // 订单有效期
+}
+
+// Option 服务的可选配置
+type Option func(s *Service)
+
+// WithOrderExpire 订单有效期,下单之后超过这个时间还没有支付的订单查单时认为支付失败,默认是一天
+func WithOrderExpire(expire time.Duration) Option {
+	return func(s *Service) {
+		if expire > 0 {
+			s.expire = expire
+		}
+	}
 }
 
-func NewService(host, privateKey string, mchID, appID int, client *http.Client, logger log.Logger, timeout time.Duration, channelKey chargechannel.ChannelKey) *Service {
-	return &Service{
-		host:       host,
+func NewService(host, privateKey string, mchID, appID int, client *http.Client, logger log.Logger, timeout time.Duration, channelKey chargechannel.ChannelKey, options ...Option) *Service { //nolint:lll
+	service := &Service{
+		gateway:    shopclub.NewClient(host, client, logger),
 		privateKey: privateKey,
 		mchID:      mchID,
 		appID:      appID,
-		client:     client,
-		logger:     logger,
 		timeout:    timeout,
 		channelKey: channelKey,
+		expire:     defaultOrderExpire,
+	}
+
+	for _, option := range options {
+		option(service)
 	}
+
+	return service
 }
 
 func (s Service) Key() chargechannel.ChannelKey {
@@ -53,6 +73,32 @@ func (s Service) PrivateKey() string {
 	return s.privateKey
 }
 
+// currency 币种,由渠道key决定
+func (s Service) currency() string {
+	switch s.channelKey {
+	case chargechannel.ChannelKeyEPayRuble:
+		return `RUB`
+	case chargechannel.ChannelKeyEPayU:
+		return `USDT`
+	default:
+		return ``
+	}
+}
+
+// Capabilities 渠道能力
+func (s Service) Capabilities() chargechannel.Capabilities {
+	capabilities := chargechannel.Capabilities{
+		ActiveQuery:  true,
+		ExtendFields: []string{chargechannel.ExtendFieldPayCode, chargechannel.ExtendFieldUserID, chargechannel.ExtendFieldUserIP, chargechannel.ExtendFieldSuccessURL}, //nolint:lll
+	}
+
+	if currency := s.currency(); currency != `` {
+		capabilities.Currencies = []string{currency}
+	}
+
+	return capabilities
+}
+
 func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need bool) {
 	return &payAsyncResponse{}, false
 }
@@ -61,134 +107,107 @@ func (s Service) CreateOrderNo(id int64, amount decimal.Decimal) string {
 	return primitive.NewObjectID().Hex()
 }
 
-func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (payUrl, payHtml string, err error) {
+func (s Service) CreateOrder(ctx context.Context, orderNo string, amount decimal.Decimal, callbackURL string, extend *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) {
 	if extend == nil {
-		return "", "", errors.New("参数不足")
+		return nil, errors.Wrap(chargechannel.ErrInvalidArgument, "参数不足")
 	}
 
-	if payUrl, err = s.charge(ctx, orderNo, extend.PayCode, amount, extend.UserIP, extend.UserID, extend.SuccessURL, callbackURL); err != nil {
-		return "", "", errors.Wrap(err, "下单失败")
+	var detail *payResponseDetail
+
+	if detail, err = s.charge(ctx, orderNo, extend.PayCode, amount, extend.UserIP, extend.UserID, extend.SuccessURL, callbackURL); err != nil {
+		return nil, errors.Wrap(err, "下单失败")
 	}
 
-	return payUrl, "", nil
+	return &chargechannel.CreateOrderResult{PayURL: detail.PayURL, TradeNo: detail.DisOrderNo}, nil
 }
 
-func (s Service) charge(ctx context.Context, orderNo string, payCode int, amount decimal.Decimal, userIP string, userID int64, successURL, callbackURL string) (payURL string, err error) {
+func (s Service) charge(ctx context.Context, orderNo string, payCode int, amount decimal.Decimal, userIP string, userID int64, successURL, callbackURL string) (detail *payResponseDetail, err error) {
 	// 1. 校验参数
 	if amount.LessThanOrEqual(decimal.Zero) {
-		return payURL, errors.New(`订单金额必须大于0`)
+		return nil, errors.Wrap(chargechannel.ErrInvalidArgument, `订单金额必须大于0`)
 	}
 
 	if !helpers.IsURL(callbackURL) || !helpers.IsURL(successURL) {
-		return payURL, fmt.Errorf(`非法的回调地址[%s]`, callbackURL)
+		return nil, errors.Wrapf(chargechannel.ErrInvalidArgument, `非法的回调地址[%s]`, callbackURL)
 	}
 
-	// 2. 准备请求相关
+	// 2. 准备请求参数
 	var (
-		logger     = helpers.GetLogger(ctx, s.logger)
-		cancel     context.CancelFunc
-		body       io.Reader
-		resp       *http.Response
-		result     = &payResponse{}
-		resultCode = &payResponseCode{}
+		cancel context.CancelFunc
+		result = &payResponse{}
 	)
 
 	ctx, cancel = context.WithTimeout(ctx, s.timeout)
 	defer cancel()
 
-	// 3. 准备请求参数
-	if body, err = s.prepareArgument(orderNo, payCode, amount, userIP, userID, successURL, callbackURL); err != nil {
-		return payURL, errors.Wrap(err, `准备参数`)
-	}
-
-	// 5. 执行HTTP请求
-	if resp, err = s.doHTTPRequest(ctx, body); err != nil {
-		return payURL, errors.Wrap(err, `执行请求`)
-	}
-
-	// 6. 处理应答
-	defer func() {
-		_ = resp.Body.Close()
-	}()
-
-	var (
-		response []byte
-	)
-
-	if response, err = ioutil.ReadAll(resp.Body); err != nil {
-		return payURL, errors.Wrap(err, `读取应答`)
-	}
-
-	logger.Info(`读取到应答`, zap.ByteString(`应答`, response))
-
-	if resp.StatusCode != http.StatusOK {
-		return payURL, errors.New(resp.Status)
-	}
-
-	if err = json.Unmarshal(response, resultCode); err != nil {
-		return payURL, errors.Wrap(err, `解析应答错误`)
-	}
-
-	logger.Info(`应答解析成功`, zap.Any(`应答`, resultCode))
+	price := amount.Mul(decimal.NewFromInt(100)).IntPart() // 单位为分
+	argument := newPayArgument(s.mchID, payCode, orderNo, price, s.appID, userIP, fmt.Sprintf("%d", userID), callbackURL, successURL)
 
-	if err = resultCode.Validate(); err != nil {
-		return payURL, err
-	}
+	argument.Sign = argument.sign(s.privateKey)
 
-	if err = json.Unmarshal(response, result); err != nil {
-		return payURL, errors.Wrap(err, `解析应答错误`)
+	// 3. 执行请求并处理应答
+	if err = s.gateway.Post(ctx, createPath, argument, result); err != nil {
+		return nil, errors.Wrap(err, `执行请求`)
 	}
 
-	logger.Info(`应答解析成功`, zap.Any(`应答`, result))
-
-	return result.Data.PayURL, nil
+	return &result.Data, nil
 }
 
-/*doHTTPRequest 执行http请求
+/*Check 通过商户订单号查单
 参数:
-*	ctx 	context.Context	上下文
-*	body	io.Reader      	body
+*	channelOrderNo	string                  	商户订单号
 返回值:
-*	resp	*http.Response 	应答
-*	err 	error          	错误
+*	paid          	chargechannel.PaidStatus	支付状态
+*	realAmount    	decimal.Decimal         	实际支付金额
+*	tradeNo       	string                  	支付平台的单号(dis_order_no)
+*	err           	error                   	错误
 */
-func (s Service) doHTTPRequest(ctx context.Context, body io.Reader) (resp *http.Response, err error) {
-	var (
-		req *http.Request
-	)
-
-	if req, err = http.NewRequestWithContext(ctx, http.MethodPost, s.host+`/payApi/PayApi/CreateOrder`, body); err != nil {
-		return nil, errors.Wrap(err, `构建请求`)
-	}
-
-	req.Header.Set(`Content-Type`, `application/json`)
-
-	if resp, err = s.client.Do(req); err != nil {
-		return nil, errors.Wrap(err, `执行请求`)
-	}
+func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	return s.check(shopclub.NewQueryArgument(s.mchID, channelOrderNo, ``))
+}
 
-	return resp, nil
+/*CheckByDisOrderNo 通过支付平台的单号查单
+参数:
+*	disOrderNo	string                  	支付平台的单号
+返回值:
+*	paid      	chargechannel.PaidStatus	支付状态
+*	realAmount	decimal.Decimal         	实际支付金额
+*	tradeNo   	string                  	支付平台的单号(dis_order_no)
+*	err       	error                   	错误
+*/
+func (s Service) CheckByDisOrderNo(disOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	return s.check(shopclub.NewQueryArgument(s.mchID, ``, disOrderNo))
 }
 
-func (s Service) prepareArgument(orderNo string, payCode int, amount decimal.Decimal, userIP string, userID int64, successURL, callbackURL string) (reader io.Reader, err error) { //nolint:lll
-	price := amount.Mul(decimal.NewFromInt(100)).IntPart() // 单位为分
-	argument := newPayArgument(s.mchID, payCode, orderNo, price, s.appID, userIP, fmt.Sprintf("%d", userID), callbackURL, successURL)
+func (s Service) check(argument *shopclub.QueryArgument) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	result := &queryResponse{}
 
-	argument.Sign = argument.sign(s.privateKey)
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
 
-	var (
-		body []byte
-	)
+	argument.Sign = shopclub.Sign(argument.Values(), s.privateKey)
+
+	if err = s.gateway.Post(ctx, queryPath, argument, result); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `查单失败`)
+	}
 
-	if body, err = json.Marshal(argument); err != nil {
-		return nil, errors.Wrap(err, `json序列化`)
+	if err = result.Data.Validate(s.privateKey); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `验证应答`)
 	}
 
-	s.logger.Info("请求参数", zap.String("body", string(body)))
+	if err = argument.Match(result.Data.OrderNo, result.Data.DisOrderNo); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, err
+	}
 
-	return bytes.NewReader(body), nil
+	return result.Data.Status(s.expired(result.Data.OrderNo, time.Now())), result.Data.RealPayAmount(), result.Data.DisOrderNo, nil
 }
 
-func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, err error) {
-	return chargechannel.PaidUnknown, chargechannel.ErrNotSupported
+// expired 订单在now时是否已经超过有效期,订单号是CreateOrderNo生成的ObjectID,下单时间从中取得,不是时不判断过期
+func (s Service) expired(orderNo string, now time.Time) bool {
+	id, err := primitive.ObjectIDFromHex(orderNo)
+	if err != nil {
+		return false
+	}
+
+	return now.After(id.Timestamp().Add(s.expire))
 }
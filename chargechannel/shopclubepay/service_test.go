@@ -2,11 +2,15 @@ package shopclubepay
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/internal/shopclub"
 	"github.com/fighterlyt/log"
 	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
@@ -35,7 +39,7 @@ func TestService_CreateOrderNo(t *testing.T) {
 
 	orderNo := service.CreateOrderNo(0, decimal.New(10, 0))
 
-	payUrl, _, err := service.CreateOrder(context.Background(), orderNo, decimal.NewFromInt(1001), `http://baidu.com`, &chargechannel.CreateOrderExtendParam{
+	result, err := service.CreateOrder(context.Background(), orderNo, decimal.NewFromInt(1001), `http://baidu.com`, &chargechannel.CreateOrderExtendParam{
 		PayCode:    70104,
 		UserID:     1,
 		UserIP:     "47.91.120.169",
@@ -44,5 +48,71 @@ func TestService_CreateOrderNo(t *testing.T) {
 
 	require.NoError(t, err)
 
-	t.Log("payURl:", payUrl)
+	t.Log("payURl:", result.PayURL)
+}
+
+func TestService_Check(t *testing.T) {
+	const privateKey = `5516ec2da46b080c26ca04b0faee6537`
+
+	var (
+		waiting = primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Minute)).Hex()
+		expired = primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Hour * 2)).Hex()
+	)
+
+	realPrices := map[string]int64{`paid`: 100100, waiting: 0, expired: 0}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		argument := shopclub.QueryArgument{}
+		_ = json.NewDecoder(r.Body).Decode(&argument)
+
+		if r.URL.Path != queryPath || shopclub.Sign(argument.Values(), privateKey) != argument.Sign {
+			_ = json.NewEncoder(w).Encode(shopclub.ResponseCode{Code: 1, Msg: `签名错误`})
+			return
+		}
+
+		orderNo := argument.OrderNo
+		if orderNo == `` {
+			orderNo = argument.DisOrderNo[len(`dis-`):]
+		}
+
+		realPrice, exist := realPrices[orderNo]
+		if !exist {
+			_ = json.NewEncoder(w).Encode(shopclub.ResponseCode{Code: 1, Msg: `订单不存在`})
+			return
+		}
+
+		result := queryResponse{Data: queryResponseDetail{MchID: argument.MchID, OrderNo: orderNo, DisOrderNo: `dis-` + orderNo, RealPrice: realPrice, OrderPrice: 100100}}
+		result.Data.Sign = result.Data.sign(privateKey)
+
+		_ = json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	service := NewService(server.URL, privateKey, 152, 52, server.Client(), logger, time.Second, chargechannel.ChannelKeyEPayRuble,
+		WithOrderExpire(time.Hour))
+
+	paid, realAmount, tradeNo, err := service.Check(`paid`)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid)
+	require.Equal(t, `dis-paid`, tradeNo)
+	require.True(t, realAmount.Equal(decimal.New(1001, 0)))
+
+	paid, _, _, err = service.CheckByDisOrderNo(`dis-paid`)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid)
+
+	paid, _, _, err = service.Check(waiting)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid, `有效期内没有支付`)
+
+	paid, _, _, err = service.Check(expired)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidFail, paid, `超过有效期没有支付`)
+
+	paid, _, _, err = service.CheckByDisOrderNo(`dis-` + expired)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidFail, paid)
+
+	_, _, _, err = service.Check(`unknown`)
+	require.Error(t, err)
 }
@@ -0,0 +1,199 @@
+package trc20
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+)
+
+const (
+	pageLimit     = 200
+	receiptResult = `SUCCESS`
+)
+
+// gridClient 基于TronGrid http接口的节点客户端
+type gridClient struct {
+	host   string       // 服务地址，包括schema 地址 端口
+	apiKey string       // TronGrid的api key,可以为空
+	client *http.Client // http 客户端
+	logger log.Logger   // 日志器
+}
+
+/*NewGridClient 新建TronGrid客户端,也可以用于自建的全节点(需要开启event api)
+参数:
+*	host  	string      	服务地址，例如https://api.trongrid.io
+*	apiKey	string      	TRON-PRO-API-KEY,可以为空
+*	client	*http.Client	http客户端
+*	logger	log.Logger  	日志器
+返回值:
+*	Client	Client      	客户端
+*/
+func NewGridClient(host, apiKey string, client *http.Client, logger log.Logger) Client {
+	return &gridClient{host: host, apiKey: apiKey, client: client, logger: logger}
+}
+
+func (g gridClient) NowBlock(ctx context.Context) (number int64, err error) {
+	result := &nowBlockResponse{}
+
+	if err = g.do(ctx, http.MethodPost, `/wallet/getnowblock`, nil, result); err != nil {
+		return 0, errors.Wrap(err, `获取最新区块`)
+	}
+
+	return result.BlockHeader.RawData.Number, nil
+}
+
+func (g gridClient) Transfers(ctx context.Context, contract, address string, since time.Time) (transfers []Transfer, err error) {
+	argument := url.Values{}
+	argument.Set(`only_to`, `true`)
+	argument.Set(`contract_address`, contract)
+	argument.Set(`min_timestamp`, fmt.Sprintf(`%d`, since.UnixMilli()))
+	argument.Set(`limit`, fmt.Sprintf(`%d`, pageLimit))
+
+	for {
+		result := &transfersResponse{}
+
+		if err = g.do(ctx, http.MethodGet, `/v1/accounts/`+address+`/transactions/trc20?`+argument.Encode(), nil, result); err != nil {
+			return nil, errors.Wrap(err, `查询转账`)
+		}
+
+		if !result.Success {
+			return nil, fmt.Errorf(`查询转账失败[%s]`, result.Error)
+		}
+
+		for _, data := range result.Data {
+			var transfer Transfer
+
+			if transfer, err = g.convert(ctx, data); err != nil {
+				return nil, errors.Wrapf(err, `转换交易[%s]`, data.TransactionID)
+			}
+
+			if transfer.TxID != `` {
+				transfers = append(transfers, transfer)
+			}
+		}
+
+		if result.Meta.Fingerprint == `` {
+			return transfers, nil
+		}
+
+		argument.Set(`fingerprint`, result.Meta.Fingerprint)
+	}
+}
+
+/*convert 转换TronGrid返回的转账记录,接口中没有区块高度，需要再查询一次交易信息
+参数:
+*	ctx     	context.Context 	上下文
+*	data    	transferResponse	转账记录
+返回值:
+*	transfer	Transfer        	转账，执行失败的交易返回零值,还没有打包的交易BlockNumber为0
+*	err     	error           	错误
+*/
+func (g gridClient) convert(ctx context.Context, data transferResponse) (transfer Transfer, err error) {
+	var value decimal.Decimal
+
+	if value, err = decimal.NewFromString(data.Value); err != nil {
+		return transfer, errors.Wrap(err, `解析金额`)
+	}
+
+	info := &transactionInfoResponse{}
+
+	if err = g.do(ctx, http.MethodPost, `/wallet/gettransactioninfobyid`, transactionInfoRequest{Value: data.TransactionID}, info); err != nil {
+		return transfer, errors.Wrap(err, `查询交易信息`)
+	}
+
+	transfer = Transfer{
+		TxID:      data.TransactionID,
+		From:      data.From,
+		To:        data.To,
+		Value:     value.Shift(-data.TokenInfo.Decimals),
+		Timestamp: time.UnixMilli(data.BlockTimestamp),
+	}
+
+	// 还没有打包的交易返回{},作为没有确认的转账,不能当作成功
+	if info.ID == `` || info.BlockNumber == 0 {
+		return transfer, nil
+	}
+
+	if info.Receipt.Result != receiptResult {
+		return Transfer{}, nil
+	}
+
+	transfer.BlockNumber = info.BlockNumber
+
+	return transfer, nil
+}
+
+/*do 执行http请求并解析应答
+参数:
+*	ctx     	context.Context	上下文
+*	method  	string         	http方法
+*	path    	string         	路径，包括query
+*	argument	interface{}    	请求body，为nil时不发送
+*	value   	interface{}    	应答
+返回值:
+*	err     	error          	错误
+*/
+func (g gridClient) do(ctx context.Context, method, path string, argument, value interface{}) (err error) {
+	var (
+		logger   = helpers.GetLogger(ctx, g.logger)
+		body     io.Reader
+		req      *http.Request
+		resp     *http.Response
+		data     []byte
+		response []byte
+	)
+
+	if argument != nil {
+		if data, err = json.Marshal(argument); err != nil {
+			return errors.Wrap(err, `json序列化`)
+		}
+
+		body = bytes.NewReader(data)
+	}
+
+	if req, err = http.NewRequestWithContext(ctx, method, g.host+path, body); err != nil {
+		return errors.Wrap(err, `构建请求`)
+	}
+
+	req.Header.Set(`Content-Type`, `application/json`)
+
+	if g.apiKey != `` {
+		req.Header.Set(`TRON-PRO-API-KEY`, g.apiKey)
+	}
+
+	if resp, err = g.client.Do(req); err != nil {
+		return errors.Wrap(err, `执行请求`)
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if response, err = ioutil.ReadAll(resp.Body); err != nil {
+		return errors.Wrap(err, `读取应答`)
+	}
+
+	logger.Debug(`读取到应答`, zap.String(`路径`, path), zap.ByteString(`应答`, response))
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	if err = json.Unmarshal(response, value); err != nil {
+		return errors.Wrap(err, `解析应答错误`)
+	}
+
+	return nil
+}
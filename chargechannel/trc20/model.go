@@ -0,0 +1,94 @@
+package trc20
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// amountStep 金额尾数步长,同一地址上同时存在的订单，通过尾数区分
+	amountStep = `0.0001`
+	// amountSlots 同一地址同一订单金额最多同时存在的订单数
+	amountSlots = 100
+	// network 转账说明中的网络名称
+	network = `TRC20`
+)
+
+// Client TRON节点客户端
+type Client interface {
+	// NowBlock 当前最新的区块高度
+	NowBlock(ctx context.Context) (number int64, err error)
+	// Transfers 查询address在since之后收到的contract代币转账
+	Transfers(ctx context.Context, contract, address string, since time.Time) (transfers []Transfer, err error)
+}
+
+// Transfer TRC20转账
+type Transfer struct {
+	TxID        string          // 交易哈希
+	From        string          // 付款地址
+	To          string          // 收款地址
+	Value       decimal.Decimal // 转账金额,已经按代币精度换算
+	BlockNumber int64           // 所在区块高度,还没有打包时为0
+	Timestamp   time.Time       // 区块时间
+}
+
+/*confirmations 在当前区块高度为head时,转账的确认数,所在区块本身算一个确认
+参数:
+*	head 	int64	当前区块高度
+返回值:
+*	int64	int64	确认数,还没有打包时为0
+*/
+func (t Transfer) confirmations(head int64) int64 {
+	if t.BlockNumber <= 0 || head < t.BlockNumber {
+		return 0
+	}
+
+	return head - t.BlockNumber + 1
+}
+
+type nowBlockResponse struct {
+	BlockID     string `json:"blockID"`
+	BlockHeader struct {
+		RawData struct {
+			Number    int64 `json:"number"`
+			Timestamp int64 `json:"timestamp"`
+		} `json:"raw_data"`
+	} `json:"block_header"`
+}
+
+type transfersResponse struct {
+	Success bool               `json:"success"`
+	Error   string             `json:"error"`
+	Data    []transferResponse `json:"data"`
+	Meta    struct {
+		Fingerprint string `json:"fingerprint"`
+	} `json:"meta"`
+}
+
+type transferResponse struct {
+	TransactionID string `json:"transaction_id"`
+	TokenInfo     struct {
+		Address  string `json:"address"`
+		Decimals int32  `json:"decimals"`
+	} `json:"token_info"`
+	BlockTimestamp int64  `json:"block_timestamp"` // 毫秒
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Type           string `json:"type"`
+	Value          string `json:"value"` // 最小单位
+}
+
+type transactionInfoRequest struct {
+	Value string `json:"value"`
+}
+
+type transactionInfoResponse struct {
+	ID             string `json:"id"`
+	BlockNumber    int64  `json:"blockNumber"`
+	BlockTimeStamp int64  `json:"blockTimeStamp"`
+	Receipt        struct {
+		Result string `json:"result"`
+	} `json:"receipt"`
+}
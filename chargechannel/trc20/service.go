@@ -0,0 +1,246 @@
+package trc20
+
+// TRC20 USDT 链上充值
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"time"
+
+	"github.com/babybabylong/common/helpers"
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/fighterlyt/log"
+	"github.com/pkg/errors"
+	"github.com/shopspring/decimal"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Service 服务
+type Service struct {
+	client        Client        // 节点客户端
+	contract      string        // 代币合约地址
+	confirmations int64         // 需要的确认数
+	pool          *deposit.Pool // 收款地址池
+	logger        log.Logger    // 日志器
+	grace         time.Duration // 订单到期之后继续等待转账的时间
+	timeout       time.Duration // 查询节点超时
+}
+
+/*NewService 新建服务
+参数:
+*	client       	Client       	节点客户端
+*	contract     	string       	USDT合约地址
+*	addresses    	[]string     	收款地址
+*	confirmations	int64        	需要的确认数，达到之后才认为已支付
+*	ttl          	time.Duration	订单有效期，只接受有效期内的转账
+*	grace        	time.Duration	到期之后继续等待的时间,到期前发出的转账可能还没有打包或者被TronGrid索引,超过之后没有到账认为支付失败
+*	timeout      	time.Duration	查询节点超时,必须大于0
+*	store        	deposit.Store	订单存储,需要持久化,重启之后继续查单
+*	logger       	log.Logger   	日志器
+返回值:
+*	*Service     	*Service     	服务
+*	error        	error        	错误
+*/
+func NewService(client Client, contract string, addresses []string, confirmations int64, ttl, grace, timeout time.Duration, store deposit.Store, logger log.Logger) (*Service, error) { //nolint:lll
+	if client == nil {
+		return nil, errors.New(`节点客户端不能为空`)
+	}
+
+	if !helpers.ValidateAddress(contract) {
+		return nil, fmt.Errorf(`非法的合约地址[%s]`, contract)
+	}
+
+	for _, address := range addresses {
+		if !helpers.ValidateAddress(address) {
+			return nil, fmt.Errorf(`非法的收款地址[%s]`, address)
+		}
+	}
+
+	if confirmations <= 0 {
+		return nil, errors.New(`确认数必须大于0`)
+	}
+
+	if grace < 0 {
+		return nil, errors.New(`等待时间不能小于0`)
+	}
+
+	if timeout <= 0 {
+		return nil, errors.New(`查询超时必须大于0`)
+	}
+
+	pool, err := deposit.NewPool(store, addresses, decimal.RequireFromString(amountStep), amountSlots, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, `收款地址池`)
+	}
+
+	return &Service{
+		client:        client,
+		contract:      contract,
+		confirmations: confirmations,
+		pool:          pool,
+		logger:        logger,
+		grace:         grace,
+		timeout:       timeout,
+	}, nil
+}
+
+func (s Service) Key() chargechannel.ChannelKey {
+	return chargechannel.ChannelKeyTrc
+}
+
+// PrivateKey 链上充值没有回调，也就没有私钥
+func (s Service) PrivateKey() string {
+	return ``
+}
+
+// Capabilities 渠道能力,链上充值只能主动查单
+func (s Service) Capabilities() chargechannel.Capabilities {
+	return chargechannel.Capabilities{
+		ActiveQuery: true,
+		Currencies:  []string{`USDT`},
+	}
+}
+
+// NeedCheck 链上充值只能主动查单
+func (s Service) NeedCheck() (template chargechannel.AsyncCallBackTemplate, need bool) {
+	return nil, true
+}
+
+func (s Service) CreateOrderNo(_ int64, _ decimal.Decimal) string {
+	return primitive.NewObjectID().Hex()
+}
+
+/*CreateOrder 创建订单,分配收款地址和精确支付金额
+参数:
+*	_      	context.Context                      	上下文
+*	orderNo	string                               	商户订单号
+*	amount 	decimal.Decimal                      	订单金额
+*	_      	string                               	回调地址(无用)
+*	_      	*chargechannel.CreateOrderExtendParam	额外参数(无用)
+返回值:
+*	result 	*chargechannel.CreateOrderResult	转账说明和收款账户
+*	err    	error                           	错误
+*/
+func (s Service) CreateOrder(_ context.Context, orderNo string, amount decimal.Decimal, _ string, _ *chargechannel.CreateOrderExtendParam) (result *chargechannel.CreateOrderResult, err error) { //nolint:lll
+	var order deposit.Order
+
+	if order, err = s.pool.Allocate(orderNo, amount, deposit.Watch{}); err != nil {
+		return nil, errors.Wrap(err, `分配收款地址`)
+	}
+
+	payHtml := fmt.Sprintf(`<p>请在%s之前向TRC20地址<b>%s</b>转账<b>%s</b> USDT,金额必须完全一致</p>`,
+		order.ExpireAt.Format(time.RFC3339), html.EscapeString(order.Account), order.PayAmount.String())
+
+	return &chargechannel.CreateOrderResult{
+		PayHTML:     payHtml,
+		QRContent:   order.Account,
+		Instruction: &chargechannel.TransferInstruction{BankName: network, AccountNo: order.Account, Amount: order.PayAmount},
+		ExpireAt:    order.ExpireAt,
+	}, nil
+}
+
+/*Order 加载订单的收款地址和精确支付金额
+参数:
+*	orderNo	string       	商户订单号
+返回值:
+*	order  	deposit.Order	订单
+*	err    	error        	错误
+*/
+func (s Service) Order(orderNo string) (order deposit.Order, err error) {
+	return s.pool.Load(orderNo)
+}
+
+/*Check 查单,在订单有效期内收到精确金额的转账，并且确认数足够时认为已支付。
+结果保存在订单上，重复查单返回同样的结果，直到Service保存结果之后调用Release才释放收款地址
+参数:
+*	channelOrderNo	string                  	商户订单号
+返回值:
+*	paid          	chargechannel.PaidStatus	支付状态
+*	realAmount    	decimal.Decimal         	实际支付金额
+*	tradeNo       	string                  	到账的交易哈希,支付成功时才有
+*	err           	error                   	错误
+*/
+func (s Service) Check(channelOrderNo string) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	var (
+		order     deposit.Order
+		transfers []Transfer
+		head      int64
+	)
+
+	if order, err = s.pool.Load(channelOrderNo); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `加载订单`)
+	}
+
+	if order.Finished() {
+		return order.Status, order.RealAmount, order.TradeNo, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	if transfers, err = s.client.Transfers(ctx, s.contract, order.Account, order.CreatedAt.Truncate(time.Second)); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `查询转账`)
+	}
+
+	transfer, found := s.match(order, transfers)
+
+	if !found {
+		// 到期前发出的转账可能晚一些才被索引,超过等待时间之后才认为支付失败
+		if order.Expired(time.Now().Add(-s.grace)) {
+			order.Status = chargechannel.PaidFail
+
+			return s.save(order)
+		}
+
+		return chargechannel.PaidProcessing, decimal.Zero, ``, nil
+	}
+
+	if head, err = s.client.NowBlock(ctx); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `获取最新区块`)
+	}
+
+	if transfer.confirmations(head) < s.confirmations {
+		return chargechannel.PaidProcessing, decimal.Zero, ``, nil
+	}
+
+	s.logger.Info(`TRC20订单到账`, zap.String(`订单号`, channelOrderNo), zap.String(`交易`, transfer.TxID),
+		zap.String(`金额`, transfer.Value.String()))
+
+	order.Status, order.RealAmount, order.TradeNo = chargechannel.Paid, transfer.Value, transfer.TxID
+
+	return s.save(order)
+}
+
+// save 保存订单的最终结果,保存失败时返回PaidUnknown,下次查单重新计算
+func (s Service) save(order deposit.Order) (paid chargechannel.PaidStatus, realAmount decimal.Decimal, tradeNo string, err error) {
+	if err = s.pool.Update(order); err != nil {
+		return chargechannel.PaidUnknown, decimal.Zero, ``, errors.Wrap(err, `保存查单结果`)
+	}
+
+	return order.Status, order.RealAmount, order.TradeNo, nil
+}
+
+// Release 结果已经由Service保存，释放收款地址上的金额尾数
+func (s Service) Release(orderNo string) error {
+	return s.pool.Release(orderNo)
+}
+
+// match 在转账中找到订单对应的那一笔,时间在订单有效期内(区块时间精确到秒)，收款地址和金额完全一致
+func (s Service) match(order deposit.Order, transfers []Transfer) (transfer Transfer, found bool) {
+	for _, transfer = range transfers {
+		if transfer.To != order.Account || !transfer.Value.Equal(order.PayAmount) {
+			continue
+		}
+
+		if transfer.Timestamp.Before(order.CreatedAt.Truncate(time.Second)) || transfer.Timestamp.After(order.ExpireAt) {
+			continue
+		}
+
+		return transfer, true
+	}
+
+	return transfer, false
+}
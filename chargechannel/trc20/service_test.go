@@ -0,0 +1,306 @@
+package trc20
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/babybabylong/first-business/chargechannel"
+	"github.com/babybabylong/first-business/chargechannel/deposit"
+	"github.com/fighterlyt/log"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	contract = `TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t`
+	addressA = `TLa2f6VPqDgRE67v1736s7bJ8Ray5wYjU7`
+	addressB = `TNXoiAJ3dct8Fjg4M9fkLFh9S2v9TXc32G`
+	payer    = `TKHuVq1oKVruCGLvqVexFs6dawKv6fQgFs`
+)
+
+var (
+	logger log.Logger
+	err    error
+)
+
+func TestMain(m *testing.M) {
+	if logger, err = log.NewEasyLogger(true, false, ``, `test`); err != nil {
+		panic(err.Error())
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeNode 进程内的TronGrid节点,只实现了用到的接口
+type fakeNode struct {
+	lock      sync.Mutex
+	head      int64
+	transfers []fakeTransfer
+}
+
+type fakeTransfer struct {
+	transferResponse
+	block   int64
+	pending bool // 还没有打包,交易信息返回{}
+}
+
+func (f *fakeNode) transfer(to string, value decimal.Decimal) string {
+	return f.transferAt(to, value, time.Now())
+}
+
+// transferAt 区块时间是at的转账,at早于现在时相当于转账被延迟索引
+func (f *fakeNode) transferAt(to string, value decimal.Decimal, at time.Time) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data := transferResponse{
+		TransactionID:  strconv.Itoa(len(f.transfers) + 1),
+		BlockTimestamp: at.UnixMilli(),
+		From:           payer,
+		To:             to,
+		Type:           `Transfer`,
+		Value:          value.Shift(6).String(),
+	}
+	data.TokenInfo.Address = contract
+	data.TokenInfo.Decimals = 6
+
+	f.transfers = append(f.transfers, fakeTransfer{transferResponse: data, block: f.head})
+
+	return data.TransactionID
+}
+
+// pend 转账还没有打包,直到pack之前交易信息都返回{}
+func (f *fakeNode) pend(to string, value decimal.Decimal) string {
+	txID := f.transfer(to, value)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.transfers[len(f.transfers)-1].pending = true
+
+	return txID
+}
+
+// pack 把还没有打包的转账打包进当前区块
+func (f *fakeNode) pack() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i := range f.transfers {
+		if f.transfers[i].pending {
+			f.transfers[i].pending, f.transfers[i].block = false, f.head
+		}
+	}
+}
+
+func (f *fakeNode) mine(blocks int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.head += blocks
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	switch {
+	case r.URL.Path == `/wallet/getnowblock`:
+		result := nowBlockResponse{}
+		result.BlockHeader.RawData.Number = f.head
+		_ = json.NewEncoder(w).Encode(result)
+	case r.URL.Path == `/wallet/gettransactioninfobyid`:
+		argument := transactionInfoRequest{}
+		_ = json.NewDecoder(r.Body).Decode(&argument)
+
+		result := transactionInfoResponse{}
+
+		for _, transfer := range f.transfers {
+			if transfer.TransactionID == argument.Value && !transfer.pending {
+				result.ID, result.BlockNumber = transfer.TransactionID, transfer.block
+				result.Receipt.Result = receiptResult
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(result)
+	case strings.HasSuffix(r.URL.Path, `/transactions/trc20`):
+		address := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, `/v1/accounts/`), `/transactions/trc20`)
+		since, _ := strconv.ParseInt(r.URL.Query().Get(`min_timestamp`), 10, 64)
+		result := transfersResponse{Success: true}
+
+		for _, transfer := range f.transfers {
+			if transfer.To == address && transfer.TokenInfo.Address == r.URL.Query().Get(`contract_address`) &&
+				transfer.BlockTimestamp >= since {
+				result.Data = append(result.Data, transfer.transferResponse)
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(result)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestService(t *testing.T, ttl, grace time.Duration) (*Service, *fakeNode) {
+	node := &fakeNode{head: 100}
+	server := httptest.NewServer(node)
+	t.Cleanup(server.Close)
+
+	client := NewGridClient(server.URL, ``, server.Client(), logger)
+
+	service, err := NewService(client, contract, []string{addressA, addressB}, 3, ttl, grace, time.Second, deposit.NewMemoryStore(time.Hour), logger)
+	require.NoError(t, err)
+
+	return service, node
+}
+
+func TestService_CreateOrder(t *testing.T) {
+	service, _ := newTestService(t, time.Hour, 0)
+
+	amount := decimal.New(10, 0)
+	payAmounts := make(map[string]struct{})
+
+	for i := 0; i < 4; i++ {
+		orderNo := service.CreateOrderNo(0, amount)
+
+		result, err := service.CreateOrder(context.Background(), orderNo, amount, ``, nil)
+		require.NoError(t, err)
+
+		order, err := service.Order(orderNo)
+		require.NoError(t, err)
+		require.Contains(t, result.PayHTML, order.Account)
+		require.Contains(t, result.PayHTML, order.PayAmount.String())
+		require.Equal(t, order.Account, result.QRContent)
+		require.True(t, order.PayAmount.Equal(result.Instruction.Amount))
+
+		payAmounts[order.Account+order.PayAmount.String()] = struct{}{}
+	}
+
+	require.Len(t, payAmounts, 4, `同一地址上的订单金额必须不同`)
+}
+
+func TestService_Check(t *testing.T) {
+	service, node := newTestService(t, time.Hour, 0)
+
+	orderNo := service.CreateOrderNo(0, decimal.New(10, 0))
+	_, err := service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), ``, nil)
+	require.NoError(t, err)
+
+	order, err := service.Order(orderNo)
+	require.NoError(t, err)
+
+	paid, _, _, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid)
+
+	node.transfer(order.Account, order.PayAmount.Add(decimal.New(1, -2)))
+	txID := node.transfer(order.Account, order.PayAmount)
+
+	paid, _, _, err = service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid, `确认数不足`)
+
+	node.mine(2)
+
+	paid, realAmount, tradeNo, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid)
+	require.True(t, realAmount.Equal(order.PayAmount))
+	require.Equal(t, txID, tradeNo, `交易号是到账的交易`)
+
+	require.NoError(t, service.Release(orderNo))
+
+	paid, realAmount, _, err = service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid, `释放之后重复查单返回同样的结果`)
+	require.True(t, realAmount.Equal(order.PayAmount))
+
+	order, err = service.Order(orderNo)
+	require.NoError(t, err)
+	require.True(t, order.Released, `Service保存结果之后释放`)
+	require.NotEmpty(t, order.TradeNo)
+}
+
+func TestService_CheckExpired(t *testing.T) {
+	service, node := newTestService(t, time.Millisecond*50, time.Millisecond*100)
+
+	late := service.CreateOrderNo(0, decimal.New(10, 0))
+	_, err := service.CreateOrder(context.Background(), late, decimal.New(10, 0), ``, nil)
+	require.NoError(t, err)
+
+	orderNo := service.CreateOrderNo(0, decimal.New(20, 0))
+	_, err = service.CreateOrder(context.Background(), orderNo, decimal.New(20, 0), ``, nil)
+	require.NoError(t, err)
+
+	order, err := service.Order(late)
+	require.NoError(t, err)
+
+	time.Sleep(time.Millisecond * 70)
+
+	paid, _, _, err := service.Check(late)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid, `到期之后在等待时间内不认为支付失败`)
+
+	node.transferAt(order.Account, order.PayAmount, order.ExpireAt.Add(-time.Millisecond*10))
+	node.mine(2)
+
+	paid, realAmount, _, err := service.Check(late)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid, `到期前发出但是延迟索引的转账`)
+	require.True(t, realAmount.Equal(order.PayAmount))
+
+	time.Sleep(time.Millisecond * 100)
+
+	paid, _, _, err = service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidFail, paid, `超过等待时间`)
+}
+
+func TestNewService(t *testing.T) {
+	client := NewGridClient(`http://127.0.0.1`, ``, http.DefaultClient, logger)
+
+	_, err := NewService(client, contract, []string{addressA}, 3, time.Hour, 0, 0, deposit.NewMemoryStore(time.Hour), logger)
+	require.Error(t, err, `查询超时为0时每次查询都已经超时`)
+
+	_, err = NewService(client, contract, []string{addressA}, 3, time.Hour, -time.Second, time.Second, deposit.NewMemoryStore(time.Hour), logger)
+	require.Error(t, err)
+}
+
+func TestService_CheckPending(t *testing.T) {
+	service, node := newTestService(t, time.Hour, 0)
+
+	orderNo := service.CreateOrderNo(0, decimal.New(10, 0))
+	_, err := service.CreateOrder(context.Background(), orderNo, decimal.New(10, 0), ``, nil)
+	require.NoError(t, err)
+
+	order, err := service.Order(orderNo)
+	require.NoError(t, err)
+
+	node.pend(order.Account, order.PayAmount)
+	node.mine(10)
+
+	paid, _, _, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid, `还没有打包的转账没有确认`)
+
+	node.pack()
+
+	paid, _, _, err = service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.PaidProcessing, paid, `刚打包时确认数不足`)
+
+	node.mine(2)
+
+	paid, realAmount, _, err := service.Check(orderNo)
+	require.NoError(t, err)
+	require.Equal(t, chargechannel.Paid, paid)
+	require.True(t, realAmount.Equal(order.PayAmount))
+}